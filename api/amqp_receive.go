@@ -0,0 +1,70 @@
+package main
+
+import (
+	"log"
+	"os"
+
+	"github.com/streadway/amqp"
+)
+
+// runInvalidationConsumer feeds events published by any replica, this one
+// included, to cache.Invalidate.
+func runInvalidationConsumer(cache *CachedUserRepository) {
+	conn, err := amqp.Dial(os.Getenv("RABBITMQ_CONN_PATH"))
+	if err != nil {
+		log.Fatalf("Failed to connect to RabbitMQ: %s", err)
+	}
+	defer conn.Close()
+
+	ch, err := conn.Channel()
+	if err != nil {
+		log.Fatalf("Failed to open a channel: %s", err)
+	}
+	defer ch.Close()
+
+	err = ch.ExchangeDeclare(
+		userEventsExchange,
+		"fanout",
+		false,
+		false,
+		false,
+		false,
+		nil,
+	)
+	if err != nil {
+		log.Fatalf("Failed to declare an exchange: %s", err)
+	}
+
+	q, err := ch.QueueDeclare(
+		"",
+		false,
+		true,
+		true,
+		false,
+		nil,
+	)
+	if err != nil {
+		log.Fatalf("Failed to declare a queue: %s", err)
+	}
+
+	if err = ch.QueueBind(q.Name, "", userEventsExchange, false, nil); err != nil {
+		log.Fatalf("Failed to bind a queue: %s", err)
+	}
+
+	msgs, err := ch.Consume(
+		q.Name,
+		"",
+		true,
+		true,
+		false,
+		false,
+		nil,
+	)
+	if err != nil {
+		log.Fatalf("Failed to register a consumer: %s", err)
+	}
+
+	for d := range msgs {
+		cache.Invalidate(d.Body)
+	}
+}
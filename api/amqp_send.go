@@ -7,6 +7,10 @@ import (
 	"github.com/streadway/amqp"
 )
 
+// userEventsExchange fans every notifier event out to all api replicas so
+// they can drop cached users.
+const userEventsExchange = "user_events"
+
 func runPublisher(send chan []byte) {
     amqpPath := os.Getenv("RABBITMQ_CONN_PATH")
 	conn, err := amqp.Dial(amqpPath)
@@ -33,6 +37,19 @@ func runPublisher(send chan []byte) {
 		log.Fatalf("Failed to declare a queue: %s", err)
 	}
 
+	err = ch.ExchangeDeclare(
+		userEventsExchange,
+		"fanout",
+		false,
+		false,
+		false,
+		false,
+		nil,
+	)
+	if err != nil {
+		log.Fatalf("Failed to declare an exchange: %s", err)
+	}
+
 	for {
 		body := <-send
 		err = ch.Publish(
@@ -45,5 +62,22 @@ func runPublisher(send chan []byte) {
 				Body:        body,
 			},
 		)
+		if err != nil {
+			log.Println("Failed to publish a message:", err)
+		}
+
+		err = ch.Publish(
+			userEventsExchange,
+			"",
+			false,
+			false,
+			amqp.Publishing{
+				ContentType: "text/plain",
+				Body:        body,
+			},
+		)
+		if err != nil {
+			log.Println("Failed to publish a message:", err)
+		}
 	}
 }
@@ -0,0 +1,386 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	apiKeyPrefix     = "cake_"
+	maxAPIKeys       = 20
+	maxAPIKeyNameLen = 64
+	// apiKeyUseResolution is how precisely the last use of a key is kept,
+	// recording every single one would write on every request.
+	apiKeyUseResolution = time.Minute
+)
+
+var (
+	errInvalidAPIKey  = errors.New("api key is not valid")
+	errExpiredAPIKey  = errors.New("api key has expired")
+	errNoSuchAPIKey   = errors.New("there is no such api key")
+	errAPIKeyNotHere  = errors.New("api keys are not accepted here")
+	errTooManyAPIKeys = errors.New("too many api keys, revoke some first")
+)
+
+// apiKeyScopes are what keys may be allowed to do, the value tells whether
+// only admins can hand the scope out.
+var apiKeyScopes = map[string]bool{
+	"profile:read":  false,
+	"profile:write": false,
+	"admin:read":    true,
+	"admin:ban":     true,
+}
+
+// APIKey lets scripts act as a user without the password, but only on
+// routes that accept one of its scopes. Only a hash of the secret part is
+// stored: the key is shown once, when it is created.
+type APIKey struct {
+	ID        string
+	Email     string
+	Name      string
+	Scopes    []string
+	Hash      string
+	CreatedAt time.Time
+	// ExpiresAt is zero for keys that never expire.
+	ExpiresAt time.Time
+	// LastUsedAt is zero for keys never used yet.
+	LastUsedAt time.Time
+}
+
+type CreateAPIKeyParams struct {
+	Name      string     `json:"name"`
+	Scopes    []string   `json:"scopes"`
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+type APIKeyResponse struct {
+	ID         string     `json:"id"`
+	Name       string     `json:"name"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	Key        string     `json:"key,omitempty"`
+}
+
+func hashAPIKeySecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// newAPIKey returns a key for u and what to hand out for it,
+// "cake_<id>_<secret>".
+func newAPIKey(u User, params CreateAPIKeyParams, now time.Time) (APIKey, string, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return APIKey{}, "", err
+	}
+
+	secret, err := randomToken()
+	if err != nil {
+		return APIKey{}, "", err
+	}
+
+	key := APIKey{
+		ID:        hex.EncodeToString(id),
+		Email:     u.Email,
+		Name:      params.Name,
+		Scopes:    params.Scopes,
+		Hash:      hashAPIKeySecret(secret),
+		CreatedAt: now,
+	}
+	if params.ExpiresAt != nil {
+		key.ExpiresAt = *params.ExpiresAt
+	}
+
+	return key, apiKeyPrefix + key.ID + "_" + secret, nil
+}
+
+// checkAPIKey finds the key token is and checks its secret and expiry.
+func checkAPIKey(ctx context.Context, ur UserRepository, token string, now time.Time) (APIKey, error) {
+	id, secret, ok := strings.Cut(strings.TrimPrefix(token, apiKeyPrefix), "_")
+	if !ok {
+		return APIKey{}, errInvalidAPIKey
+	}
+
+	key, err := ur.GetAPIKey(ctx, id)
+	if err != nil {
+		return APIKey{}, errInvalidAPIKey
+	}
+
+	if subtle.ConstantTimeCompare([]byte(hashAPIKeySecret(secret)), []byte(key.Hash)) != 1 {
+		return APIKey{}, errInvalidAPIKey
+	}
+
+	if !key.ExpiresAt.IsZero() && !key.ExpiresAt.After(now) {
+		return APIKey{}, errExpiredAPIKey
+	}
+	return key, nil
+}
+
+// allows checks that the key holds every one of scopes. No scopes means the
+// route is not open to keys at all.
+func (k APIKey) allows(scopes []string) error {
+	if len(scopes) == 0 {
+		return errAPIKeyNotHere
+	}
+
+	for _, scope := range scopes {
+		held := false
+		for _, s := range k.Scopes {
+			held = held || s == scope
+		}
+		if !held {
+			return errors.New("api key lacks scope \"" + scope + "\"")
+		}
+	}
+	return nil
+}
+
+func validateAPIKeyParams(u User, p *CreateAPIKeyParams, now time.Time) error {
+	p.Name = strings.TrimSpace(p.Name)
+	if len(p.Name) == 0 || len(p.Name) > maxAPIKeyNameLen {
+		return errors.New("api key name should have 1 to 64 symbols")
+	}
+
+	if len(p.Scopes) == 0 {
+		return errors.New("api key should have at least one scope")
+	}
+
+	seen := map[string]bool{}
+	for _, scope := range p.Scopes {
+		adminOnly, ok := apiKeyScopes[scope]
+		if !ok {
+			return errors.New("unknown scope \"" + scope + "\"")
+		}
+		if adminOnly && !isAdmin(u) {
+			return errors.New("not enough privileges for scope \"" + scope + "\"")
+		}
+		if seen[scope] {
+			return errors.New("scope \"" + scope + "\" is given twice")
+		}
+		seen[scope] = true
+	}
+
+	if p.ExpiresAt != nil && !p.ExpiresAt.After(now) {
+		return errors.New("api key should expire in the future")
+	}
+	return nil
+}
+
+func apiKeyResponse(k APIKey) APIKeyResponse {
+	resp := APIKeyResponse{
+		ID:        k.ID,
+		Name:      k.Name,
+		Scopes:    k.Scopes,
+		CreatedAt: k.CreatedAt,
+	}
+	if !k.ExpiresAt.IsZero() {
+		expiresAt := k.ExpiresAt
+		resp.ExpiresAt = &expiresAt
+	}
+	if !k.LastUsedAt.IsZero() {
+		lastUsedAt := k.LastUsedAt
+		resp.LastUsedAt = &lastUsedAt
+	}
+	return resp
+}
+
+func (us *UserService) CreateAPIKey(w http.ResponseWriter, r *http.Request, u User) {
+	params := &CreateAPIKeyParams{}
+	if err := json.NewDecoder(r.Body).Decode(params); err != nil {
+		handleError(errors.New("could not read params"), w)
+		return
+	}
+
+	now := time.Now()
+	if err := validateAPIKeyParams(u, params, now); err != nil {
+		handleError(err, w)
+		return
+	}
+
+	keys, err := us.repository.APIKeys(r.Context(), u.Email)
+	if err != nil {
+		handleError(err, w)
+		return
+	}
+
+	if len(keys) >= maxAPIKeys {
+		handleError(errTooManyAPIKeys, w)
+		return
+	}
+
+	key, token, err := newAPIKey(u, *params, now)
+	if err != nil {
+		handleError(err, w)
+		return
+	}
+
+	if err = us.repository.AddAPIKey(r.Context(), key); err != nil {
+		handleError(err, w)
+		return
+	}
+
+	resp := apiKeyResponse(key)
+	resp.Key = token
+	body, err := json.Marshal(resp)
+	if err != nil {
+		handleError(err, w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	w.Write(body)
+}
+
+func (us *UserService) ListAPIKeys(w http.ResponseWriter, r *http.Request, u User) {
+	keys, err := us.repository.APIKeys(r.Context(), u.Email)
+	if err != nil {
+		handleError(err, w)
+		return
+	}
+
+	resp := []APIKeyResponse{}
+	for _, k := range keys {
+		resp = append(resp, apiKeyResponse(k))
+	}
+
+	body, err := json.Marshal(resp)
+	if err != nil {
+		handleError(err, w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
+
+// RevokeAPIKey revokes the key given by the id query parameter.
+func (us *UserService) RevokeAPIKey(w http.ResponseWriter, r *http.Request, u User) {
+	id := r.URL.Query().Get("id")
+	if err := us.repository.RevokeAPIKey(r.Context(), u.Email, id); err != nil {
+		handleError(err, w)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("api key \"" + id + "\" is revoked"))
+}
+
+func (ur *InMemoryUserStorage) AddAPIKey(ctx context.Context, k APIKey) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	ur.lock.Lock()
+	defer ur.lock.Unlock()
+
+	if _, ok := ur.storage[k.Email]; !ok {
+		return errors.New("there is no such user to add a key to")
+	}
+
+	if _, ok := ur.apiKeys[k.ID]; ok {
+		return errors.New("api key is already present")
+	}
+
+	return ur.commit(journalEntry{Op: "api_key", Login: k.Email, APIKey: k, At: time.Now()})
+}
+
+func (ur *InMemoryUserStorage) GetAPIKey(ctx context.Context, id string) (APIKey, error) {
+	if err := ctx.Err(); err != nil {
+		return APIKey{}, err
+	}
+
+	ur.lock.RLock()
+	defer ur.lock.RUnlock()
+
+	k, ok := ur.apiKeys[id]
+	if !ok {
+		return APIKey{}, errNoSuchAPIKey
+	}
+	return k, nil
+}
+
+// UseAPIKey records that the key id was used at.
+func (ur *InMemoryUserStorage) UseAPIKey(ctx context.Context, id string, at time.Time) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	ur.lock.Lock()
+	defer ur.lock.Unlock()
+
+	k, ok := ur.apiKeys[id]
+	if !ok {
+		return errNoSuchAPIKey
+	}
+
+	return ur.commit(journalEntry{Op: "use_api_key", Login: k.Email, Token: id, At: at})
+}
+
+// APIKeys returns the keys of the user that have not expired, oldest first.
+func (ur *InMemoryUserStorage) APIKeys(ctx context.Context, login string) ([]APIKey, error) {
+	if err := ctx.Err(); err != nil {
+		return []APIKey{}, err
+	}
+
+	ur.lock.RLock()
+	defer ur.lock.RUnlock()
+
+	now := time.Now()
+	keys := []APIKey{}
+	for _, k := range ur.apiKeys {
+		if k.Email != login || (!k.ExpiresAt.IsZero() && !k.ExpiresAt.After(now)) {
+			continue
+		}
+		keys = append(keys, k)
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].CreatedAt.Before(keys[j].CreatedAt)
+	})
+	return keys, nil
+}
+
+func (ur *InMemoryUserStorage) RevokeAPIKey(ctx context.Context, login string, id string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	ur.lock.Lock()
+	defer ur.lock.Unlock()
+
+	if k, ok := ur.apiKeys[id]; !ok || k.Email != login {
+		return errNoSuchAPIKey
+	}
+
+	return ur.commit(journalEntry{Op: "revoke_api_key", Login: login, Token: id, At: time.Now()})
+}
+
+func (ur *InMemoryUserStorage) dropAPIKeys(login string) {
+	for id, k := range ur.apiKeys {
+		if k.Email == login {
+			delete(ur.apiKeys, id)
+		}
+	}
+}
+
+func (ur *InMemoryUserStorage) moveAPIKeys(login string, newLogin string) {
+	for id, k := range ur.apiKeys {
+		if k.Email == login {
+			k.Email = newLogin
+			ur.apiKeys[id] = k
+		}
+	}
+}
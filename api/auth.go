@@ -1,8 +1,11 @@
 package main
 
 import (
+	"encoding/json"
+	"log"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/philanton/cake-service/pkg/jwt"
 )
@@ -18,10 +21,44 @@ func NewMyJWTService() (*MyJWTService, error) {
 	return &MyJWTService{jwtService}, err
 }
 
-func (j *MyJWTService) jwtAuth(ur UserRepository, h ProtectedHandler) http.HandlerFunc {
+// issueToken forges a token for u, who logged in at authTime, and describes
+// it as a session of the client that asked for it.
+func (j *MyJWTService) issueToken(r *http.Request, u User, authTime time.Time) (string, Session, error) {
+	token, err := j.GenerateJWTAuthenticatedAt(u.Email, u.TokenGeneration, authTime)
+	if err != nil {
+		return "", Session{}, err
+	}
+
+	claims, err := j.ParseJWT(token)
+	if err != nil {
+		return "", Session{}, err
+	}
+
+	session := Session{
+		ID:         claims.Id,
+		Email:      u.Email,
+		IssuedAt:   time.Unix(claims.IssuedAt, 0),
+		UserAgent:  r.UserAgent(),
+		RemoteAddr: r.RemoteAddr,
+	}
+	if claims.ExpiresAt != 0 {
+		session.ExpiresAt = time.Unix(claims.ExpiresAt, 0)
+	}
+
+	return token, session, nil
+}
+
+// jwtAuth accepts API keys too, but only those holding every one of scopes.
+// Routes that ask for no scopes only accept JWTs.
+func (j *MyJWTService) jwtAuth(ur UserRepository, h ProtectedHandler, scopes ...string) http.HandlerFunc {
 	return func(rw http.ResponseWriter, r *http.Request) {
 		authHeader := r.Header.Get("Authorization")
 		token := strings.TrimPrefix(authHeader, "Bearer ")
+		if strings.HasPrefix(token, apiKeyPrefix) {
+			apiKeyAuth(rw, r, ur, token, scopes, h)
+			return
+		}
+
 		auth, err := j.ParseJWT(token)
 		if err != nil {
 			rw.WriteHeader(401)
@@ -29,27 +66,92 @@ func (j *MyJWTService) jwtAuth(ur UserRepository, h ProtectedHandler) http.Handl
 			return
 		}
 
-		err = ur.IsBanned(auth.Email)
+		err = ur.IsBanned(r.Context(), auth.Email)
 		if err != nil {
 			rw.WriteHeader(401)
 			rw.Write([]byte(err.Error()))
 			return
 		}
 
-		err = ur.CheckNotInDB(token)
+		err = ur.CheckNotInDB(r.Context(), auth.Id)
 		if err != nil {
 			rw.WriteHeader(401)
 			rw.Write([]byte(err.Error()))
 			return
 		}
 
-		user, err := ur.Get(auth.Email)
+		user, err := ur.Get(r.Context(), auth.Email)
 		if err != nil {
 			rw.WriteHeader(401)
 			rw.Write([]byte("unauthorized"))
 			return
 		}
 
-		h(rw, r, user)
+		if auth.Generation != user.TokenGeneration {
+			rw.WriteHeader(401)
+			rw.Write([]byte("token is banned"))
+			return
+		}
+
+		h(rw, withAuth(r, auth), user)
 	}
 }
+
+func apiKeyAuth(rw http.ResponseWriter, r *http.Request, ur UserRepository, token string, scopes []string, h ProtectedHandler) {
+	now := time.Now()
+	key, err := checkAPIKey(r.Context(), ur, token, now)
+	if err != nil {
+		rw.WriteHeader(401)
+		rw.Write([]byte(err.Error()))
+		return
+	}
+
+	if err = key.allows(scopes); err != nil {
+		rw.WriteHeader(403)
+		rw.Write([]byte(err.Error()))
+		return
+	}
+
+	if err = ur.IsBanned(r.Context(), key.Email); err != nil {
+		rw.WriteHeader(401)
+		rw.Write([]byte(err.Error()))
+		return
+	}
+
+	user, err := ur.Get(r.Context(), key.Email)
+	if err != nil {
+		rw.WriteHeader(401)
+		rw.Write([]byte("unauthorized"))
+		return
+	}
+
+	// the key worked either way, failing to record it is no reason to refuse
+	if now.Sub(key.LastUsedAt) >= apiKeyUseResolution {
+		if err = ur.UseAPIKey(r.Context(), key.ID, now); err != nil {
+			log.Println("Could not record api key use:", err)
+		}
+	}
+
+	h(rw, r, user)
+}
+
+// JWKS publishes the keys our tokens can be verified with, so other services
+// do not need a copy of them.
+func (j *MyJWTService) JWKS(w http.ResponseWriter, r *http.Request) {
+	jwks, err := j.JWTService.JWKS()
+	if err != nil {
+		handleError(err, w)
+		return
+	}
+
+	body, err := json.Marshal(jwks)
+	if err != nil {
+		handleError(err, w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=60")
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
@@ -1,10 +1,32 @@
 package main
 
 import (
+	"context"
 	"errors"
+	"sort"
 	"time"
 )
 
+// AuditEntry is a ban or unban, seen from anybody it mentions.
+type AuditEntry struct {
+	At      time.Time
+	Action  string
+	Actor   string
+	Subject string
+	Reason  string
+}
+
+// banError is what IsBanned reports for a banned user, as opposed to a
+// failure to find out.
+type banError struct {
+	reason    string
+	whoBanned string
+}
+
+func (e banError) Error() string {
+	return "user is banned with reason \"" + e.reason + "\" by \"" + e.whoBanned + "\""
+}
+
 type Ban struct {
 	BannedAt    time.Time
 	WhoBanned   string
@@ -13,7 +35,14 @@ type Ban struct {
 	Reason      string
 }
 
-func (ur *InMemoryUserStorage) IsBanned(login string) error {
+func (ur *InMemoryUserStorage) IsBanned(ctx context.Context, login string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	ur.lock.RLock()
+	defer ur.lock.RUnlock()
+
 	history, ok := ur.banHistory[login]
 	if !ok {
 		return nil
@@ -21,22 +50,85 @@ func (ur *InMemoryUserStorage) IsBanned(login string) error {
 
 	lastBan := history[len(history)-1]
 	if lastBan.UnbannedAt.IsZero() {
-		return errors.New("user is banned with reason \"" + lastBan.Reason + "\" by \"" + lastBan.WhoBanned + "\"")
+		return banError{reason: lastBan.Reason, whoBanned: lastBan.WhoBanned}
 	}
 
 	return nil
 }
 
-func (ur *InMemoryUserStorage) BanHistory(login string) ([]Ban, error) {
+func banAuditEntries(login string, b Ban) []AuditEntry {
+	entries := []AuditEntry{{
+		At:      b.BannedAt,
+		Action:  "ban",
+		Actor:   b.WhoBanned,
+		Subject: login,
+		Reason:  b.Reason,
+	}}
+
+	if !b.UnbannedAt.IsZero() {
+		entries = append(entries, AuditEntry{
+			At:      b.UnbannedAt,
+			Action:  "unban",
+			Actor:   b.WhoUnbanned,
+			Subject: login,
+		})
+	}
+
+	return entries
+}
+
+// AuditTrail returns every ban and unban the user was either subject or
+// author of, oldest first.
+func (ur *InMemoryUserStorage) AuditTrail(ctx context.Context, login string) ([]AuditEntry, error) {
+	if err := ctx.Err(); err != nil {
+		return []AuditEntry{}, err
+	}
+
+	ur.lock.RLock()
+	defer ur.lock.RUnlock()
+
+	trail := []AuditEntry{}
+	for subject, history := range ur.banHistory {
+		for _, b := range history {
+			for _, e := range banAuditEntries(subject, b) {
+				if e.Actor == login || e.Subject == login {
+					trail = append(trail, e)
+				}
+			}
+		}
+	}
+
+	sort.Slice(trail, func(i, j int) bool {
+		return trail[i].At.Before(trail[j].At)
+	})
+	return trail, nil
+}
+
+func (ur *InMemoryUserStorage) BanHistory(ctx context.Context, login string) ([]Ban, error) {
+	if err := ctx.Err(); err != nil {
+		return []Ban{}, err
+	}
+
+	ur.lock.RLock()
+	defer ur.lock.RUnlock()
+
 	history, ok := ur.banHistory[login]
 	if !ok {
 		return []Ban{}, errors.New("user history is clear")
 	}
 
-	return history, nil
+	// Unban edits the last entry in place, so callers get their own copy.
+	return append([]Ban{}, history...), nil
 }
 
-func (ur *InMemoryUserStorage) Ban(login string, byLogin string, reason string) error {
+func (ur *InMemoryUserStorage) Ban(ctx context.Context, login string, byLogin string, reason string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	ur.lock.Lock()
+	defer ur.lock.Unlock()
+
 	history, ok := ur.banHistory[login]
 	if ok {
 		lastBan := history[len(history)-1]
@@ -45,21 +137,23 @@ func (ur *InMemoryUserStorage) Ban(login string, byLogin string, reason string)
 		}
 	}
 
-	ur.lock.Lock()
-	defer ur.lock.Unlock()
-
-	ur.banHistory[login] = append(history, Ban{
-		BannedAt:    time.Now(),
-		WhoBanned:   byLogin,
-		UnbannedAt:  time.Time{},
-		Reason:      reason,
-		WhoUnbanned: "",
+	return ur.commit(journalEntry{
+		Op:     "ban",
+		Login:  login,
+		By:     byLogin,
+		Reason: reason,
+		At:     time.Now(),
 	})
-
-	return nil
 }
 
-func (ur *InMemoryUserStorage) Unban(login string, byLogin string) error {
+func (ur *InMemoryUserStorage) Unban(ctx context.Context, login string, byLogin string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	ur.lock.Lock()
+	defer ur.lock.Unlock()
+
 	history, ok := ur.banHistory[login]
 	if !ok {
 		return errors.New("user history is clear")
@@ -70,12 +164,5 @@ func (ur *InMemoryUserStorage) Unban(login string, byLogin string) error {
 		return errors.New("user is not banned")
 	}
 
-	ur.lock.Lock()
-	defer ur.lock.Unlock()
-
-	lastBan.UnbannedAt = time.Now()
-	lastBan.WhoUnbanned = byLogin
-	history[len(history)-1] = lastBan
-
-	return nil
+	return ur.commit(journalEntry{Op: "unban", Login: login, By: byLogin, At: time.Now()})
 }
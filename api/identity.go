@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"time"
+)
+
+var errNoSuchIdentity = errors.New("there is no such identity")
+
+// Identity links an account at an OpenID Connect provider to a user. The
+// subject stays the same for the account, so logins find the user by it even
+// after either email changes.
+type Identity struct {
+	Issuer   string
+	Subject  string
+	Email    string
+	LinkedAt time.Time
+}
+
+func identityKey(issuer string, subject string) string {
+	return issuer + "\n" + subject
+}
+
+func (ur *InMemoryUserStorage) LinkIdentity(ctx context.Context, id Identity) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	ur.lock.Lock()
+	defer ur.lock.Unlock()
+
+	if _, ok := ur.storage[id.Email]; !ok {
+		return errors.New("there is no such user to link")
+	}
+
+	if _, ok := ur.identities[identityKey(id.Issuer, id.Subject)]; ok {
+		return errors.New("identity is already linked")
+	}
+
+	return ur.commit(journalEntry{Op: "identity", Login: id.Email, Identity: id, At: time.Now()})
+}
+
+// TakeOver overwrites the user like Update does and leaves id the only
+// identity linked to it, all under one lock.
+func (ur *InMemoryUserStorage) TakeOver(ctx context.Context, login string, u User, id Identity) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	ur.lock.Lock()
+	defer ur.lock.Unlock()
+
+	stored, ok := ur.storage[login]
+	if !ok {
+		return errors.New("there is no such user to update")
+	}
+
+	if stored.Version != u.Version {
+		return errStaleVersion
+	}
+
+	if linked, ok := ur.identities[identityKey(id.Issuer, id.Subject)]; ok && linked.Email != login {
+		return errors.New("identity is already linked")
+	}
+
+	u.TokenGeneration = stored.TokenGeneration
+	u.Version++
+	id.Email = login
+	return ur.commit(journalEntry{Op: "take_over", Login: login, User: u, Identity: id, At: time.Now()})
+}
+
+func (ur *InMemoryUserStorage) GetIdentity(ctx context.Context, issuer string, subject string) (Identity, error) {
+	if err := ctx.Err(); err != nil {
+		return Identity{}, err
+	}
+
+	ur.lock.RLock()
+	defer ur.lock.RUnlock()
+
+	id, ok := ur.identities[identityKey(issuer, subject)]
+	if !ok {
+		return Identity{}, errNoSuchIdentity
+	}
+	return id, nil
+}
+
+// Identities returns the identities linked to the user, oldest first.
+func (ur *InMemoryUserStorage) Identities(ctx context.Context, login string) ([]Identity, error) {
+	if err := ctx.Err(); err != nil {
+		return []Identity{}, err
+	}
+
+	ur.lock.RLock()
+	defer ur.lock.RUnlock()
+
+	identities := []Identity{}
+	for _, id := range ur.identities {
+		if id.Email == login {
+			identities = append(identities, id)
+		}
+	}
+
+	sort.Slice(identities, func(i, j int) bool {
+		return identities[i].LinkedAt.Before(identities[j].LinkedAt)
+	})
+	return identities, nil
+}
+
+func (ur *InMemoryUserStorage) dropIdentities(login string) {
+	for key, id := range ur.identities {
+		if id.Email == login {
+			delete(ur.identities, key)
+		}
+	}
+}
+
+func (ur *InMemoryUserStorage) moveIdentities(login string, newLogin string) {
+	for key, id := range ur.identities {
+		if id.Email == login {
+			id.Email = newLogin
+			ur.identities[key] = id
+		}
+	}
+}
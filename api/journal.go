@@ -0,0 +1,486 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	journalFile  = "journal.log"
+	snapshotFile = "snapshot.json"
+
+	defaultSnapshotInterval = 5 * time.Minute
+)
+
+// journalEntry is one mutation. Seq numbers entries in the order they were
+// committed, so replaying skips those a snapshot already holds.
+type journalEntry struct {
+	Seq     uint64       `json:"seq"`
+	Op      string       `json:"op"`
+	Login   string       `json:"login"`
+	To      string       `json:"to,omitempty"`
+	User    User         `json:"user"`
+	By      string       `json:"by,omitempty"`
+	Reason  string       `json:"reason,omitempty"`
+	Token   string       `json:"token,omitempty"`
+	Expires time.Time    `json:"expires"`
+	Until   time.Time    `json:"until"`
+	Session Session      `json:"session"`
+	Refresh RefreshToken `json:"refresh"`
+	At      time.Time    `json:"at"`
+
+	Identity Identity `json:"identity"`
+	APIKey   APIKey   `json:"api_key"`
+}
+
+type snapshot struct {
+	Seq        uint64                  `json:"seq"`
+	Storage    map[string]User         `json:"storage"`
+	InvTokenDB map[string]time.Time    `json:"revoked_tokens"`
+	BanHistory map[string][]Ban        `json:"ban_history"`
+	Tombstones map[string]time.Time    `json:"tombstones"`
+	Sessions   map[string][]Session    `json:"sessions"`
+	Refresh    map[string]RefreshToken `json:"refresh_tokens"`
+	Identities map[string]Identity     `json:"identities"`
+	APIKeys    map[string]APIKey       `json:"api_keys"`
+
+	Generations map[string]int `json:"generations"`
+}
+
+type journal struct {
+	dir  string
+	file journalWriter
+	// size is where the last complete entry ends, a failed write is cut
+	// back to it.
+	size int64
+	stop chan struct{}
+	done chan struct{}
+}
+
+// journalWriter is what the journal needs of its file.
+type journalWriter interface {
+	io.WriteCloser
+	Sync() error
+	Truncate(size int64) error
+}
+
+func snapshotInterval() time.Duration {
+	interval, err := time.ParseDuration(os.Getenv("CAKE_SNAPSHOT_INTERVAL"))
+	if err != nil || interval <= 0 {
+		return defaultSnapshotInterval
+	}
+	return interval
+}
+
+func (ur *InMemoryUserStorage) apply(e journalEntry) {
+	switch e.Op {
+	case "add", "update":
+		ur.storage[e.Login] = e.User
+	case "delete":
+		ur.retireGeneration(e.Login)
+		delete(ur.storage, e.Login)
+		ur.dropIdentities(e.Login)
+		ur.dropAPIKeys(e.Login)
+	case "rename":
+		ur.retireGeneration(e.Login)
+		u := ur.storage[e.Login]
+		u.Email = e.To
+		u.Version++
+		u.Unverified = true
+		if u.TokenGeneration < ur.generations[e.To] {
+			u.TokenGeneration = ur.generations[e.To]
+		}
+		delete(ur.storage, e.Login)
+		ur.storage[e.To] = u
+
+		if history, ok := ur.banHistory[e.Login]; ok {
+			delete(ur.banHistory, e.Login)
+			ur.banHistory[e.To] = history
+		}
+		delete(ur.sessions, e.Login)
+		ur.dropRefreshTokens(e.Login)
+		ur.moveIdentities(e.Login, e.To)
+		ur.moveAPIKeys(e.Login, e.To)
+
+		if len(e.Token) != 0 {
+			ur.invTokenDB[e.Token] = e.Expires
+		}
+	case "tombstone":
+		ur.retireGeneration(e.Login)
+		delete(ur.storage, e.Login)
+		delete(ur.sessions, e.Login)
+		ur.dropRefreshTokens(e.Login)
+		ur.dropIdentities(e.Login)
+		ur.dropAPIKeys(e.Login)
+		ur.tombstones[e.Login] = e.Until
+
+		if len(e.Token) != 0 {
+			ur.invTokenDB[e.Token] = e.Expires
+		}
+	case "session":
+		ur.sessions[e.Login] = append(ur.sessions[e.Login], e.Session)
+	case "token":
+		ur.invTokenDB[e.Token] = e.Expires
+	case "refresh":
+		ur.refreshTokens[e.Refresh.ID] = e.Refresh
+	case "rotate":
+		t := ur.refreshTokens[e.Token]
+		t.UsedAt = e.At
+		ur.refreshTokens[e.Token] = t
+		ur.refreshTokens[e.Refresh.ID] = e.Refresh
+	case "reuse":
+		ur.revokeRefreshFamily(e.Token)
+	case "logout":
+		ur.invTokenDB[e.Token] = e.Expires
+		for _, t := range ur.refreshTokens {
+			if t.AccessToken.ID == e.Token {
+				ur.revokeRefreshFamily(t.Family)
+				break
+			}
+		}
+	case "logout_all":
+		u := ur.storage[e.Login]
+		u.TokenGeneration++
+		ur.storage[e.Login] = u
+		delete(ur.sessions, e.Login)
+		ur.dropRefreshTokens(e.Login)
+		ur.dropAPIKeys(e.Login)
+	case "purge":
+		for id, expiresAt := range ur.invTokenDB {
+			if !expiresAt.IsZero() && expiresAt.Before(e.At) {
+				delete(ur.invTokenDB, id)
+			}
+		}
+
+		for login, sessions := range ur.sessions {
+			alive := []Session{}
+			for _, s := range sessions {
+				if s.ExpiresAt.IsZero() || !s.ExpiresAt.Before(e.At) {
+					alive = append(alive, s)
+				}
+			}
+
+			if len(alive) == 0 {
+				delete(ur.sessions, login)
+			} else {
+				ur.sessions[login] = alive
+			}
+		}
+
+		for id, t := range ur.refreshTokens {
+			if t.ExpiresAt.Before(e.At) {
+				delete(ur.refreshTokens, id)
+			}
+		}
+
+		for id, k := range ur.apiKeys {
+			if !k.ExpiresAt.IsZero() && k.ExpiresAt.Before(e.At) {
+				delete(ur.apiKeys, id)
+			}
+		}
+	case "identity":
+		ur.identities[identityKey(e.Identity.Issuer, e.Identity.Subject)] = e.Identity
+	case "take_over":
+		ur.storage[e.Login] = e.User
+		ur.dropIdentities(e.Login)
+		ur.identities[identityKey(e.Identity.Issuer, e.Identity.Subject)] = e.Identity
+	case "api_key":
+		ur.apiKeys[e.APIKey.ID] = e.APIKey
+	case "use_api_key":
+		if k, ok := ur.apiKeys[e.Token]; ok {
+			k.LastUsedAt = e.At
+			ur.apiKeys[e.Token] = k
+		}
+	case "revoke_api_key":
+		delete(ur.apiKeys, e.Token)
+	case "ban":
+		ur.banHistory[e.Login] = append(ur.banHistory[e.Login], Ban{
+			BannedAt:  e.At,
+			WhoBanned: e.By,
+			Reason:    e.Reason,
+		})
+	case "unban":
+		history := ur.banHistory[e.Login]
+		if len(history) == 0 {
+			return
+		}
+		history[len(history)-1].UnbannedAt = e.At
+		history[len(history)-1].WhoUnbanned = e.By
+	}
+}
+
+// retireGeneration makes an account registered under login later on start
+// past the tokens issued to the one leaving it.
+func (ur *InMemoryUserStorage) retireGeneration(login string) {
+	if u, ok := ur.storage[login]; ok && u.TokenGeneration >= ur.generations[login] {
+		ur.generations[login] = u.TokenGeneration + 1
+	}
+}
+
+func (ur *InMemoryUserStorage) dropRefreshTokens(login string) {
+	for id, t := range ur.refreshTokens {
+		if t.Email == login {
+			delete(ur.refreshTokens, id)
+		}
+	}
+}
+
+func (ur *InMemoryUserStorage) revokeRefreshFamily(family string) {
+	for id, t := range ur.refreshTokens {
+		if t.Family != family {
+			continue
+		}
+
+		t.Revoked = true
+		ur.refreshTokens[id] = t
+		if len(t.AccessToken.ID) != 0 {
+			ur.invTokenDB[t.AccessToken.ID] = t.AccessToken.ExpiresAt
+		}
+	}
+}
+
+// commit writes e to the journal and applies it to the maps. Callers must
+// hold the write lock.
+func (ur *InMemoryUserStorage) commit(e journalEntry) error {
+	e.Seq = ur.seq + 1
+	if ur.journal != nil {
+		line, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+
+		line = append(line, '\n')
+		if _, err = ur.journal.file.Write(line); err != nil {
+			ur.journal.rollback()
+			return err
+		}
+
+		if err = ur.journal.file.Sync(); err != nil {
+			ur.journal.rollback()
+			return err
+		}
+		ur.journal.size += int64(len(line))
+	}
+
+	ur.seq = e.Seq
+	ur.apply(e)
+	return nil
+}
+
+// restore loads the last snapshot from dir, replays the journal on top of it
+// and keeps the journal open for appending.
+func (ur *InMemoryUserStorage) restore(dir string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, snapshotFile))
+	if err == nil {
+		s := snapshot{}
+		if err = json.Unmarshal(data, &s); err != nil {
+			return err
+		}
+		ur.seq = s.Seq
+
+		if s.Storage != nil {
+			ur.storage = s.Storage
+		}
+		if s.InvTokenDB != nil {
+			ur.invTokenDB = s.InvTokenDB
+		}
+		if s.BanHistory != nil {
+			ur.banHistory = s.BanHistory
+		}
+		if s.Tombstones != nil {
+			ur.tombstones = s.Tombstones
+		}
+		if s.Sessions != nil {
+			ur.sessions = s.Sessions
+		}
+		if s.Refresh != nil {
+			ur.refreshTokens = s.Refresh
+		}
+		if s.Identities != nil {
+			ur.identities = s.Identities
+		}
+		if s.APIKeys != nil {
+			ur.apiKeys = s.APIKeys
+		}
+		if s.Generations != nil {
+			ur.generations = s.Generations
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	file, err := os.OpenFile(filepath.Join(dir, journalFile), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			if len(line) != 0 {
+				log.Println("Dropping incomplete journal entry:", string(line))
+			}
+			break
+		} else if err != nil {
+			file.Close()
+			return err
+		}
+
+		e := journalEntry{}
+		if err = json.Unmarshal(line, &e); err != nil {
+			file.Close()
+			return err
+		}
+
+		// a crash between renaming the snapshot and truncating the journal
+		// leaves entries behind that the snapshot holds already
+		if e.Seq != 0 && e.Seq <= ur.seq {
+			continue
+		}
+		if e.Seq > ur.seq {
+			ur.seq = e.Seq
+		}
+		ur.apply(e)
+	}
+
+	ur.journal = &journal{
+		dir:  dir,
+		file: file,
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+
+	// Compact right away so a partially written tail never gets appended to.
+	return ur.Snapshot()
+}
+
+// Snapshot writes the whole state to disk and truncates the journal.
+func (ur *InMemoryUserStorage) Snapshot() error {
+	if ur.journal == nil {
+		return nil
+	}
+
+	ur.lock.Lock()
+	defer ur.lock.Unlock()
+
+	data, err := json.Marshal(snapshot{
+		Seq:        ur.seq,
+		Storage:    ur.storage,
+		InvTokenDB: ur.invTokenDB,
+		BanHistory: ur.banHistory,
+		Tombstones: ur.tombstones,
+		Sessions:   ur.sessions,
+		Refresh:    ur.refreshTokens,
+		Identities: ur.identities,
+		APIKeys:    ur.apiKeys,
+
+		Generations: ur.generations,
+	})
+	if err != nil {
+		return err
+	}
+
+	tmp := filepath.Join(ur.journal.dir, snapshotFile+".tmp")
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	if _, err = file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+
+	if err = file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+
+	if err = file.Close(); err != nil {
+		return err
+	}
+
+	if err = os.Rename(tmp, filepath.Join(ur.journal.dir, snapshotFile)); err != nil {
+		return err
+	}
+
+	if err = syncDir(ur.journal.dir); err != nil {
+		return err
+	}
+
+	// the journal is opened with O_APPEND, writes need no seeking back
+	if err = ur.journal.file.Truncate(0); err != nil {
+		return err
+	}
+	ur.journal.size = 0
+	return nil
+}
+
+// rollback cuts off whatever part of an entry got written, or the next entry
+// would be appended to a torn line and the journal could not be replayed.
+func (j *journal) rollback() {
+	if err := j.file.Truncate(j.size); err != nil {
+		log.Println("Could not cut the journal back after a failed write:", err)
+	}
+}
+
+// syncDir makes a rename in dir durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+
+	if err = d.Sync(); err != nil {
+		d.Close()
+		return err
+	}
+	return d.Close()
+}
+
+func (ur *InMemoryUserStorage) runSnapshots(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer func() {
+		ticker.Stop()
+		close(ur.journal.done)
+	}()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := ur.Snapshot(); err != nil {
+				log.Println("Could not write snapshot", err)
+			}
+		case <-ur.journal.stop:
+			return
+		}
+	}
+}
+
+// Close stops periodic snapshots, writes a final one and closes the journal.
+func (ur *InMemoryUserStorage) Close() error {
+	if ur.journal == nil {
+		return nil
+	}
+
+	close(ur.journal.stop)
+	<-ur.journal.done
+
+	if err := ur.Snapshot(); err != nil {
+		ur.journal.file.Close()
+		return err
+	}
+
+	return ur.journal.file.Close()
+}
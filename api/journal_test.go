@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// shortWriter writes the first half of what it is given and fails.
+type shortWriter struct {
+	journalWriter
+}
+
+func (w shortWriter) Write(p []byte) (int, error) {
+	n, _ := w.journalWriter.Write(p[:len(p)/2])
+	return n, errors.New("no space left on device")
+}
+
+func TestInMemoryUserStorage_Journal(t *testing.T) {
+	ctx := context.Background()
+	user := User{
+		Email:          "test@mail.com",
+		PasswordDigest: "digest",
+		Role:           "user",
+		FavoriteCake:   "somecake",
+	}
+
+	t.Run("replaying journal without snapshot", func(t *testing.T) {
+		t.Setenv("CAKE_DATA_DIR", t.TempDir())
+
+		ur := NewInMemoryUserStorage()
+		assertNoError(t, ur.Add(ctx, user.Email, user))
+		assertNoError(t, ur.Add(ctx, "other@mail.com", user))
+		assertNoError(t, ur.Ban(ctx, user.Email, "admin@mail.com", "some reason"))
+		assertNoError(t, ur.Unban(ctx, user.Email, "root@mail.com"))
+		assertNoError(t, ur.Ban(ctx, user.Email, "admin@mail.com", "other reason"))
+		assertNoError(t, ur.AddToken(ctx, RevokedToken{ID: "token", ExpiresAt: time.Now().Add(time.Hour)}))
+		assertNoError(t, ur.AddToken(ctx, RevokedToken{ID: "expired", ExpiresAt: time.Now().Add(-time.Hour)}))
+		_, err := ur.PurgeExpiredTokens(ctx, time.Now())
+		assertNoError(t, err)
+		_, err = ur.Delete(ctx, "other@mail.com")
+		assertNoError(t, err)
+
+		// simulate a crash: the journal is left behind without a final snapshot
+		close(ur.journal.stop)
+		ur.journal.file.Close()
+
+		restored := NewInMemoryUserStorage()
+		defer restored.Close()
+
+		if _, err = restored.Get(ctx, user.Email); err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+
+		_, err = restored.Get(ctx, "other@mail.com")
+		assertError(t, "there is no such user to get", err)
+		assertError(t, "token is banned", restored.CheckNotInDB(ctx, "token"))
+		assertNoError(t, restored.CheckNotInDB(ctx, "expired"))
+		assertError(t, "user is banned with reason \"other reason\" by \"admin@mail.com\"", restored.IsBanned(ctx, user.Email))
+
+		history, err := restored.BanHistory(ctx, user.Email)
+		assertNoError(t, err)
+		if len(history) != 2 || history[0].WhoUnbanned != "root@mail.com" {
+			t.Errorf("Unexpected ban history: %v", history)
+		}
+	})
+
+	t.Run("restoring from snapshot", func(t *testing.T) {
+		t.Setenv("CAKE_DATA_DIR", t.TempDir())
+
+		ur := NewInMemoryUserStorage()
+		assertNoError(t, ur.Add(ctx, user.Email, user))
+		assertNoError(t, ur.Snapshot())
+
+		updated, err := ur.Get(ctx, user.Email)
+		assertNoError(t, err)
+		updated.FavoriteCake = "othercake"
+		assertNoError(t, ur.Update(ctx, user.Email, updated))
+		assertNoError(t, ur.Close())
+
+		restored := NewInMemoryUserStorage()
+		defer restored.Close()
+
+		u, err := restored.Get(ctx, user.Email)
+		assertNoError(t, err)
+		if u.FavoriteCake != "othercake" || u.Version != 2 {
+			t.Errorf("Unexpected user: %v", u)
+		}
+	})
+
+	t.Run("replaying journal the snapshot holds already", func(t *testing.T) {
+		dir := t.TempDir()
+		t.Setenv("CAKE_DATA_DIR", dir)
+
+		ur := NewInMemoryUserStorage()
+		assertNoError(t, ur.Add(ctx, user.Email, user))
+		assertNoError(t, ur.Ban(ctx, user.Email, "admin@mail.com", "some reason"))
+		assertNoError(t, ur.Unban(ctx, user.Email, "root@mail.com"))
+		assertNoError(t, ur.Ban(ctx, user.Email, "admin@mail.com", "other reason"))
+
+		// simulate a crash between renaming the snapshot and truncating the journal
+		journalData, err := os.ReadFile(filepath.Join(dir, journalFile))
+		assertNoError(t, err)
+		assertNoError(t, ur.Snapshot())
+		close(ur.journal.stop)
+		ur.journal.file.Close()
+		assertNoError(t, os.WriteFile(filepath.Join(dir, journalFile), journalData, 0600))
+
+		restored := NewInMemoryUserStorage()
+
+		history, err := restored.BanHistory(ctx, user.Email)
+		assertNoError(t, err)
+		if len(history) != 2 || history[0].WhoUnbanned != "root@mail.com" || !history[1].UnbannedAt.IsZero() {
+			t.Errorf("Unexpected ban history: %v", history)
+		}
+
+		assertNoError(t, restored.Unban(ctx, user.Email, "root@mail.com"))
+		assertNoError(t, restored.Add(ctx, "other@mail.com", user))
+		assertNoError(t, restored.Close())
+
+		again := NewInMemoryUserStorage()
+		defer again.Close()
+		if _, err = again.Get(ctx, "other@mail.com"); err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		assertNoError(t, again.IsBanned(ctx, user.Email))
+	})
+
+	t.Run("failing to write an entry", func(t *testing.T) {
+		t.Setenv("CAKE_DATA_DIR", t.TempDir())
+
+		ur := NewInMemoryUserStorage()
+		assertNoError(t, ur.Add(ctx, user.Email, user))
+
+		file := ur.journal.file
+		ur.journal.file = shortWriter{file}
+		assertError(t, "no space left on device", ur.Add(ctx, "torn@mail.com", user))
+		ur.journal.file = file
+
+		_, err := ur.Get(ctx, "torn@mail.com")
+		assertError(t, "there is no such user to get", err)
+		assertNoError(t, ur.Add(ctx, "other@mail.com", user))
+
+		// simulate a crash: the journal is left behind without a final snapshot
+		close(ur.journal.stop)
+		ur.journal.file.Close()
+
+		restored := NewInMemoryUserStorage()
+		defer restored.Close()
+
+		for _, email := range []string{user.Email, "other@mail.com"} {
+			if _, err = restored.Get(ctx, email); err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+		}
+		_, err = restored.Get(ctx, "torn@mail.com")
+		assertError(t, "there is no such user to get", err)
+	})
+}
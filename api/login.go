@@ -1,15 +1,21 @@
 package main
 
 import (
-	"crypto/md5"
 	"encoding/json"
 	"errors"
+	"log"
+	"math"
 	"net/http"
+	"strconv"
+	"time"
 )
 
 type JWTParams struct {
 	Email    string `json:"email"`
 	Password string `json:"password"`
+	// OTP is a TOTP or recovery code, for users with two-factor
+	// authentication enabled.
+	OTP string `json:"otp"`
 }
 
 func (u *UserService) JWT(w http.ResponseWriter, r *http.Request, jwtService *MyJWTService) {
@@ -20,24 +26,109 @@ func (u *UserService) JWT(w http.ResponseWriter, r *http.Request, jwtService *My
 		return
 	}
 
-	passwordDigest := md5.New().Sum([]byte(params.Password))
-	user, err := u.repository.Get(params.Email)
+	attempt, wait := u.throttle.Reserve(params.Email, clientAddr(r), time.Now())
+	if attempt == nil {
+		failedLogins.WithLabelValues("locked").Inc()
+		handleTooManyLogins(w, wait)
+		return
+	}
+	defer attempt.Release()
+
+	user, err := u.repository.Get(r.Context(), params.Email)
 	if err != nil {
+		failedLogins.WithLabelValues("unknown_user").Inc()
+		u.loginFailed(attempt, false)
 		handleError(err, w)
 		return
 	}
 
-	if string(passwordDigest) != user.PasswordDigest {
+	if ok, _ := verifyPassword(params.Password, user.PasswordDigest); !ok {
+		failedLogins.WithLabelValues("wrong_password").Inc()
+		u.loginFailed(attempt, true)
 		handleError(errors.New("invalid login params"), w)
 		return
 	}
 
-	token, err := jwtService.GenerateJWT(user.Email)
+	if user.Unverified && u.verification.policy == unverifiedNone {
+		handleError(errEmailNotVerified, w)
+		return
+	}
+
+	if user.TOTP.Enabled {
+		if err = checkSecondFactor(&user, params.OTP, time.Now()); errors.Is(err, errInvalidTOTPCode) {
+			failedLogins.WithLabelValues("wrong_otp").Inc()
+			u.loginFailed(attempt, true)
+		}
+		if err != nil {
+			handleError(err, w)
+			return
+		}
+
+		// a code that was used already makes the update stale
+		if err = u.repository.Update(r.Context(), user.Email, user); err != nil {
+			handleError(errInvalidTOTPCode, w)
+			return
+		}
+
+		u.notifier <- []byte("updated 2fa: " + user.Email)
+
+		if user, err = u.repository.Get(r.Context(), user.Email); err != nil {
+			handleError(err, w)
+			return
+		}
+	}
+	attempt.Succeeded()
+
+	if u.hasher.NeedsRehash(user.PasswordDigest) {
+		u.rehash(r, user, params.Password)
+	}
+
+	resp, session, refresh, err := jwtService.issueTokenPair(r, user, "")
 	if err != nil {
 		handleError(errors.New("invalid login params"), w)
 		return
 	}
 
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte(token))
+	if err = u.repository.AddSession(r.Context(), session); err != nil {
+		handleError(err, w)
+		return
+	}
+
+	if err = u.repository.AddRefreshToken(r.Context(), refresh); err != nil {
+		handleError(err, w)
+		return
+	}
+
+	writeTokenResponse(w, resp)
+}
+
+func handleTooManyLogins(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	w.WriteHeader(http.StatusTooManyRequests)
+	w.Write([]byte("too many failed logins, try again later"))
+}
+
+// loginFailed counts a failed login. Unknown emails count too, so that
+// locking out does not tell which accounts exist, but only known accounts
+// being locked are announced.
+func (u *UserService) loginFailed(attempt *loginReservation, known bool) {
+	if attempt.Failed(time.Now()) && known {
+		accountLockouts.Inc()
+		u.notifier <- []byte("locked: " + attempt.login)
+	}
+}
+
+// rehash upgrades the digest of a user who just proved the password. Failing
+// to do so is not a reason to refuse the login, the next one will retry.
+func (u *UserService) rehash(r *http.Request, user User, password string) {
+	digest, err := u.hasher.Hash(password)
+	if err != nil {
+		log.Println("Could not rehash password:", err)
+		return
+	}
+
+	user.PasswordDigest = digest
+	if err = u.repository.Update(r.Context(), user.Email, user); err != nil {
+		log.Println("Could not rehash password:", err)
+	}
 }
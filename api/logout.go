@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// Logout revokes the token the request came with and the refresh tokens
+// issued from the same login.
+func (us *UserService) Logout(w http.ResponseWriter, r *http.Request, u User) {
+	if err := us.repository.RevokeSession(r.Context(), currentToken(r)); err != nil {
+		handleError(err, w)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("logged out"))
+}
+
+// LogoutAll revokes every token of the user by moving it to the next token
+// generation. Api keys are revoked too: logging out everywhere is what users
+// do when they fear their credentials leaked.
+func (us *UserService) LogoutAll(w http.ResponseWriter, r *http.Request, u User) {
+	if err := us.repository.RevokeAllTokens(r.Context(), u.Email); err != nil {
+		handleError(err, w)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("logged out everywhere"))
+	us.notifier <- []byte("logged out everywhere: " + u.Email)
+}
+
+func (ur *InMemoryUserStorage) RevokeSession(ctx context.Context, token RevokedToken) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	ur.lock.Lock()
+	defer ur.lock.Unlock()
+
+	return ur.commit(journalEntry{Op: "logout", Token: token.ID, Expires: token.ExpiresAt, At: time.Now()})
+}
+
+func (ur *InMemoryUserStorage) RevokeAllTokens(ctx context.Context, login string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	ur.lock.Lock()
+	defer ur.lock.Unlock()
+
+	if _, ok := ur.storage[login]; !ok {
+		return errors.New("there is no such user to log out")
+	}
+
+	return ur.commit(journalEntry{Op: "logout_all", Login: login, At: time.Now()})
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+type lruEntry struct {
+	key       string
+	value     interface{}
+	expiresAt time.Time
+}
+
+// lruFill tracks the loads of a key in flight. Every Delete of the key bumps
+// version, so a load that started before it knows its value is stale.
+type lruFill struct {
+	version uint64
+	loading int
+}
+
+// lruCache is a size bounded cache whose entries also go stale after ttl.
+type lruCache struct {
+	lock    sync.Mutex
+	size    int
+	ttl     time.Duration
+	order   *list.List
+	entries map[string]*list.Element
+	fills   map[string]*lruFill
+}
+
+func newLRUCache(size int, ttl time.Duration) *lruCache {
+	return &lruCache{
+		size:    size,
+		ttl:     ttl,
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+		fills:   make(map[string]*lruFill),
+	}
+}
+
+func (c *lruCache) Get(key string) (interface{}, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+
+	entry := elem.Value.(*lruEntry)
+	if time.Now().After(entry.expiresAt) {
+		c.order.Remove(elem)
+		delete(c.entries, key)
+		return nil, false
+	}
+
+	c.order.MoveToFront(elem)
+	return entry.value, true
+}
+
+func (c *lruCache) Set(key string, value interface{}) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.set(key, value)
+}
+
+// Miss starts loading key and returns the version to pass to Fill. Every Miss
+// is followed by a Done once the load is over.
+func (c *lruCache) Miss(key string) uint64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	f, ok := c.fills[key]
+	if !ok {
+		f = &lruFill{}
+		c.fills[key] = f
+	}
+	f.loading++
+	return f.version
+}
+
+// Fill stores the loaded value unless key was deleted since Miss returned
+// version.
+func (c *lruCache) Fill(key string, value interface{}, version uint64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if f, ok := c.fills[key]; ok && f.version == version {
+		c.set(key, value)
+	}
+}
+
+func (c *lruCache) Done(key string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if f, ok := c.fills[key]; ok {
+		if f.loading--; f.loading == 0 {
+			delete(c.fills, key)
+		}
+	}
+}
+
+func (c *lruCache) set(key string, value interface{}) {
+	if elem, ok := c.entries[key]; ok {
+		entry := elem.Value.(*lruEntry)
+		entry.value = value
+		entry.expiresAt = time.Now().Add(c.ttl)
+		c.order.MoveToFront(elem)
+		return
+	}
+
+	c.entries[key] = c.order.PushFront(&lruEntry{
+		key:       key,
+		value:     value,
+		expiresAt: time.Now().Add(c.ttl),
+	})
+
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*lruEntry).key)
+	}
+}
+
+func (c *lruCache) Delete(key string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if elem, ok := c.entries[key]; ok {
+		c.order.Remove(elem)
+		delete(c.entries, key)
+	}
+
+	if f, ok := c.fills[key]; ok {
+		f.version++
+	}
+}
+
+func (c *lruCache) Len() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.order.Len()
+}
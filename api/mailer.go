@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultMailFrom = "cake-service@localhost"
+
+// Mailer delivers emails to users.
+type Mailer interface {
+	Send(ctx context.Context, to string, subject string, body string) error
+}
+
+// newMailer picks SMTP when CAKE_SMTP_ADDR is set, else writes emails to
+// CAKE_MAIL_FILE, else to the log.
+func newMailer() (Mailer, error) {
+	from := os.Getenv("CAKE_MAIL_FROM")
+	if len(from) == 0 {
+		from = defaultMailFrom
+	}
+
+	if addr := os.Getenv("CAKE_SMTP_ADDR"); len(addr) != 0 {
+		return newSMTPMailer(addr, os.Getenv("CAKE_SMTP_USER"), os.Getenv("CAKE_SMTP_PASSWORD"), from)
+	}
+
+	if path := os.Getenv("CAKE_MAIL_FILE"); len(path) != 0 {
+		f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			return nil, err
+		}
+		return &WriterMailer{w: f, from: from}, nil
+	}
+
+	return &WriterMailer{w: log.Writer(), from: from}, nil
+}
+
+func formatMail(from string, to string, subject string, body string) []byte {
+	return []byte("From: " + from + "\r\n" +
+		"To: " + to + "\r\n" +
+		"Subject: " + subject + "\r\n" +
+		"Date: " + time.Now().Format(time.RFC1123Z) + "\r\n" +
+		"Content-Type: text/plain; charset=UTF-8\r\n" +
+		"\r\n" +
+		strings.ReplaceAll(body, "\n", "\r\n") + "\r\n")
+}
+
+// SMTPMailer sends through an SMTP relay, authenticating with PLAIN when a
+// user is configured. net/smtp refuses PLAIN over unencrypted connections
+// to anything but localhost.
+type SMTPMailer struct {
+	addr string
+	from string
+	auth smtp.Auth
+}
+
+func newSMTPMailer(addr string, user string, password string, from string) (*SMTPMailer, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, errors.New("invalid SMTP address \"" + addr + "\"")
+	}
+
+	m := &SMTPMailer{addr: addr, from: from}
+	if len(user) != 0 {
+		m.auth = smtp.PlainAuth("", user, password, host)
+	}
+	return m, nil
+}
+
+func (m *SMTPMailer) Send(ctx context.Context, to string, subject string, body string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return smtp.SendMail(m.addr, m.auth, m.from, []string{to}, formatMail(m.from, to, subject, body))
+}
+
+// WriterMailer writes emails out instead of sending them, for local
+// development.
+type WriterMailer struct {
+	lock sync.Mutex
+	w    io.Writer
+	from string
+}
+
+func (m *WriterMailer) Send(ctx context.Context, to string, subject string, body string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	_, err := m.w.Write(append(formatMail(m.from, to, subject, body), '\n'))
+	return err
+}
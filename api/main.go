@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"io"
 	"log"
 	"net/http"
 	"os"
@@ -12,6 +13,7 @@ import (
 )
 
 func (us *UserService) getCakeHandler(w http.ResponseWriter, r *http.Request, u User) {
+	w.Header().Set("ETag", etag(u))
 	w.Write([]byte(u.FavoriteCake))
 	cakesGiven.Inc()
 }
@@ -25,12 +27,64 @@ func wrapJWT(
 	}
 }
 
+func newUserRepository() (UserRepository, error) {
+	dsn := os.Getenv("CAKE_DB_DSN")
+	if len(dsn) == 0 {
+		return NewInMemoryUserStorage(), nil
+	}
+
+	driver := os.Getenv("CAKE_DB_DRIVER")
+	if len(driver) == 0 {
+		driver = "postgres"
+	}
+
+	return NewSQLUserStorage(driver, dsn)
+}
+
 func main() {
 	r := mux.NewRouter()
 
+	storage, err := newUserRepository()
+	if err != nil {
+		panic(err)
+	}
+
+	repository := storage
+	if size, ttl := cacheConfig(); size > 0 {
+		cache := NewCachedUserRepository(storage, size, ttl)
+		go runInvalidationConsumer(cache)
+		repository = cache
+	}
+
+	hasher, err := newPasswordHasher()
+	if err != nil {
+		panic(err)
+	}
+
+	mailer, err := newMailer()
+	if err != nil {
+		panic(err)
+	}
+
+	verification, err := emailVerificationFromEnv()
+	if err != nil {
+		panic(err)
+	}
+
+	identityProvider, err := oidcProviderFromEnv(verification)
+	if err != nil {
+		panic(err)
+	}
+
 	userService := UserService{
-		notifier:   make(chan []byte, 10),
-		repository: NewInMemoryUserStorage(),
+		notifier:     make(chan []byte, 10),
+		repository:   repository,
+		hasher:       hasher,
+		throttle:     loginThrottleFromEnv(),
+		mailer:       mailer,
+		verification: verification,
+
+		identityProvider: identityProvider,
 	}
 
 	myJWTService, err := NewMyJWTService()
@@ -40,40 +94,112 @@ func main() {
 
 	go runPublisher(userService.notifier)
 	go startProm()
+	go runTokenSweeper(storage, tokenSweepInterval())
 
 	r.HandleFunc(
 		"/user/me",
-		logRequest(myJWTService.jwtAuth(userService.repository, userService.getCakeHandler)),
+		logRequest(myJWTService.jwtAuth(userService.repository, userService.getCakeHandler, "profile:read")),
+	).Methods(http.MethodGet)
+	r.HandleFunc(
+		"/user/me",
+		logRequest(myJWTService.jwtAuth(userService.repository, userService.DeleteAccount)),
+	).Methods(http.MethodDelete)
+	r.HandleFunc(
+		"/user/export",
+		logRequest(myJWTService.jwtAuth(userService.repository, userService.Export, "profile:read")),
 	).Methods(http.MethodGet)
 	r.HandleFunc("/user/register", logRequest(userService.Register)).Methods(http.MethodPost)
+	r.HandleFunc("/user/verify", logRequest(userService.Verify)).Methods(http.MethodGet)
+	r.HandleFunc(
+		"/user/verify/resend",
+		logRequest(myJWTService.jwtAuth(userService.repository, userService.ResendVerification)),
+	).Methods(http.MethodPost)
+	r.HandleFunc("/.well-known/jwks.json", logRequest(myJWTService.JWKS)).Methods(http.MethodGet)
 	r.HandleFunc(
 		"/user/jwt",
 		logRequest(wrapJWT(myJWTService, userService.JWT)),
 	).Methods(http.MethodPost)
+	if userService.identityProvider != nil {
+		r.HandleFunc("/user/oidc/login", logRequest(userService.OIDCLogin)).Methods(http.MethodGet)
+		r.HandleFunc(
+			"/user/oidc/link",
+			logRequest(myJWTService.jwtAuth(userService.repository, userService.OIDCLink)),
+		).Methods(http.MethodPost)
+		r.HandleFunc(
+			"/user/oidc/callback",
+			logRequest(wrapJWT(myJWTService, userService.OIDCCallback)),
+		).Methods(http.MethodGet)
+	}
+	r.HandleFunc(
+		"/user/refresh",
+		logRequest(wrapJWT(myJWTService, userService.Refresh)),
+	).Methods(http.MethodPost)
+	r.HandleFunc(
+		"/user/logout",
+		logRequest(myJWTService.jwtAuth(userService.repository, userService.Logout)),
+	).Methods(http.MethodPost)
+	r.HandleFunc(
+		"/user/logout/all",
+		logRequest(myJWTService.jwtAuth(userService.repository, userService.LogoutAll)),
+	).Methods(http.MethodPost)
+	r.HandleFunc(
+		"/user/2fa",
+		logRequest(myJWTService.jwtAuth(userService.repository, userService.requireVerified(userService.EnrollTOTP))),
+	).Methods(http.MethodPost)
+	r.HandleFunc(
+		"/user/2fa/confirm",
+		logRequest(myJWTService.jwtAuth(userService.repository, userService.requireVerified(userService.ConfirmTOTP))),
+	).Methods(http.MethodPost)
+	r.HandleFunc(
+		"/user/2fa",
+		logRequest(myJWTService.jwtAuth(userService.repository, userService.requireVerified(userService.DisableTOTP))),
+	).Methods(http.MethodDelete)
+	r.HandleFunc(
+		"/user/keys",
+		logRequest(myJWTService.jwtAuth(userService.repository, userService.requireVerified(userService.CreateAPIKey))),
+	).Methods(http.MethodPost)
+	r.HandleFunc(
+		"/user/keys",
+		logRequest(myJWTService.jwtAuth(userService.repository, userService.ListAPIKeys)),
+	).Methods(http.MethodGet)
+	r.HandleFunc(
+		"/user/keys",
+		logRequest(myJWTService.jwtAuth(userService.repository, userService.RevokeAPIKey)),
+	).Methods(http.MethodDelete)
 	r.HandleFunc(
 		"/user/favorite_cake",
-		logRequest(myJWTService.jwtAuth(userService.repository, userService.OverwriteCake)),
+		logRequest(myJWTService.jwtAuth(userService.repository, userService.requireVerified(userService.OverwriteCake), "profile:write")),
 	).Methods(http.MethodPut)
+	r.HandleFunc("/user/password/forgot", logRequest(userService.ForgotPassword)).Methods(http.MethodPost)
+	r.HandleFunc("/user/password/reset", logRequest(userService.ResetPassword)).Methods(http.MethodPost)
 	r.HandleFunc(
 		"/user/password",
-		logRequest(myJWTService.jwtAuth(userService.repository, userService.OverwritePassword)),
+		logRequest(myJWTService.jwtAuth(userService.repository, userService.requireVerified(userService.OverwritePassword))),
 	).Methods(http.MethodPut)
 	r.HandleFunc(
 		"/user/email",
-		logRequest(myJWTService.jwtAuth(userService.repository, userService.OverwriteEmail)),
+		logRequest(myJWTService.jwtAuth(userService.repository, userService.requireVerified(userService.OverwriteEmail))),
 	).Methods(http.MethodPut)
 	r.HandleFunc(
 		"/admin/ban",
-		logRequest(myJWTService.jwtAuth(userService.repository, userService.BanUser)),
+		logRequest(myJWTService.jwtAuth(userService.repository, userService.requireVerified(userService.BanUser), "admin:ban")),
 	).Methods(http.MethodPost)
 	r.HandleFunc(
 		"/admin/unban",
-		logRequest(myJWTService.jwtAuth(userService.repository, userService.UnbanUser)),
+		logRequest(myJWTService.jwtAuth(userService.repository, userService.requireVerified(userService.UnbanUser), "admin:ban")),
 	).Methods(http.MethodPost)
 	r.HandleFunc(
 		"/admin/inspect",
-		logRequest(myJWTService.jwtAuth(userService.repository, userService.History)),
+		logRequest(myJWTService.jwtAuth(userService.repository, userService.requireVerified(userService.History), "admin:read")),
+	).Methods(http.MethodGet)
+	r.HandleFunc(
+		"/admin/users",
+		logRequest(myJWTService.jwtAuth(userService.repository, userService.requireVerified(userService.ListUsers), "admin:read")),
 	).Methods(http.MethodGet)
+	r.HandleFunc(
+		"/admin/keys/rotate",
+		logRequest(myJWTService.jwtAuth(userService.repository, userService.requireVerified(myJWTService.RotateKeys))),
+	).Methods(http.MethodPost)
 
     apiPort := os.Getenv("API_PORT")
 	srv := http.Server{
@@ -96,5 +222,11 @@ func main() {
 		log.Println("Server exited with error:", err)
 	}
 
+	if closer, ok := storage.(io.Closer); ok {
+		if err = closer.Close(); err != nil {
+			log.Println("Could not close storage:", err)
+		}
+	}
+
 	log.Println("Good bye :)")
 }
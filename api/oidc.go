@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/philanton/cake-service/pkg/oidc"
+)
+
+const (
+	oidcCookie       = "cake_oidc"
+	oidcCookiePath   = "/user/oidc"
+	oidcLoginTTL     = 10 * time.Minute
+	discoveryTimeout = 10 * time.Second
+)
+
+var errInvalidOIDCLogin = errors.New("login with the identity provider is not valid, start over")
+
+// oidcProviderFromEnv reads CAKE_OIDC_ISSUER, CAKE_OIDC_CLIENT_ID,
+// CAKE_OIDC_CLIENT_SECRET, CAKE_OIDC_REDIRECT_URL and CAKE_OIDC_SCOPES.
+// Without an issuer there is no provider to log in with.
+func oidcProviderFromEnv(v emailVerification) (*oidc.Provider, error) {
+	issuer := os.Getenv("CAKE_OIDC_ISSUER")
+	if len(issuer) == 0 {
+		return nil, nil
+	}
+
+	redirectURL := os.Getenv("CAKE_OIDC_REDIRECT_URL")
+	if len(redirectURL) == 0 {
+		redirectURL = v.baseURL + oidcCookiePath + "/callback"
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), discoveryTimeout)
+	defer cancel()
+
+	return oidc.NewProvider(ctx, oidc.Config{
+		Issuer:       issuer,
+		ClientID:     os.Getenv("CAKE_OIDC_CLIENT_ID"),
+		ClientSecret: os.Getenv("CAKE_OIDC_CLIENT_SECRET"),
+		RedirectURL:  redirectURL,
+		Scopes:       strings.Fields(os.Getenv("CAKE_OIDC_SCOPES")),
+	})
+}
+
+// oidcLogin is what a login started with the provider has to be completed
+// with. It waits in a signed cookie for the user to come back. A login
+// started by OIDCLink carries the email of the account to link.
+type oidcLogin struct {
+	state    string
+	nonce    string
+	verifier string
+	link     string
+}
+
+func (v emailVerification) oidcCookie(l oidcLogin, now time.Time) string {
+	payload := l.state + "." + l.nonce + "." + l.verifier + "." + base64.RawURLEncoding.EncodeToString([]byte(l.link)) +
+		"." + strconv.FormatInt(now.Add(oidcLoginTTL).Unix(), 10)
+	return payload + "." + v.sign("oidc", payload, "")
+}
+
+func (v emailVerification) parseOIDCCookie(value string, now time.Time) (oidcLogin, error) {
+	parts := strings.Split(value, ".")
+	if len(parts) != 6 {
+		return oidcLogin{}, errInvalidOIDCLogin
+	}
+
+	payload := strings.Join(parts[:5], ".")
+	if subtle.ConstantTimeCompare([]byte(parts[5]), []byte(v.sign("oidc", payload, ""))) != 1 {
+		return oidcLogin{}, errInvalidOIDCLogin
+	}
+
+	link, err := base64.RawURLEncoding.DecodeString(parts[3])
+	if err != nil {
+		return oidcLogin{}, errInvalidOIDCLogin
+	}
+
+	expiry, err := strconv.ParseInt(parts[4], 10, 64)
+	if err != nil || now.Unix() > expiry {
+		return oidcLogin{}, errInvalidOIDCLogin
+	}
+
+	return oidcLogin{state: parts[0], nonce: parts[1], verifier: parts[2], link: string(link)}, nil
+}
+
+// OIDCLogin sends the user to log in with the identity provider.
+func (us *UserService) OIDCLogin(w http.ResponseWriter, r *http.Request) {
+	us.startOIDCLogin(w, r, oidcLogin{}, http.StatusFound)
+}
+
+// OIDCLink sends the user to log in with the identity provider and links
+// the identity it comes back with to u. Only a login that just checked the
+// credentials of u may do so.
+func (us *UserService) OIDCLink(w http.ResponseWriter, r *http.Request, u User) {
+	if !recentLogin(r, time.Now()) {
+		handleError(errors.New("log in again to link an identity"), w)
+		return
+	}
+
+	us.startOIDCLogin(w, r, oidcLogin{link: u.Email}, http.StatusSeeOther)
+}
+
+func (us *UserService) startOIDCLogin(w http.ResponseWriter, r *http.Request, login oidcLogin, status int) {
+	for _, s := range []*string{&login.state, &login.nonce, &login.verifier} {
+		value, err := oidc.RandomString()
+		if err != nil {
+			handleError(err, w)
+			return
+		}
+		*s = value
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcCookie,
+		Value:    us.verification.oidcCookie(login, time.Now()),
+		Path:     oidcCookiePath,
+		MaxAge:   int(oidcLoginTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(us.verification.baseURL, "https://"),
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, us.identityProvider.AuthCodeURL(login.state, login.nonce, login.verifier), status)
+}
+
+// OIDCCallback completes a login started by OIDCLogin and issues our own
+// token pair. The provider authenticated the user, so there is no password
+// or second factor to check here.
+func (us *UserService) OIDCCallback(w http.ResponseWriter, r *http.Request, jwtService *MyJWTService) {
+	q := r.URL.Query()
+	if reason := q.Get("error"); len(reason) != 0 {
+		failedLogins.WithLabelValues("oidc").Inc()
+		handleError(errors.New("identity provider refused the login: "+reason), w)
+		return
+	}
+
+	cookie, err := r.Cookie(oidcCookie)
+	if err != nil {
+		handleError(errInvalidOIDCLogin, w)
+		return
+	}
+
+	login, err := us.verification.parseOIDCCookie(cookie.Value, time.Now())
+	if err != nil || subtle.ConstantTimeCompare([]byte(q.Get("state")), []byte(login.state)) != 1 {
+		handleError(errInvalidOIDCLogin, w)
+		return
+	}
+
+	// the login is completed or failed from here on, either way it is over
+	http.SetCookie(w, &http.Cookie{Name: oidcCookie, Path: oidcCookiePath, MaxAge: -1})
+
+	claims, err := us.identityProvider.Exchange(r.Context(), q.Get("code"), login.nonce, login.verifier)
+	if err != nil {
+		failedLogins.WithLabelValues("oidc").Inc()
+		handleError(err, w)
+		return
+	}
+
+	user, err := us.oidcUser(r, claims, login.link)
+	if err != nil {
+		handleError(err, w)
+		return
+	}
+
+	if user.Unverified && us.verification.policy == unverifiedNone {
+		handleError(errEmailNotVerified, w)
+		return
+	}
+
+	resp, session, refresh, err := jwtService.issueTokenPair(r, user, "")
+	if err != nil {
+		handleError(err, w)
+		return
+	}
+
+	if err = us.repository.AddSession(r.Context(), session); err != nil {
+		handleError(err, w)
+		return
+	}
+
+	if err = us.repository.AddRefreshToken(r.Context(), refresh); err != nil {
+		handleError(err, w)
+		return
+	}
+
+	writeTokenResponse(w, resp)
+}
+
+// oidcUser finds the user the identity in claims is linked to. An identity
+// seen for the first time is linked to link, the account that started the
+// login with OIDCLink, if any. Otherwise an account is created for it, with no
+// password.
+//
+// An identity is never linked to an existing account just for sharing its
+// email, the provider does not know the password or second factor of the
+// account. The exception is an account nobody verified the email of yet: it
+// could be registered by somebody else than its owner, so an identity the
+// provider verified the email of takes it over, see takeOver.
+func (us *UserService) oidcUser(r *http.Request, claims oidc.IDClaims, link string) (User, error) {
+	issuer := us.identityProvider.Issuer()
+	id, err := us.repository.GetIdentity(r.Context(), issuer, claims.Subject)
+	if err == nil {
+		if len(link) != 0 {
+			return User{}, errors.New("identity is already linked")
+		}
+		return us.repository.Get(r.Context(), id.Email)
+	} else if !errors.Is(err, errNoSuchIdentity) {
+		return User{}, err
+	}
+
+	id = Identity{Issuer: issuer, Subject: claims.Subject, Email: link, LinkedAt: time.Now()}
+	if len(link) != 0 {
+		if err = us.repository.LinkIdentity(r.Context(), id); err != nil {
+			return User{}, err
+		}
+		return us.repository.Get(r.Context(), link)
+	}
+
+	if err = validateEmail(claims.Email); err != nil {
+		return User{}, errors.New("identity provider did not share a valid email")
+	}
+
+	id.Email = claims.Email
+	if existing, err := us.repository.Get(r.Context(), claims.Email); err == nil {
+		if !existing.Unverified || !claims.EmailVerified {
+			return User{}, errors.New("email is already registered, log in and link the identity")
+		}
+		if err = us.takeOver(r, existing, id); err != nil {
+			return User{}, err
+		}
+		return us.repository.Get(r.Context(), claims.Email)
+	}
+
+	user := User{
+		Email:      claims.Email,
+		Role:       "user",
+		Unverified: !claims.EmailVerified,
+	}
+
+	if err = us.repository.Add(r.Context(), user.Email, user); err != nil {
+		return User{}, err
+	}
+	if user.Unverified {
+		us.sendVerification(r, user)
+	}
+
+	us.notifier <- []byte("registered: " + user.Email)
+	registeredUsers.Inc()
+
+	if err = us.repository.LinkIdentity(r.Context(), id); err != nil {
+		return User{}, err
+	}
+
+	return us.repository.Get(r.Context(), claims.Email)
+}
+
+// takeOver verifies the email of u for the identity provider that vouched
+// for it with id. The password, second factor, linked identities and every
+// token the account had stop working, they may be of whoever registered the
+// address before its owner.
+func (us *UserService) takeOver(r *http.Request, u User, id Identity) error {
+	u.PasswordDigest = ""
+	u.TOTP = TOTP{}
+	u.Unverified = false
+	if err := us.repository.TakeOver(r.Context(), u.Email, u, id); err != nil {
+		return err
+	}
+
+	if err := us.repository.RevokeAllTokens(r.Context(), u.Email); err != nil {
+		return err
+	}
+
+	us.notifier <- []byte("verified: " + u.Email)
+	return nil
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// PasswordHasher turns passwords into digests that carry their own
+// parameters, so the parameters can change without breaking old digests.
+type PasswordHasher interface {
+	Hash(password string) (string, error)
+	// Verify returns errUnknownDigest for digests of another scheme.
+	Verify(password string, digest string) (bool, error)
+	// NeedsRehash reports whether digest is of another scheme or was made
+	// with other parameters than Hash uses now.
+	NeedsRehash(digest string) bool
+}
+
+var errUnknownDigest = errors.New("unknown password digest")
+
+// passwordSchemes can verify every digest the service ever stored, whatever
+// hasher is configured now. Legacy digests go first: they end with a fixed
+// suffix but may start with anything, "$2" included.
+var passwordSchemes = []PasswordHasher{md5Hasher{}, argon2idHasher{}, bcryptHasher{}}
+
+func newPasswordHasher() (PasswordHasher, error) {
+	switch scheme := os.Getenv("CAKE_PASSWORD_HASHER"); scheme {
+	case "", "argon2id":
+		return defaultArgon2idHasher, nil
+	case "bcrypt":
+		return bcryptHasher{cost: bcrypt.DefaultCost}, nil
+	default:
+		return nil, errors.New("unknown password hasher \"" + scheme + "\"")
+	}
+}
+
+func verifyPassword(password string, digest string) (bool, error) {
+	for _, scheme := range passwordSchemes {
+		ok, err := scheme.Verify(password, digest)
+		if !errors.Is(err, errUnknownDigest) {
+			return ok, err
+		}
+	}
+	return false, errUnknownDigest
+}
+
+type argon2idHasher struct {
+	time    uint32
+	memory  uint32
+	threads uint8
+	keyLen  uint32
+}
+
+// defaultArgon2idHasher follows the OWASP recommendation.
+var defaultArgon2idHasher = argon2idHasher{time: 2, memory: 19 * 1024, threads: 1, keyLen: 32}
+
+func (h argon2idHasher) Hash(password string) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	key := argon2.IDKey([]byte(password), salt, h.time, h.memory, h.threads, h.keyLen)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, h.memory, h.time, h.threads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+// decode parses "$argon2id$v=19$m=..,t=..,p=..$salt$key".
+func (argon2idHasher) decode(digest string) (argon2idHasher, []byte, []byte, error) {
+	parts := strings.Split(digest, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return argon2idHasher{}, nil, nil, errUnknownDigest
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return argon2idHasher{}, nil, nil, errors.New("unsupported argon2id version")
+	}
+
+	h := argon2idHasher{}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &h.memory, &h.time, &h.threads); err != nil {
+		return argon2idHasher{}, nil, nil, errors.New("malformed argon2id parameters")
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return argon2idHasher{}, nil, nil, errors.New("malformed argon2id salt")
+	}
+
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return argon2idHasher{}, nil, nil, errors.New("malformed argon2id key")
+	}
+
+	h.keyLen = uint32(len(key))
+	return h, salt, key, nil
+}
+
+func (h argon2idHasher) Verify(password string, digest string) (bool, error) {
+	params, salt, key, err := h.decode(digest)
+	if err != nil {
+		return false, err
+	}
+
+	actual := argon2.IDKey([]byte(password), salt, params.time, params.memory, params.threads, params.keyLen)
+	return subtle.ConstantTimeCompare(actual, key) == 1, nil
+}
+
+func (h argon2idHasher) NeedsRehash(digest string) bool {
+	params, _, _, err := h.decode(digest)
+	return err != nil || params != h
+}
+
+type bcryptHasher struct {
+	cost int
+}
+
+func (h bcryptHasher) Hash(password string) (string, error) {
+	digest, err := bcrypt.GenerateFromPassword([]byte(password), h.cost)
+	return string(digest), err
+}
+
+func (bcryptHasher) Verify(password string, digest string) (bool, error) {
+	if !strings.HasPrefix(digest, "$2") {
+		return false, errUnknownDigest
+	}
+
+	err := bcrypt.CompareHashAndPassword([]byte(digest), []byte(password))
+	if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (h bcryptHasher) NeedsRehash(digest string) bool {
+	cost, err := bcrypt.Cost([]byte(digest))
+	return err != nil || cost != h.cost
+}
+
+// md5Hasher reads digests stored before passwords were hashed properly:
+// the plaintext followed by the MD5 of nothing. It is only there so those
+// users can log in once and get rehashed.
+type md5Hasher struct{}
+
+func (md5Hasher) Hash(password string) (string, error) {
+	return string(md5.New().Sum([]byte(password))), nil
+}
+
+func (h md5Hasher) Verify(password string, digest string) (bool, error) {
+	if !strings.HasSuffix(digest, string(md5.New().Sum(nil))) {
+		return false, errUnknownDigest
+	}
+
+	expected, _ := h.Hash(password)
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(digest)) == 1, nil
+}
+
+func (md5Hasher) NeedsRehash(string) bool {
+	return true
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"crypto/md5"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestPasswordHashers(t *testing.T) {
+	for name, h := range map[string]PasswordHasher{
+		"argon2id": defaultArgon2idHasher,
+		"bcrypt":   bcryptHasher{cost: bcrypt.MinCost},
+	} {
+		t.Run(name, func(t *testing.T) {
+			digest, err := h.Hash("somepass")
+			assertNoError(t, err)
+
+			// digests go to VARCHAR columns, which postgres keeps to UTF-8
+			if !utf8.ValidString(digest) || strings.ContainsRune(digest, 0) {
+				t.Errorf("Expected a text digest, got %q", digest)
+			}
+
+			other, err := h.Hash("somepass")
+			assertNoError(t, err)
+			if digest == other {
+				t.Errorf("Expected digests to be salted, got %s twice", digest)
+			}
+
+			if ok, err := verifyPassword("somepass", digest); !ok || err != nil {
+				t.Errorf("Expected password to match %s, got %v, %v", digest, ok, err)
+			}
+
+			if ok, err := verifyPassword("otherpass", digest); ok || err != nil {
+				t.Errorf("Expected password not to match %s, got %v, %v", digest, ok, err)
+			}
+
+			if h.NeedsRehash(digest) {
+				t.Errorf("Expected %s not to need rehashing", digest)
+			}
+		})
+	}
+
+	t.Run("legacy digests", func(t *testing.T) {
+		digest := string(md5.New().Sum([]byte("$2a$somepass")))
+
+		if ok, err := verifyPassword("$2a$somepass", digest); !ok || err != nil {
+			t.Errorf("Expected legacy digest to match, got %v, %v", ok, err)
+		}
+
+		if ok, _ := verifyPassword("somepass", digest); ok {
+			t.Errorf("Expected legacy digest not to match")
+		}
+	})
+
+	t.Run("changed parameters", func(t *testing.T) {
+		digest, err := bcryptHasher{cost: bcrypt.MinCost}.Hash("somepass")
+		assertNoError(t, err)
+
+		if !defaultArgon2idHasher.NeedsRehash(digest) {
+			t.Errorf("Expected bcrypt digest to need rehashing with argon2id")
+		}
+
+		stronger := defaultArgon2idHasher
+		stronger.time++
+		digest, err = defaultArgon2idHasher.Hash("somepass")
+		assertNoError(t, err)
+
+		if !stronger.NeedsRehash(digest) {
+			t.Errorf("Expected digest to need rehashing with stronger parameters")
+		}
+
+		if _, err = verifyPassword("somepass", "plain"); err != errUnknownDigest {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	})
+}
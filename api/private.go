@@ -4,6 +4,8 @@ import (
 	"encoding/json"
 	"errors"
 	"net/http"
+	"strconv"
+	"strings"
 )
 
 type BanUserParams struct {
@@ -15,6 +17,21 @@ type UnbanUserParams struct {
 	Email string `json:"email"`
 }
 
+type UserListItem struct {
+	Email        string `json:"email"`
+	Role         string `json:"role"`
+	FavoriteCake string `json:"favorite_cake"`
+}
+
+type UserListResponse struct {
+	Users      []UserListItem `json:"users"`
+	NextCursor string         `json:"next_cursor,omitempty"`
+}
+
+func isAdmin(u User) bool {
+	return u.Role == "admin" || u.Role == "superadmin"
+}
+
 func (us *UserService) BanUser(w http.ResponseWriter, r *http.Request, u User) {
 	params := &BanUserParams{}
 	if err := json.NewDecoder(r.Body).Decode(params); err != nil {
@@ -22,7 +39,7 @@ func (us *UserService) BanUser(w http.ResponseWriter, r *http.Request, u User) {
 		return
 	}
 
-	user, err := us.repository.Get(params.Email)
+	user, err := us.repository.Get(r.Context(), params.Email)
 	if err != nil {
 		handleError(err, w)
 		return
@@ -33,7 +50,7 @@ func (us *UserService) BanUser(w http.ResponseWriter, r *http.Request, u User) {
 		return
 	}
 
-	err = us.repository.Ban(params.Email, u.Email, params.Reason)
+	err = us.repository.Ban(r.Context(), params.Email, u.Email, params.Reason)
 	if err != nil {
 		handleError(err, w)
 		return
@@ -51,7 +68,7 @@ func (us *UserService) UnbanUser(w http.ResponseWriter, r *http.Request, u User)
 		return
 	}
 
-	user, err := us.repository.Get(params.Email)
+	user, err := us.repository.Get(r.Context(), params.Email)
 	if err != nil {
 		handleError(err, w)
 		return
@@ -62,7 +79,7 @@ func (us *UserService) UnbanUser(w http.ResponseWriter, r *http.Request, u User)
 		return
 	}
 
-	err = us.repository.Unban(params.Email, u.Email)
+	err = us.repository.Unban(r.Context(), params.Email, u.Email)
 	if err != nil {
 		handleError(err, w)
 		return
@@ -73,25 +90,97 @@ func (us *UserService) UnbanUser(w http.ResponseWriter, r *http.Request, u User)
 	us.notifier <- []byte("unbanned: " + params.Email)
 }
 
-func (us *UserService) History(w http.ResponseWriter, r *http.Request, u User) {
-	email := r.URL.Query().Get("email")
-	if len(email) == 0 {
-		handleError(errors.New("email is not specified"), w)
+func parseUserQuery(r *http.Request) (UserQuery, error) {
+	values := r.URL.Query()
+	q := UserQuery{
+		Role:          values.Get("role"),
+		FavoriteCake:  values.Get("favorite_cake"),
+		EmailContains: values.Get("email"),
+		SortBy:        strings.TrimPrefix(values.Get("sort"), "-"),
+		Descending:    strings.HasPrefix(values.Get("sort"), "-"),
+		Cursor:        values.Get("cursor"),
+	}
+
+	if banned := values.Get("banned"); len(banned) != 0 {
+		b, err := strconv.ParseBool(banned)
+		if err != nil {
+			return UserQuery{}, errors.New("banned should be true or false")
+		}
+		q.Banned = &b
+	}
+
+	if limit := values.Get("limit"); len(limit) != 0 {
+		l, err := strconv.Atoi(limit)
+		if err != nil || l <= 0 {
+			return UserQuery{}, errors.New("limit should be between 1 and 100")
+		}
+		q.Limit = l
+	}
+
+	return q, nil
+}
+
+func (us *UserService) ListUsers(w http.ResponseWriter, r *http.Request, u User) {
+	if !isAdmin(u) {
+		handleError(errors.New("not enough privileges"), w)
 		return
 	}
 
-	user, err := us.repository.Get(email)
+	q, err := parseUserQuery(r)
 	if err != nil {
 		handleError(err, w)
 		return
 	}
 
-	if len(u.Role) <= len(user.Role) {
+	page, err := us.repository.List(r.Context(), q)
+	if err != nil {
+		handleError(err, w)
+		return
+	}
+
+	resp := UserListResponse{
+		Users:      make([]UserListItem, 0, len(page.Users)),
+		NextCursor: page.NextCursor,
+	}
+	for _, user := range page.Users {
+		resp.Users = append(resp.Users, UserListItem{
+			Email:        user.Email,
+			Role:         user.Role,
+			FavoriteCake: user.FavoriteCake,
+		})
+	}
+
+	body, err := json.Marshal(resp)
+	if err != nil {
+		handleError(err, w)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
+
+func (us *UserService) History(w http.ResponseWriter, r *http.Request, u User) {
+	email := r.URL.Query().Get("email")
+	if len(email) == 0 {
+		handleError(errors.New("email is not specified"), w)
+		return
+	}
+
+	// a deleted user has no role left to compare, but its history is kept
+	user, err := us.repository.Get(r.Context(), email)
+	if err != nil {
+		deleted, tombErr := us.repository.Tombstoned(r.Context(), email)
+		if tombErr != nil || !deleted {
+			handleError(err, w)
+			return
+		}
+	} else if len(u.Role) <= len(user.Role) {
 		handleError(errors.New("not enough privileges"), w)
 		return
 	}
 
-	history, err := us.repository.BanHistory(email)
+	history, err := us.repository.BanHistory(r.Context(), email)
 	if err != nil {
 		handleError(err, w)
 		return
@@ -106,3 +195,21 @@ func (us *UserService) History(w http.ResponseWriter, r *http.Request, u User) {
 	w.WriteHeader(http.StatusOK)
 	w.Write(body)
 }
+
+// RotateKeys makes the api sign with a new key. Tokens signed with the old
+// one keep working until the key grace period is over.
+func (j *MyJWTService) RotateKeys(w http.ResponseWriter, r *http.Request, u User) {
+	if u.Role != "superadmin" {
+		handleError(errors.New("not enough privileges"), w)
+		return
+	}
+
+	kid, err := j.JWTService.RotateKeys()
+	if err != nil {
+		handleError(err, w)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	w.Write([]byte("signing with key \"" + kid + "\""))
+}
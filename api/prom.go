@@ -18,6 +18,22 @@ var (
 		Name: "number_of_cakes_given",
 		Help: "The total number of given cakes.",
 	})
+	revokedTokens = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "number_of_revoked_tokens",
+		Help: "The current number of revoked tokens that have not expired yet.",
+	})
+	cacheRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "user_cache_requests_total",
+		Help: "The total number of user cache lookups by kind and result.",
+	}, []string{"kind", "result"})
+	failedLogins = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "failed_logins_total",
+		Help: "The total number of refused logins by reason.",
+	}, []string{"reason"})
+	accountLockouts = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "account_lockouts_total",
+		Help: "The total number of accounts locked out after failed logins.",
+	})
 	requestRecords = promauto.NewHistogramVec(prometheus.HistogramOpts{
 		Name:    "api_request_record_seconds",
 		Help:    "Histogram of response time for handler in seconds.",
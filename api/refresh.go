@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"time"
+)
+
+const defaultRefreshTokenTTL = 30 * 24 * time.Hour
+
+var (
+	errInvalidRefreshToken = errors.New("refresh token is not valid")
+	errRefreshTokenReused  = errors.New("refresh token was already used")
+)
+
+// RefreshToken is stored by the hash of the token handed to the client.
+// Tokens rotated from one login share a Family, and AccessToken is the access
+// token issued together with each of them, so a reused refresh token can take
+// everything issued from that login down with it.
+type RefreshToken struct {
+	ID          string
+	Family      string
+	Email       string
+	ExpiresAt   time.Time
+	AccessToken RevokedToken
+	UsedAt      time.Time
+	Revoked     bool
+}
+
+type TokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int64  `json:"expires_in"`
+}
+
+type RefreshParams struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+func refreshTokenTTL() time.Duration {
+	ttl, err := time.ParseDuration(os.Getenv("CAKE_REFRESH_TOKEN_TTL"))
+	if err != nil || ttl <= 0 {
+		return defaultRefreshTokenTTL
+	}
+	return ttl
+}
+
+func hashRefreshToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// issueTokenPair forges an access token and a refresh token of family for
+// u. An empty family starts a new one: u just logged in.
+func (j *MyJWTService) issueTokenPair(r *http.Request, u User, family string) (TokenResponse, Session, RefreshToken, error) {
+	authTime := time.Time{}
+	if len(family) == 0 {
+		authTime = time.Now()
+	}
+
+	access, session, err := j.issueToken(r, u, authTime)
+	if err != nil {
+		return TokenResponse{}, Session{}, RefreshToken{}, err
+	}
+
+	refresh, err := randomToken()
+	if err != nil {
+		return TokenResponse{}, Session{}, RefreshToken{}, err
+	}
+
+	if len(family) == 0 {
+		family = hashRefreshToken(refresh)
+	}
+
+	resp := TokenResponse{
+		AccessToken:  access,
+		RefreshToken: refresh,
+		TokenType:    "Bearer",
+	}
+	if !session.ExpiresAt.IsZero() {
+		resp.ExpiresIn = int64(time.Until(session.ExpiresAt).Seconds())
+	}
+
+	return resp, session, RefreshToken{
+		ID:          hashRefreshToken(refresh),
+		Family:      family,
+		Email:       u.Email,
+		ExpiresAt:   time.Now().Add(refreshTokenTTL()),
+		AccessToken: RevokedToken{ID: session.ID, ExpiresAt: session.ExpiresAt},
+	}, nil
+}
+
+func writeTokenResponse(w http.ResponseWriter, resp TokenResponse) {
+	body, err := json.Marshal(resp)
+	if err != nil {
+		handleError(err, w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
+
+// Refresh trades a refresh token for a new pair. Every refresh token works
+// once: presenting a used one means it leaked, so its whole family is revoked.
+func (u *UserService) Refresh(w http.ResponseWriter, r *http.Request, jwtService *MyJWTService) {
+	params := &RefreshParams{}
+	if err := json.NewDecoder(r.Body).Decode(params); err != nil {
+		handleError(errors.New("could not read params"), w)
+		return
+	}
+
+	old, err := u.repository.GetRefreshToken(r.Context(), hashRefreshToken(params.RefreshToken))
+	if err != nil {
+		handleError(err, w)
+		return
+	}
+
+	if err = u.repository.IsBanned(r.Context(), old.Email); err != nil {
+		handleError(err, w)
+		return
+	}
+
+	user, err := u.repository.Get(r.Context(), old.Email)
+	if err != nil {
+		handleError(errInvalidRefreshToken, w)
+		return
+	}
+
+	resp, session, next, err := jwtService.issueTokenPair(r, user, old.Family)
+	if err != nil {
+		handleError(errInvalidRefreshToken, w)
+		return
+	}
+
+	if err = u.repository.RotateRefreshToken(r.Context(), old.ID, next); err != nil {
+		if errors.Is(err, errRefreshTokenReused) {
+			log.Println("Refresh token reused, revoked its family for", old.Email)
+		}
+		handleError(err, w)
+		return
+	}
+
+	if err = u.repository.AddSession(r.Context(), session); err != nil {
+		handleError(err, w)
+		return
+	}
+
+	writeTokenResponse(w, resp)
+}
+
+func (ur *InMemoryUserStorage) AddRefreshToken(ctx context.Context, t RefreshToken) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	ur.lock.Lock()
+	defer ur.lock.Unlock()
+
+	if _, ok := ur.storage[t.Email]; !ok {
+		return errors.New("there is no such user to log in")
+	}
+
+	return ur.commit(journalEntry{Op: "refresh", Login: t.Email, Refresh: t, At: time.Now()})
+}
+
+func (ur *InMemoryUserStorage) GetRefreshToken(ctx context.Context, id string) (RefreshToken, error) {
+	if err := ctx.Err(); err != nil {
+		return RefreshToken{}, err
+	}
+
+	ur.lock.RLock()
+	defer ur.lock.RUnlock()
+
+	t, ok := ur.refreshTokens[id]
+	if !ok {
+		return RefreshToken{}, errInvalidRefreshToken
+	}
+	return t, nil
+}
+
+// RotateRefreshToken marks the token id used and stores next in its place.
+// If id was used already, its family is revoked instead.
+func (ur *InMemoryUserStorage) RotateRefreshToken(ctx context.Context, id string, next RefreshToken) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	ur.lock.Lock()
+	defer ur.lock.Unlock()
+
+	t, ok := ur.refreshTokens[id]
+	if !ok || t.Revoked {
+		return errInvalidRefreshToken
+	}
+
+	now := time.Now()
+	if !t.UsedAt.IsZero() {
+		if err := ur.commit(journalEntry{Op: "reuse", Login: t.Email, Token: t.Family, At: now}); err != nil {
+			return err
+		}
+		return errRefreshTokenReused
+	}
+
+	if !t.ExpiresAt.After(now) {
+		return errors.New("refresh token has expired")
+	}
+
+	next.Family = t.Family
+	next.Email = t.Email
+	return ur.commit(journalEntry{Op: "rotate", Login: t.Email, Token: id, Refresh: next, At: now})
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+)
+
+var (
+	errInvalidResetToken = errors.New("reset token is not valid")
+	errExpiredResetToken = errors.New("reset token has expired")
+)
+
+type ForgotPasswordParams struct {
+	Email string `json:"email"`
+}
+
+type ResetPasswordParams struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+// resetToken is bound to the current password digest of u, so it stops
+// working once any password is set: it can be used once.
+func (v emailVerification) resetToken(u User, now time.Time) string {
+	return v.signedToken("reset", u.Email, u.PasswordDigest, now.Add(v.resetTTL))
+}
+
+// ForgotPassword mails a reset token. It answers the same whether or not
+// the account exists, and mails in the background so that the time it takes
+// does not tell either.
+func (us *UserService) ForgotPassword(w http.ResponseWriter, r *http.Request) {
+	params := &ForgotPasswordParams{}
+	if err := json.NewDecoder(r.Body).Decode(params); err != nil {
+		handleError(errors.New("could not read params"), w)
+		return
+	}
+
+	if user, err := us.repository.Get(r.Context(), params.Email); err == nil {
+		token := us.verification.resetToken(user, time.Now())
+		body := "Hi,\n\nsomebody asked to reset the password of your account. If it was you, " +
+			"use this token to choose a new password:\n\n" +
+			token + "\n\n" +
+			"The token expires in " + us.verification.resetTTL.String() + ". " +
+			"If it was not you, ignore this email.\n"
+
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+			defer cancel()
+
+			if err := us.mailer.Send(ctx, user.Email, "Reset your password", body); err != nil {
+				log.Println("Could not send password reset email to", user.Email, err)
+			}
+		}()
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+	w.Write([]byte("if the account exists, a reset token is sent to its email"))
+}
+
+// ResetPassword sets a new password and logs the user out everywhere.
+func (us *UserService) ResetPassword(w http.ResponseWriter, r *http.Request) {
+	params := &ResetPasswordParams{}
+	if err := json.NewDecoder(r.Body).Decode(params); err != nil {
+		handleError(errors.New("could not read params"), w)
+		return
+	}
+
+	if err := validatePassword(params.Password); err != nil {
+		handleError(err, w)
+		return
+	}
+
+	email, err := tokenEmail(params.Token)
+	if err != nil {
+		handleError(errInvalidResetToken, w)
+		return
+	}
+
+	user, err := us.repository.Get(r.Context(), email)
+	if err != nil {
+		handleError(errInvalidResetToken, w)
+		return
+	}
+
+	err = us.verification.checkSignedToken("reset", params.Token, user.PasswordDigest, time.Now())
+	if errors.Is(err, errVerificationLinkStale) {
+		handleError(errExpiredResetToken, w)
+		return
+	} else if err != nil {
+		handleError(errInvalidResetToken, w)
+		return
+	}
+
+	digest, err := us.hasher.Hash(params.Password)
+	if err != nil {
+		handleError(err, w)
+		return
+	}
+
+	// the token came by email, which verifies the address too
+	user.PasswordDigest = digest
+	user.Unverified = false
+	if err = us.repository.Update(r.Context(), email, user); err != nil {
+		// somebody reset the password with the same token just now
+		handleError(errInvalidResetToken, w)
+		return
+	}
+
+	if err = us.repository.RevokeAllTokens(r.Context(), email); err != nil {
+		handleError(err, w)
+		return
+	}
+	us.throttle.Succeeded(email)
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("password is reset"))
+	us.notifier <- []byte("password reset: " + email)
+}
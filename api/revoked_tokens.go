@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/philanton/cake-service/pkg/jwt"
+)
+
+const defaultTokenSweepInterval = time.Minute
+
+// RevokedToken identifies a token on the denylist by its jti. ExpiresAt is
+// when the token stops being valid on its own, zero if it never does.
+type RevokedToken struct {
+	ID        string
+	ExpiresAt time.Time
+}
+
+type authContextKey struct{}
+
+func withAuth(r *http.Request, a jwt.Claims) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), authContextKey{}, a))
+}
+
+// currentToken returns the token the request was authenticated with by
+// jwtAuth.
+func currentToken(r *http.Request) RevokedToken {
+	a, _ := r.Context().Value(authContextKey{}).(jwt.Claims)
+
+	t := RevokedToken{ID: a.Id}
+	if a.ExpiresAt != 0 {
+		t.ExpiresAt = time.Unix(a.ExpiresAt, 0)
+	}
+	return t
+}
+
+// recentLogin tells whether the request came with a token issued at a login
+// less than maxReauthAge ago. Refreshed tokens were not.
+func recentLogin(r *http.Request, now time.Time) bool {
+	a, _ := r.Context().Value(authContextKey{}).(jwt.Claims)
+	return a.AuthTime != 0 && now.Sub(time.Unix(a.AuthTime, 0)) <= maxReauthAge
+}
+
+func tokenSweepInterval() time.Duration {
+	interval, err := time.ParseDuration(os.Getenv("CAKE_TOKEN_SWEEP_INTERVAL"))
+	if err != nil || interval <= 0 {
+		return defaultTokenSweepInterval
+	}
+	return interval
+}
+
+// runTokenSweeper drops revoked tokens that have expired anyway and reports
+// the size of what is left.
+func runTokenSweeper(ur UserRepository, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), interval)
+		remaining, err := ur.PurgeExpiredTokens(ctx, time.Now())
+		cancel()
+
+		if err != nil {
+			log.Println("Could not purge revoked tokens", err)
+		} else {
+			revokedTokens.Set(float64(remaining))
+		}
+
+		<-ticker.C
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// Session is a token issued to a user, recorded so the user can see where
+// they are logged in.
+type Session struct {
+	ID         string
+	Email      string
+	IssuedAt   time.Time
+	ExpiresAt  time.Time
+	UserAgent  string
+	RemoteAddr string
+}
+
+func (ur *InMemoryUserStorage) AddSession(ctx context.Context, s Session) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	ur.lock.Lock()
+	defer ur.lock.Unlock()
+
+	if _, ok := ur.storage[s.Email]; !ok {
+		return errors.New("there is no such user to log in")
+	}
+
+	return ur.commit(journalEntry{Op: "session", Login: s.Email, Session: s, At: time.Now()})
+}
+
+// Sessions returns the sessions of the user that have neither expired nor
+// been revoked.
+func (ur *InMemoryUserStorage) Sessions(ctx context.Context, login string) ([]Session, error) {
+	if err := ctx.Err(); err != nil {
+		return []Session{}, err
+	}
+
+	ur.lock.RLock()
+	defer ur.lock.RUnlock()
+
+	now := time.Now()
+	sessions := []Session{}
+	for _, s := range ur.sessions[login] {
+		if _, revoked := ur.invTokenDB[s.ID]; revoked {
+			continue
+		}
+		if !s.ExpiresAt.IsZero() && !s.ExpiresAt.After(now) {
+			continue
+		}
+		sessions = append(sessions, s)
+	}
+
+	return sessions, nil
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultMaxLoginAttempts    = 5
+	defaultMaxAddrAttempts     = 20
+	defaultLoginLockout        = time.Minute
+	maxLoginLockout            = time.Hour
+	loginAttemptsPurgeInterval = 10 * time.Minute
+	// maxTrackedLogins bounds the accounts and the addresses counted each,
+	// or guessing at made up emails would grow them without end.
+	maxTrackedLogins = 100000
+	// pendingLoginWait is what to retry after when the attempts left are
+	// all taken by logins still being checked.
+	pendingLoginWait = time.Second
+)
+
+type loginAttempts struct {
+	failures    int
+	lastFailure time.Time
+	lockedUntil time.Time
+	// pending counts the attempts reserved but not yet found to fail or not.
+	pending int
+}
+
+// loginThrottle counts failed logins per account and per client address.
+// Once either gets past its free attempts, every further failure locks it
+// out for twice as long as the one before, up to maxLoginLockout. Counts are
+// forgotten after maxLoginLockout without failures.
+//
+// The counts live in the process, every api replica keeps its own.
+type loginThrottle struct {
+	lock       sync.Mutex
+	maxAccount int
+	maxAddr    int
+	maxTracked int
+	lockout    time.Duration
+	accounts   map[string]*loginAttempts
+	addrs      map[string]*loginAttempts
+	lastPurge  time.Time
+}
+
+func newLoginThrottle(maxAccount, maxAddr int, lockout time.Duration) *loginThrottle {
+	return &loginThrottle{
+		maxAccount: maxAccount,
+		maxAddr:    maxAddr,
+		maxTracked: maxTrackedLogins,
+		lockout:    lockout,
+		accounts:   make(map[string]*loginAttempts),
+		addrs:      make(map[string]*loginAttempts),
+	}
+}
+
+// loginThrottleFromEnv reads CAKE_LOGIN_MAX_ATTEMPTS, CAKE_LOGIN_MAX_ADDR_ATTEMPTS
+// and CAKE_LOGIN_LOCKOUT.
+func loginThrottleFromEnv() *loginThrottle {
+	maxAccount, err := strconv.Atoi(os.Getenv("CAKE_LOGIN_MAX_ATTEMPTS"))
+	if err != nil || maxAccount <= 0 {
+		maxAccount = defaultMaxLoginAttempts
+	}
+
+	maxAddr, err := strconv.Atoi(os.Getenv("CAKE_LOGIN_MAX_ADDR_ATTEMPTS"))
+	if err != nil || maxAddr <= 0 {
+		maxAddr = defaultMaxAddrAttempts
+	}
+
+	lockout, err := time.ParseDuration(os.Getenv("CAKE_LOGIN_LOCKOUT"))
+	if err != nil || lockout <= 0 {
+		lockout = defaultLoginLockout
+	}
+
+	return newLoginThrottle(maxAccount, maxAddr, lockout)
+}
+
+func clientAddr(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// RetryAfter returns how long login and addr are still locked out for.
+func (t *loginThrottle) RetryAfter(login string, addr string, now time.Time) time.Duration {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	wait := time.Duration(0)
+	for _, a := range []*loginAttempts{t.accounts[login], t.addrs[addr]} {
+		if a != nil && a.lockedUntil.Sub(now) > wait {
+			wait = a.lockedUntil.Sub(now)
+		}
+	}
+	return wait
+}
+
+// attempts returns the counts of key, forgetting failures too old to matter.
+// Making room for a new key evicts the one that failed longest ago among
+// those neither locked out nor being checked. Forgetting those would let
+// their guesses through, so without any it returns nil.
+func (t *loginThrottle) attempts(attempts map[string]*loginAttempts, key string, now time.Time) *loginAttempts {
+	a, ok := attempts[key]
+	if ok {
+		if now.Sub(a.lastFailure) > maxLoginLockout {
+			*a = loginAttempts{pending: a.pending}
+		}
+		return a
+	}
+
+	if len(attempts) >= t.maxTracked {
+		t.purge(now)
+	}
+	if len(attempts) >= t.maxTracked {
+		oldest := ""
+		for k, other := range attempts {
+			if other.pending != 0 || other.lockedUntil.After(now) {
+				continue
+			}
+			if oldest == "" || other.lastFailure.Before(attempts[oldest].lastFailure) {
+				oldest = k
+			}
+		}
+		if oldest == "" {
+			return nil
+		}
+		delete(attempts, oldest)
+	}
+
+	a = &loginAttempts{}
+	attempts[key] = a
+	return a
+}
+
+// available tells whether a has an attempt left to reserve. Past the free
+// ones, every attempt allowed by the lockout is tried one at a time.
+func (a *loginAttempts) available(max int, now time.Time) bool {
+	if a == nil {
+		return true
+	}
+
+	failures := a.failures
+	if now.Sub(a.lastFailure) > maxLoginLockout {
+		failures = 0
+	}
+	return !a.lockedUntil.After(now) && (a.pending == 0 || failures+a.pending < max)
+}
+
+func (t *loginThrottle) fail(attempts map[string]*loginAttempts, key string, max int, now time.Time) bool {
+	a := t.attempts(attempts, key, now)
+	if a == nil {
+		return false
+	}
+
+	a.failures++
+	a.lastFailure = now
+	if a.failures < max {
+		return false
+	}
+
+	lockout := t.lockout
+	for i := max; i < a.failures && lockout < maxLoginLockout; i++ {
+		lockout *= 2
+	}
+	if lockout > maxLoginLockout {
+		lockout = maxLoginLockout
+	}
+
+	a.lockedUntil = now.Add(lockout)
+	return a.failures == max
+}
+
+// loginReservation is an attempt taken by Reserve. It has to be given back
+// with Failed, Succeeded or Release.
+type loginReservation struct {
+	throttle *loginThrottle
+	login    string
+	addr     string
+	done     bool
+}
+
+// Reserve takes an attempt for login from addr before the password is
+// checked, so that parallel requests can not try more than are left between
+// them. Without one left, or without room to count one, it returns how long
+// to wait instead.
+func (t *loginThrottle) Reserve(login string, addr string, now time.Time) (*loginReservation, time.Duration) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	account, address := t.accounts[login], t.addrs[addr]
+	if !account.available(t.maxAccount, now) || !address.available(t.maxAddr, now) {
+		wait := pendingLoginWait
+		for _, a := range []*loginAttempts{account, address} {
+			if a != nil && a.lockedUntil.Sub(now) > wait {
+				wait = a.lockedUntil.Sub(now)
+			}
+		}
+		return nil, wait
+	}
+
+	account, address = t.attempts(t.accounts, login, now), t.attempts(t.addrs, addr, now)
+	if account == nil || address == nil {
+		// the one that did fit was made for nothing
+		if account != nil && account.pending == 0 && account.failures == 0 {
+			delete(t.accounts, login)
+		}
+		if address != nil && address.pending == 0 && address.failures == 0 {
+			delete(t.addrs, addr)
+		}
+		return nil, pendingLoginWait
+	}
+
+	account.pending++
+	address.pending++
+	return &loginReservation{throttle: t, login: login, addr: addr}, 0
+}
+
+// release gives the attempt back, the caller holds the lock.
+func (r *loginReservation) release() bool {
+	if r.done {
+		return false
+	}
+	r.done = true
+
+	t := r.throttle
+	for _, c := range []struct {
+		attempts map[string]*loginAttempts
+		key      string
+	}{{t.accounts, r.login}, {t.addrs, r.addr}} {
+		if a, ok := c.attempts[c.key]; ok {
+			a.pending--
+			if a.pending == 0 && a.failures == 0 {
+				delete(c.attempts, c.key)
+			}
+		}
+	}
+	return true
+}
+
+// Failed counts the attempt as a failed login and reports whether it just
+// locked the account.
+func (r *loginReservation) Failed(now time.Time) bool {
+	r.throttle.lock.Lock()
+	defer r.throttle.lock.Unlock()
+
+	if !r.release() {
+		return false
+	}
+	return r.throttle.failed(r.login, r.addr, now)
+}
+
+// Succeeded counts the attempt as a login and forgets the failures of the
+// account, as loginThrottle.Succeeded does.
+func (r *loginReservation) Succeeded() {
+	r.throttle.lock.Lock()
+	defer r.throttle.lock.Unlock()
+
+	if r.release() {
+		r.throttle.succeeded(r.login)
+	}
+}
+
+// Release gives the attempt back without counting it, it does nothing once
+// the attempt was counted already.
+func (r *loginReservation) Release() {
+	r.throttle.lock.Lock()
+	defer r.throttle.lock.Unlock()
+
+	r.release()
+}
+
+// Failed records a failed login and reports whether it just locked the
+// account.
+func (t *loginThrottle) Failed(login string, addr string, now time.Time) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	return t.failed(login, addr, now)
+}
+
+func (t *loginThrottle) failed(login string, addr string, now time.Time) bool {
+	if now.Sub(t.lastPurge) > loginAttemptsPurgeInterval {
+		t.purge(now)
+	}
+
+	t.fail(t.addrs, addr, t.maxAddr, now)
+	return t.fail(t.accounts, login, t.maxAccount, now)
+}
+
+// Succeeded forgets the failures of login. Those of the address stay, or
+// logging in to one account would reset guessing at all the others.
+func (t *loginThrottle) Succeeded(login string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.succeeded(login)
+}
+
+// succeeded keeps the attempts other requests have reserved for login.
+func (t *loginThrottle) succeeded(login string) {
+	if a, ok := t.accounts[login]; ok && a.pending != 0 {
+		*a = loginAttempts{pending: a.pending}
+		return
+	}
+	delete(t.accounts, login)
+}
+
+func (t *loginThrottle) purge(now time.Time) {
+	for _, attempts := range []map[string]*loginAttempts{t.accounts, t.addrs} {
+		for key, a := range attempts {
+			if a.pending == 0 && now.Sub(a.lastFailure) > maxLoginLockout {
+				delete(attempts, key)
+			}
+		}
+	}
+	t.lastPurge = now
+}
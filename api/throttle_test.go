@@ -0,0 +1,159 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLoginThrottle(t *testing.T) {
+	now := time.Now()
+
+	t.Run("backing off exponentially", func(t *testing.T) {
+		throttle := newLoginThrottle(3, 100, time.Minute)
+
+		locked := []bool{}
+		for i := 0; i < 5; i++ {
+			locked = append(locked, throttle.Failed("test@mail.com", "addr", now))
+		}
+
+		if locked[0] || locked[1] || !locked[2] || locked[3] || locked[4] {
+			t.Errorf("Expected the account to get locked once, on the third failure: %v", locked)
+		}
+
+		if wait := throttle.RetryAfter("test@mail.com", "other", now); wait != 4*time.Minute {
+			t.Errorf("Expected to wait 4m after 5 failures, got %v", wait)
+		}
+
+		for i := 0; i < 10; i++ {
+			throttle.Failed("test@mail.com", "addr", now)
+		}
+		if wait := throttle.RetryAfter("test@mail.com", "other", now); wait != maxLoginLockout {
+			t.Errorf("Expected lockout to be capped at %v, got %v", maxLoginLockout, wait)
+		}
+
+		if wait := throttle.RetryAfter("test@mail.com", "other", now.Add(2*maxLoginLockout)); wait != 0 {
+			t.Errorf("Expected lockout to be over, got %v", wait)
+		}
+	})
+
+	t.Run("locking out addresses", func(t *testing.T) {
+		throttle := newLoginThrottle(3, 4, time.Minute)
+
+		for _, login := range []string{"a@mail.com", "b@mail.com", "c@mail.com", "d@mail.com"} {
+			throttle.Failed(login, "addr", now)
+		}
+
+		if wait := throttle.RetryAfter("e@mail.com", "addr", now); wait != time.Minute {
+			t.Errorf("Expected the address to be locked out, got %v", wait)
+		}
+
+		if wait := throttle.RetryAfter("e@mail.com", "other", now); wait != 0 {
+			t.Errorf("Expected other addresses not to be locked out, got %v", wait)
+		}
+	})
+
+	t.Run("succeeding", func(t *testing.T) {
+		throttle := newLoginThrottle(3, 4, time.Minute)
+
+		throttle.Failed("test@mail.com", "addr", now)
+		throttle.Failed("test@mail.com", "addr", now)
+		throttle.Succeeded("test@mail.com")
+
+		if throttle.Failed("test@mail.com", "addr", now) {
+			t.Errorf("Expected a successful login to reset the account")
+		}
+
+		throttle.Failed("other@mail.com", "addr", now)
+		if throttle.RetryAfter("", "addr", now) == 0 {
+			t.Errorf("Expected a successful login not to reset the address")
+		}
+	})
+
+	t.Run("reserving attempts", func(t *testing.T) {
+		throttle := newLoginThrottle(3, 100, time.Minute)
+
+		attempts := []*loginReservation{}
+		for i := 0; i < 3; i++ {
+			attempt, wait := throttle.Reserve("test@mail.com", "addr", now)
+			if attempt == nil {
+				t.Fatalf("Expected attempt %d to be reserved, got to wait %v", i+1, wait)
+			}
+			attempts = append(attempts, attempt)
+		}
+
+		if attempt, wait := throttle.Reserve("test@mail.com", "addr", now); attempt != nil || wait != pendingLoginWait {
+			t.Errorf("Expected no attempt left while the others are checked, got to wait %v", wait)
+		}
+
+		attempts[0].Release()
+		attempts[0].Failed(now)
+		if attempt, _ := throttle.Reserve("test@mail.com", "addr", now); attempt == nil {
+			t.Errorf("Expected a released attempt to be free again")
+		} else {
+			attempts[0] = attempt
+		}
+
+		locked := []bool{}
+		for _, attempt := range attempts {
+			locked = append(locked, attempt.Failed(now))
+		}
+		if locked[0] || locked[1] || !locked[2] {
+			t.Errorf("Expected the account to get locked on the third failure: %v", locked)
+		}
+
+		if attempt, wait := throttle.Reserve("test@mail.com", "addr", now); attempt != nil || wait != time.Minute {
+			t.Errorf("Expected the account to be locked out, got to wait %v", wait)
+		}
+
+		later := now.Add(time.Minute)
+		attempt, _ := throttle.Reserve("test@mail.com", "addr", later)
+		if attempt == nil {
+			t.Fatalf("Expected the lockout to be over")
+		}
+		if other, _ := throttle.Reserve("test@mail.com", "addr", later); other != nil {
+			t.Errorf("Expected attempts past the free ones to be tried one at a time")
+		}
+
+		attempt.Succeeded()
+		if attempt, _ = throttle.Reserve("test@mail.com", "addr", later); attempt == nil {
+			t.Errorf("Expected a successful login to reset the account")
+		}
+	})
+
+	t.Run("bounding tracked logins", func(t *testing.T) {
+		throttle := newLoginThrottle(3, 100, time.Minute)
+		throttle.maxTracked = 2
+
+		throttle.Failed("a@mail.com", "addr", now)
+		throttle.Failed("b@mail.com", "addr", now.Add(time.Second))
+		throttle.Failed("c@mail.com", "addr", now.Add(2*time.Second))
+
+		if len(throttle.accounts) != 2 || throttle.accounts["a@mail.com"] != nil {
+			t.Errorf("Expected the oldest account to be forgotten: %v", throttle.accounts)
+		}
+
+		// locked out and pending accounts are never forgotten to make room
+		for i := 0; i < 3; i++ {
+			throttle.Failed("b@mail.com", "addr", now.Add(3*time.Second))
+		}
+		attempt, _ := throttle.Reserve("c@mail.com", "addr", now.Add(3*time.Second))
+		if attempt == nil {
+			t.Fatalf("Expected an attempt to be reserved")
+		}
+
+		if other, wait := throttle.Reserve("d@mail.com", "addr", now.Add(3*time.Second)); other != nil || wait != pendingLoginWait {
+			t.Errorf("Expected a new account to be refused, got %v, %v", other, wait)
+		}
+		if len(throttle.accounts) != 2 || throttle.accounts["d@mail.com"] != nil {
+			t.Errorf("Unexpected accounts: %v", throttle.accounts)
+		}
+		if wait := throttle.RetryAfter("b@mail.com", "addr", now.Add(3*time.Second)); wait == 0 {
+			t.Errorf("Expected the locked account to stay locked, got %v", wait)
+		}
+
+		attempt.Release()
+		if other, _ := throttle.Reserve("d@mail.com", "addr", now.Add(3*time.Second)); other == nil {
+			t.Errorf("Expected the released account to make room")
+		}
+	})
+}
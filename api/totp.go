@@ -0,0 +1,298 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	totpIssuer    = "cake-service"
+	totpPeriod    = 30
+	totpDigits    = 6
+	totpSkew      = 1
+	recoveryCodes = 10
+)
+
+var (
+	errTOTPRequired    = errors.New("two-factor code is required")
+	errInvalidTOTPCode = errors.New("invalid two-factor code")
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// TOTP is the two-factor state of a user, RFC 6238. Secret is set on
+// enrollment, which takes effect once the first code confirms it. LastStep
+// is the time step of the last code accepted, codes of it and of earlier
+// steps are refused so a code works once. RecoveryCodes are hashed and each
+// of them works once too.
+type TOTP struct {
+	Secret        string
+	Enabled       bool
+	LastStep      int64
+	RecoveryCodes []string
+}
+
+type TOTPEnrollment struct {
+	Secret string `json:"secret"`
+	URI    string `json:"otpauth_uri"`
+}
+
+type TOTPCodeParams struct {
+	Code string `json:"code"`
+}
+
+type RecoveryCodesResponse struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+func totpCode(secret []byte, step int64) string {
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(step))
+
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	code := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, code%1000000)
+}
+
+// verifyTOTP accepts codes of the steps next to the current one too, for
+// clocks that drift. It returns the step the code is of.
+func verifyTOTP(secret string, code string, lastStep int64, now time.Time) (int64, bool) {
+	key, err := totpEncoding.DecodeString(secret)
+	if err != nil || len(code) != totpDigits {
+		return 0, false
+	}
+
+	current := now.Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if step <= lastStep {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(totpCode(key, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+func totpURI(email string, secret string) string {
+	params := url.Values{
+		"secret":    {secret},
+		"issuer":    {totpIssuer},
+		"algorithm": {"SHA1"},
+		"digits":    {fmt.Sprint(totpDigits)},
+		"period":    {fmt.Sprint(totpPeriod)},
+	}
+	return "otpauth://totp/" + url.PathEscape(totpIssuer+":"+email) + "?" + params.Encode()
+}
+
+func hashRecoveryCode(code string) string {
+	sum := sha256.Sum256([]byte(strings.ToUpper(strings.ReplaceAll(code, "-", ""))))
+	return hex.EncodeToString(sum[:])
+}
+
+func newRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, 0, recoveryCodes)
+	hashes := make([]string, 0, recoveryCodes)
+	for i := 0; i < recoveryCodes; i++ {
+		b := make([]byte, 5)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+
+		code := totpEncoding.EncodeToString(b)
+		codes = append(codes, code[:4]+"-"+code[4:])
+		hashes = append(hashes, hashRecoveryCode(code))
+	}
+	return codes, hashes, nil
+}
+
+// checkSecondFactor accepts a TOTP code or a recovery code and records that
+// it was used in u. The caller has to store u for that to stick.
+func checkSecondFactor(u *User, code string, now time.Time) error {
+	if len(code) == 0 {
+		return errTOTPRequired
+	}
+
+	if step, ok := verifyTOTP(u.TOTP.Secret, code, u.TOTP.LastStep, now); ok {
+		u.TOTP.LastStep = step
+		return nil
+	}
+
+	hash := hashRecoveryCode(code)
+	for i, h := range u.TOTP.RecoveryCodes {
+		if subtle.ConstantTimeCompare([]byte(h), []byte(hash)) == 1 {
+			left := make([]string, 0, len(u.TOTP.RecoveryCodes)-1)
+			left = append(left, u.TOTP.RecoveryCodes[:i]...)
+			u.TOTP.RecoveryCodes = append(left, u.TOTP.RecoveryCodes[i+1:]...)
+			return nil
+		}
+	}
+
+	return errInvalidTOTPCode
+}
+
+// EnrollTOTP hands out a new secret. Two-factor authentication is only
+// enabled once ConfirmTOTP gets a code generated with it.
+func (us *UserService) EnrollTOTP(w http.ResponseWriter, r *http.Request, u User) {
+	if !ifMatch(r, u) {
+		handlePreconditionFailed(w)
+		return
+	}
+
+	if u.TOTP.Enabled {
+		handleError(errors.New("two-factor authentication is already enabled"), w)
+		return
+	}
+
+	secret := make([]byte, 20)
+	if _, err := rand.Read(secret); err != nil {
+		handleError(err, w)
+		return
+	}
+
+	u.TOTP = TOTP{Secret: totpEncoding.EncodeToString(secret)}
+	if err := us.repository.Update(r.Context(), u.Email, u); err != nil {
+		handleUpdateError(err, w)
+		return
+	}
+	us.notifier <- []byte("updated 2fa: " + u.Email)
+
+	body, err := json.Marshal(TOTPEnrollment{Secret: u.TOTP.Secret, URI: totpURI(u.Email, u.TOTP.Secret)})
+	if err != nil {
+		handleError(err, w)
+		return
+	}
+
+	u.Version++
+	w.Header().Set("ETag", etag(u))
+	w.WriteHeader(http.StatusCreated)
+	w.Write(body)
+}
+
+// ConfirmTOTP enables two-factor authentication and returns the recovery
+// codes, the only time they are shown.
+func (us *UserService) ConfirmTOTP(w http.ResponseWriter, r *http.Request, u User) {
+	if !ifMatch(r, u) {
+		handlePreconditionFailed(w)
+		return
+	}
+
+	params := &TOTPCodeParams{}
+	if err := json.NewDecoder(r.Body).Decode(params); err != nil {
+		handleError(errors.New("could not read params"), w)
+		return
+	}
+
+	if u.TOTP.Enabled {
+		handleError(errors.New("two-factor authentication is already enabled"), w)
+		return
+	}
+
+	if len(u.TOTP.Secret) == 0 {
+		handleError(errors.New("two-factor authentication is not being enrolled"), w)
+		return
+	}
+
+	// codes are guessed here as well as at login, so they count alike
+	attempt, wait := us.throttle.Reserve(u.Email, clientAddr(r), time.Now())
+	if attempt == nil {
+		handleTooManyLogins(w, wait)
+		return
+	}
+	defer attempt.Release()
+
+	step, ok := verifyTOTP(u.TOTP.Secret, params.Code, u.TOTP.LastStep, time.Now())
+	if !ok {
+		us.loginFailed(attempt, true)
+		handleError(errInvalidTOTPCode, w)
+		return
+	}
+
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		handleError(err, w)
+		return
+	}
+
+	u.TOTP = TOTP{Secret: u.TOTP.Secret, Enabled: true, LastStep: step, RecoveryCodes: hashes}
+	if err = us.repository.Update(r.Context(), u.Email, u); err != nil {
+		handleUpdateError(err, w)
+		return
+	}
+	attempt.Succeeded()
+	us.notifier <- []byte("updated 2fa: " + u.Email)
+
+	body, err := json.Marshal(RecoveryCodesResponse{RecoveryCodes: codes})
+	if err != nil {
+		handleError(err, w)
+		return
+	}
+
+	u.Version++
+	w.Header().Set("ETag", etag(u))
+	w.WriteHeader(http.StatusCreated)
+	w.Write(body)
+}
+
+func (us *UserService) DisableTOTP(w http.ResponseWriter, r *http.Request, u User) {
+	if !ifMatch(r, u) {
+		handlePreconditionFailed(w)
+		return
+	}
+
+	params := &TOTPCodeParams{}
+	if err := json.NewDecoder(r.Body).Decode(params); err != nil {
+		handleError(errors.New("could not read params"), w)
+		return
+	}
+
+	if !u.TOTP.Enabled {
+		handleError(errors.New("two-factor authentication is not enabled"), w)
+		return
+	}
+
+	attempt, wait := us.throttle.Reserve(u.Email, clientAddr(r), time.Now())
+	if attempt == nil {
+		handleTooManyLogins(w, wait)
+		return
+	}
+	defer attempt.Release()
+
+	if err := checkSecondFactor(&u, params.Code, time.Now()); err != nil {
+		if errors.Is(err, errInvalidTOTPCode) {
+			us.loginFailed(attempt, true)
+		}
+		handleError(err, w)
+		return
+	}
+
+	u.TOTP = TOTP{}
+	if err := us.repository.Update(r.Context(), u.Email, u); err != nil {
+		handleUpdateError(err, w)
+		return
+	}
+	attempt.Succeeded()
+	us.notifier <- []byte("updated 2fa: " + u.Email)
+
+	u.Version++
+	w.Header().Set("ETag", etag(u))
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("two-factor authentication is disabled"))
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTOTP(t *testing.T) {
+	// RFC 6238 appendix B, truncated to six digits
+	secret := totpEncoding.EncodeToString([]byte("12345678901234567890"))
+	vectors := map[int64]string{
+		59:          "287082",
+		1111111109:  "081804",
+		1234567890:  "005924",
+		20000000000: "353130",
+	}
+
+	for at, code := range vectors {
+		if step, ok := verifyTOTP(secret, code, 0, time.Unix(at, 0)); !ok || step != at/totpPeriod {
+			t.Errorf("Expected %s to be accepted at %d", code, at)
+		}
+	}
+
+	t.Run("replaying codes", func(t *testing.T) {
+		now := time.Unix(1234567890, 0)
+		step, ok := verifyTOTP(secret, "005924", 0, now)
+		if !ok {
+			t.FailNow()
+		}
+
+		if _, ok = verifyTOTP(secret, "005924", step, now); ok {
+			t.Errorf("Expected a used code to be refused")
+		}
+	})
+
+	t.Run("recovery codes", func(t *testing.T) {
+		codes, hashes, err := newRecoveryCodes()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		u := User{TOTP: TOTP{Secret: secret, Enabled: true, RecoveryCodes: hashes}}
+		if err = checkSecondFactor(&u, codes[3], time.Now()); err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+
+		if len(u.TOTP.RecoveryCodes) != recoveryCodes-1 {
+			t.Errorf("Expected the recovery code to be used up")
+		}
+
+		assertError(t, "invalid two-factor code", checkSecondFactor(&u, codes[3], time.Now()))
+		assertError(t, "two-factor code is required", checkSecondFactor(&u, "", time.Now()))
+	})
+}
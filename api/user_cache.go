@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultCacheTTL = 30 * time.Second
+
+// CachedUserRepository keeps what jwtAuth asks for on every request in
+// memory. Entries are dropped on local writes and on notifier events coming
+// from other replicas, and go stale after the TTL in any case.
+//
+// Only revoked tokens are cached: a cached "not revoked" could not be
+// invalidated, since notifier events do not name tokens.
+type CachedUserRepository struct {
+	UserRepository
+
+	users  *lruCache
+	bans   *lruCache
+	tokens *lruCache
+}
+
+func NewCachedUserRepository(ur UserRepository, size int, ttl time.Duration) *CachedUserRepository {
+	return &CachedUserRepository{
+		UserRepository: ur,
+		users:          newLRUCache(size, ttl),
+		bans:           newLRUCache(size, ttl),
+		tokens:         newLRUCache(size, ttl),
+	}
+}
+
+// cacheConfig reads CAKE_CACHE_SIZE and CAKE_CACHE_TTL, a zero size means
+// caching is off.
+func cacheConfig() (int, time.Duration) {
+	size, err := strconv.Atoi(os.Getenv("CAKE_CACHE_SIZE"))
+	if err != nil || size < 0 {
+		size = 0
+	}
+
+	ttl, err := time.ParseDuration(os.Getenv("CAKE_CACHE_TTL"))
+	if err != nil || ttl <= 0 {
+		ttl = defaultCacheTTL
+	}
+
+	return size, ttl
+}
+
+func (c *CachedUserRepository) invalidate(logins ...string) {
+	for _, login := range logins {
+		c.users.Delete(login)
+		c.bans.Delete(login)
+	}
+}
+
+// Invalidate drops whatever is cached for the users an event like
+// "banned: <email>" or "updated email: <old> -> <new>" mentions.
+func (c *CachedUserRepository) Invalidate(event []byte) {
+	msg := string(event)
+	idx := strings.Index(msg, ": ")
+	if idx < 0 {
+		return
+	}
+
+	c.invalidate(strings.Split(msg[idx+2:], " -> ")...)
+}
+
+func (c *CachedUserRepository) Get(ctx context.Context, login string) (User, error) {
+	if u, ok := c.users.Get(login); ok {
+		cacheRequests.WithLabelValues("user", "hit").Inc()
+		return u.(User), nil
+	}
+	cacheRequests.WithLabelValues("user", "miss").Inc()
+
+	// an invalidation landing while the user is read makes it stale already
+	version := c.users.Miss(login)
+	defer c.users.Done(login)
+
+	u, err := c.UserRepository.Get(ctx, login)
+	if err != nil {
+		return u, err
+	}
+
+	c.users.Fill(login, u, version)
+	return u, nil
+}
+
+func (c *CachedUserRepository) IsBanned(ctx context.Context, login string) error {
+	if err, ok := c.bans.Get(login); ok {
+		cacheRequests.WithLabelValues("ban", "hit").Inc()
+		if err == nil {
+			return nil
+		}
+		return err.(error)
+	}
+	cacheRequests.WithLabelValues("ban", "miss").Inc()
+
+	version := c.bans.Miss(login)
+	defer c.bans.Done(login)
+
+	err := c.UserRepository.IsBanned(ctx, login)
+	if err == nil || errors.As(err, &banError{}) {
+		c.bans.Fill(login, err, version)
+	}
+	return err
+}
+
+func (c *CachedUserRepository) CheckNotInDB(ctx context.Context, tokenID string) error {
+	if _, ok := c.tokens.Get(tokenID); ok {
+		cacheRequests.WithLabelValues("token", "hit").Inc()
+		return errors.New("token is banned")
+	}
+	cacheRequests.WithLabelValues("token", "miss").Inc()
+
+	err := c.UserRepository.CheckNotInDB(ctx, tokenID)
+	if err != nil && ctx.Err() == nil && err.Error() == "token is banned" {
+		c.tokens.Set(tokenID, struct{}{})
+	}
+	return err
+}
+
+func (c *CachedUserRepository) Add(ctx context.Context, login string, u User) error {
+	defer c.invalidate(login)
+	return c.UserRepository.Add(ctx, login, u)
+}
+
+func (c *CachedUserRepository) Update(ctx context.Context, login string, u User) error {
+	defer c.invalidate(login)
+	return c.UserRepository.Update(ctx, login, u)
+}
+
+func (c *CachedUserRepository) Delete(ctx context.Context, login string) (User, error) {
+	defer c.invalidate(login)
+	return c.UserRepository.Delete(ctx, login)
+}
+
+func (c *CachedUserRepository) Rename(ctx context.Context, login string, newLogin string, version int, token RevokedToken) error {
+	defer c.invalidate(login, newLogin)
+	return c.UserRepository.Rename(ctx, login, newLogin, version, token)
+}
+
+func (c *CachedUserRepository) TakeOver(ctx context.Context, login string, u User, id Identity) error {
+	defer c.invalidate(login)
+	return c.UserRepository.TakeOver(ctx, login, u, id)
+}
+
+func (c *CachedUserRepository) Tombstone(ctx context.Context, login string, until time.Time, token RevokedToken) error {
+	defer c.invalidate(login)
+	return c.UserRepository.Tombstone(ctx, login, until, token)
+}
+
+func (c *CachedUserRepository) RevokeAllTokens(ctx context.Context, login string) error {
+	defer c.invalidate(login)
+	return c.UserRepository.RevokeAllTokens(ctx, login)
+}
+
+func (c *CachedUserRepository) Ban(ctx context.Context, login string, byLogin string, reason string) error {
+	defer c.invalidate(login)
+	return c.UserRepository.Ban(ctx, login, byLogin, reason)
+}
+
+func (c *CachedUserRepository) Unban(ctx context.Context, login string, byLogin string) error {
+	defer c.invalidate(login)
+	return c.UserRepository.Unban(ctx, login, byLogin)
+}
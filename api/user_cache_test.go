@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// racingRepository runs meanwhile after reading from the wrapped repository,
+// as if another request wrote between the read and the cache fill.
+type racingRepository struct {
+	UserRepository
+	meanwhile func()
+}
+
+func (r *racingRepository) Get(ctx context.Context, login string) (User, error) {
+	u, err := r.UserRepository.Get(ctx, login)
+	r.meanwhile()
+	return u, err
+}
+
+func (r *racingRepository) IsBanned(ctx context.Context, login string) error {
+	err := r.UserRepository.IsBanned(ctx, login)
+	r.meanwhile()
+	return err
+}
+
+func TestCachedUserRepository(t *testing.T) {
+	testUserRepository(t, func(t *testing.T) UserRepository {
+		return NewCachedUserRepository(NewInMemoryUserStorage(), 10, time.Minute)
+	})
+
+	ctx := context.Background()
+	user := User{
+		Email:          "test@mail.com",
+		PasswordDigest: "digest",
+		Role:           "user",
+		FavoriteCake:   "somecake",
+	}
+
+	t.Run("evicting least recently used entries", func(t *testing.T) {
+		c := newLRUCache(2, time.Minute)
+		c.Set("a", 1)
+		c.Set("b", 2)
+		c.Get("a")
+		c.Set("c", 3)
+
+		if _, ok := c.Get("b"); ok {
+			t.Errorf("Expected \"b\" to be evicted")
+		}
+		if _, ok := c.Get("a"); !ok {
+			t.Errorf("Expected \"a\" to be kept")
+		}
+		if c.Len() != 2 {
+			t.Errorf("Unexpected cache size: %d", c.Len())
+		}
+	})
+
+	t.Run("expiring entries", func(t *testing.T) {
+		c := newLRUCache(2, time.Millisecond)
+		c.Set("a", 1)
+		time.Sleep(5 * time.Millisecond)
+
+		if _, ok := c.Get("a"); ok {
+			t.Errorf("Expected \"a\" to expire")
+		}
+	})
+
+	t.Run("serving users from cache", func(t *testing.T) {
+		storage := NewInMemoryUserStorage()
+		cache := NewCachedUserRepository(storage, 10, time.Minute)
+		assertNoError(t, cache.Add(ctx, user.Email, user))
+
+		cached, err := cache.Get(ctx, user.Email)
+		assertNoError(t, err)
+
+		changed := cached
+		changed.FavoriteCake = "othercake"
+		assertNoError(t, storage.Update(ctx, user.Email, changed))
+
+		u, err := cache.Get(ctx, user.Email)
+		assertNoError(t, err)
+		if u.FavoriteCake != "somecake" {
+			t.Errorf("Expected cached user, got %v", u)
+		}
+
+		cache.Invalidate([]byte("updated cake: " + user.Email))
+		u, err = cache.Get(ctx, user.Email)
+		assertNoError(t, err)
+		if u.FavoriteCake != "othercake" {
+			t.Errorf("Expected fresh user, got %v", u)
+		}
+	})
+
+	t.Run("invalidating on local writes", func(t *testing.T) {
+		cache := NewCachedUserRepository(NewInMemoryUserStorage(), 10, time.Minute)
+		assertNoError(t, cache.Add(ctx, user.Email, user))
+		assertNoError(t, cache.IsBanned(ctx, user.Email))
+
+		assertNoError(t, cache.Ban(ctx, user.Email, "admin@mail.com", "some reason"))
+		assertError(t, "user is banned with reason \"some reason\" by \"admin@mail.com\"", cache.IsBanned(ctx, user.Email))
+
+		assertNoError(t, cache.Unban(ctx, user.Email, "admin@mail.com"))
+		assertNoError(t, cache.IsBanned(ctx, user.Email))
+
+		_, err := cache.Get(ctx, user.Email)
+		assertNoError(t, err)
+		assertNoError(t, cache.Rename(ctx, user.Email, "new@mail.com", 1, RevokedToken{}))
+
+		_, err = cache.Get(ctx, user.Email)
+		assertError(t, "there is no such user to get", err)
+	})
+
+	t.Run("invalidating renamed users on events", func(t *testing.T) {
+		storage := NewInMemoryUserStorage()
+		cache := NewCachedUserRepository(storage, 10, time.Minute)
+		assertNoError(t, storage.Add(ctx, user.Email, user))
+
+		_, err := cache.Get(ctx, user.Email)
+		assertNoError(t, err)
+		assertNoError(t, storage.Rename(ctx, user.Email, "new@mail.com", 1, RevokedToken{}))
+
+		cache.Invalidate([]byte("updated email: " + user.Email + " -> new@mail.com"))
+		_, err = cache.Get(ctx, user.Email)
+		assertError(t, "there is no such user to get", err)
+	})
+
+	t.Run("invalidating while filling", func(t *testing.T) {
+		storage := NewInMemoryUserStorage()
+		racing := &racingRepository{UserRepository: storage}
+		cache := NewCachedUserRepository(racing, 10, time.Minute)
+		assertNoError(t, storage.Add(ctx, user.Email, user))
+
+		racing.meanwhile = func() {
+			racing.meanwhile = func() {}
+
+			u, err := storage.Get(ctx, user.Email)
+			assertNoError(t, err)
+			u.FavoriteCake = "othercake"
+			assertNoError(t, storage.Update(ctx, user.Email, u))
+			assertNoError(t, storage.Ban(ctx, user.Email, "admin@mail.com", "some reason"))
+			cache.Invalidate([]byte("banned: " + user.Email))
+		}
+
+		u, err := cache.Get(ctx, user.Email)
+		assertNoError(t, err)
+		if u.FavoriteCake != "somecake" {
+			t.Errorf("Expected the user read before the update, got %v", u)
+		}
+
+		u, err = cache.Get(ctx, user.Email)
+		assertNoError(t, err)
+		if u.FavoriteCake != "othercake" {
+			t.Errorf("Expected the stale user not to be cached, got %v", u)
+		}
+
+		assertNoError(t, storage.Unban(ctx, user.Email, "admin@mail.com"))
+		racing.meanwhile = func() {
+			racing.meanwhile = func() {}
+
+			assertNoError(t, storage.Ban(ctx, user.Email, "admin@mail.com", "other reason"))
+			cache.Invalidate([]byte("banned: " + user.Email))
+		}
+
+		assertNoError(t, cache.IsBanned(ctx, user.Email))
+		assertError(t, "user is banned with reason \"other reason\" by \"admin@mail.com\"", cache.IsBanned(ctx, user.Email))
+	})
+
+	t.Run("caching only revoked tokens", func(t *testing.T) {
+		storage := NewInMemoryUserStorage()
+		cache := NewCachedUserRepository(storage, 10, time.Minute)
+
+		assertNoError(t, cache.CheckNotInDB(ctx, "token"))
+		assertNoError(t, storage.AddToken(ctx, RevokedToken{ID: "token", ExpiresAt: time.Now().Add(time.Hour)}))
+		assertError(t, "token is banned", cache.CheckNotInDB(ctx, "token"))
+
+		_, err := storage.PurgeExpiredTokens(ctx, time.Now().Add(2*time.Hour))
+		assertNoError(t, err)
+		assertError(t, "token is banned", cache.CheckNotInDB(ctx, "token"))
+	})
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"time"
+)
+
+const (
+	defaultDeletionCooldown = 30 * 24 * time.Hour
+	// maxReauthAge is how recent the login of a user without a password
+	// has to be to delete the account.
+	maxReauthAge = 5 * time.Minute
+)
+
+type DeleteAccountParams struct {
+	Password string `json:"password"`
+}
+
+func deletionCooldown() time.Duration {
+	cooldown, err := time.ParseDuration(os.Getenv("CAKE_DELETION_COOLDOWN"))
+	if err != nil || cooldown < 0 {
+		return defaultDeletionCooldown
+	}
+	return cooldown
+}
+
+func (us *UserService) DeleteAccount(w http.ResponseWriter, r *http.Request, u User) {
+	if !ifMatch(r, u) {
+		handlePreconditionFailed(w)
+		return
+	}
+
+	params := &DeleteAccountParams{}
+	if err := json.NewDecoder(r.Body).Decode(params); err != nil {
+		handleError(errors.New("could not read params"), w)
+		return
+	}
+
+	// accounts created through an identity provider have no password, a
+	// login with the provider just now proves the same
+	if len(u.PasswordDigest) == 0 {
+		if !recentLogin(r, time.Now()) {
+			handleError(errors.New("log in again to delete the account"), w)
+			return
+		}
+	} else if ok, _ := verifyPassword(params.Password, u.PasswordDigest); !ok {
+		handleError(errors.New("invalid password"), w)
+		return
+	}
+
+	until := time.Now().Add(deletionCooldown())
+	if err := us.repository.Tombstone(r.Context(), u.Email, until, currentToken(r)); err != nil {
+		handleError(err, w)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("account deleted"))
+	us.notifier <- []byte("deleted: " + u.Email)
+}
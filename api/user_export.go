@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+type ExportedUser struct {
+	Email        string            `json:"email"`
+	Role         string            `json:"role"`
+	FavoriteCake string            `json:"favorite_cake"`
+	TwoFactor    ExportedTwoFactor `json:"two_factor"`
+}
+
+// ExportedTwoFactor tells how far two-factor authentication is set up, the
+// secret and recovery codes stay out of the export.
+type ExportedTwoFactor struct {
+	Enabled           bool `json:"enabled"`
+	Enrolling         bool `json:"enrolling"`
+	RecoveryCodesLeft int  `json:"recovery_codes_left"`
+}
+
+type ExportedBan struct {
+	BannedAt    time.Time  `json:"banned_at"`
+	WhoBanned   string     `json:"who_banned"`
+	UnbannedAt  *time.Time `json:"unbanned_at,omitempty"`
+	WhoUnbanned string     `json:"who_unbanned,omitempty"`
+	Reason      string     `json:"reason"`
+}
+
+type ExportedSession struct {
+	ID         string    `json:"id"`
+	IssuedAt   time.Time `json:"issued_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	UserAgent  string    `json:"user_agent"`
+	RemoteAddr string    `json:"remote_addr"`
+}
+
+type ExportedIdentity struct {
+	Issuer   string    `json:"issuer"`
+	Subject  string    `json:"subject"`
+	LinkedAt time.Time `json:"linked_at"`
+}
+
+type ExportedAPIKey struct {
+	ID         string     `json:"id"`
+	Name       string     `json:"name"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+}
+
+type ExportedAuditEntry struct {
+	At      time.Time `json:"at"`
+	Action  string    `json:"action"`
+	Actor   string    `json:"actor"`
+	Subject string    `json:"subject"`
+	Reason  string    `json:"reason,omitempty"`
+}
+
+type UserExport struct {
+	ExportedAt time.Time            `json:"exported_at"`
+	User       ExportedUser         `json:"user"`
+	BanHistory []ExportedBan        `json:"ban_history"`
+	Sessions   []ExportedSession    `json:"sessions"`
+	Identities []ExportedIdentity   `json:"identities"`
+	APIKeys    []ExportedAPIKey     `json:"api_keys"`
+	Audit      []ExportedAuditEntry `json:"audit"`
+}
+
+func (us *UserService) Export(w http.ResponseWriter, r *http.Request, u User) {
+	export := UserExport{
+		ExportedAt: time.Now().UTC(),
+		User: ExportedUser{
+			Email:        u.Email,
+			Role:         u.Role,
+			FavoriteCake: u.FavoriteCake,
+			TwoFactor: ExportedTwoFactor{
+				Enabled:           u.TOTP.Enabled,
+				Enrolling:         !u.TOTP.Enabled && len(u.TOTP.Secret) != 0,
+				RecoveryCodesLeft: len(u.TOTP.RecoveryCodes),
+			},
+		},
+		BanHistory: []ExportedBan{},
+		Sessions:   []ExportedSession{},
+		Identities: []ExportedIdentity{},
+		APIKeys:    []ExportedAPIKey{},
+		Audit:      []ExportedAuditEntry{},
+	}
+
+	// a clear history is reported as an error, which means nothing to export
+	history, _ := us.repository.BanHistory(r.Context(), u.Email)
+	for _, b := range history {
+		ban := ExportedBan{
+			BannedAt:    b.BannedAt,
+			WhoBanned:   b.WhoBanned,
+			WhoUnbanned: b.WhoUnbanned,
+			Reason:      b.Reason,
+		}
+		if !b.UnbannedAt.IsZero() {
+			unbannedAt := b.UnbannedAt
+			ban.UnbannedAt = &unbannedAt
+		}
+		export.BanHistory = append(export.BanHistory, ban)
+	}
+
+	sessions, err := us.repository.Sessions(r.Context(), u.Email)
+	if err != nil {
+		handleError(err, w)
+		return
+	}
+	for _, s := range sessions {
+		export.Sessions = append(export.Sessions, ExportedSession{
+			ID:         s.ID,
+			IssuedAt:   s.IssuedAt,
+			ExpiresAt:  s.ExpiresAt,
+			UserAgent:  s.UserAgent,
+			RemoteAddr: s.RemoteAddr,
+		})
+	}
+
+	identities, err := us.repository.Identities(r.Context(), u.Email)
+	if err != nil {
+		handleError(err, w)
+		return
+	}
+	for _, id := range identities {
+		export.Identities = append(export.Identities, ExportedIdentity{
+			Issuer:   id.Issuer,
+			Subject:  id.Subject,
+			LinkedAt: id.LinkedAt,
+		})
+	}
+
+	keys, err := us.repository.APIKeys(r.Context(), u.Email)
+	if err != nil {
+		handleError(err, w)
+		return
+	}
+	for _, k := range keys {
+		// the same view ListAPIKeys gives, which never holds the hash
+		resp := apiKeyResponse(k)
+		export.APIKeys = append(export.APIKeys, ExportedAPIKey{
+			ID:         resp.ID,
+			Name:       resp.Name,
+			Scopes:     resp.Scopes,
+			CreatedAt:  resp.CreatedAt,
+			ExpiresAt:  resp.ExpiresAt,
+			LastUsedAt: resp.LastUsedAt,
+		})
+	}
+
+	trail, err := us.repository.AuditTrail(r.Context(), u.Email)
+	if err != nil {
+		handleError(err, w)
+		return
+	}
+	for _, e := range trail {
+		export.Audit = append(export.Audit, ExportedAuditEntry{
+			At:      e.At,
+			Action:  e.Action,
+			Actor:   e.Actor,
+			Subject: e.Subject,
+			Reason:  e.Reason,
+		})
+	}
+
+	body, err := json.MarshalIndent(export, "", "  ")
+	if err != nil {
+		handleError(err, w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", "attachment; filename=\"cake-service-export.json\"")
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"sort"
+	"strings"
+)
+
+const (
+	defaultListLimit = 20
+	maxListLimit     = 100
+)
+
+var sortableUserFields = map[string]func(User) string{
+	"email":         func(u User) string { return u.Email },
+	"role":          func(u User) string { return u.Role },
+	"favorite_cake": func(u User) string { return u.FavoriteCake },
+}
+
+type UserQuery struct {
+	Role          string
+	Banned        *bool
+	FavoriteCake  string
+	EmailContains string
+	SortBy        string
+	Descending    bool
+	Cursor        string
+	Limit         int
+}
+
+type UserPage struct {
+	Users      []User
+	NextCursor string
+}
+
+// listCursor points right after the last user of a page: the value of the
+// sort field and the email to break ties.
+type listCursor struct {
+	Key   string `json:"k"`
+	Email string `json:"e"`
+}
+
+func encodeCursor(c listCursor) string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeCursor(s string) (*listCursor, error) {
+	if len(s) == 0 {
+		return nil, nil
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, errors.New("cursor is not valid")
+	}
+
+	c := &listCursor{}
+	if err = json.Unmarshal(data, c); err != nil {
+		return nil, errors.New("cursor is not valid")
+	}
+	return c, nil
+}
+
+func validateUserQuery(q *UserQuery) error {
+	if len(q.SortBy) == 0 {
+		q.SortBy = "email"
+	}
+
+	if _, ok := sortableUserFields[q.SortBy]; !ok {
+		return errors.New("users can not be sorted by \"" + q.SortBy + "\"")
+	}
+
+	if q.Limit == 0 {
+		q.Limit = defaultListLimit
+	}
+
+	if q.Limit < 0 || q.Limit > maxListLimit {
+		return errors.New("limit should be between 1 and 100")
+	}
+
+	return nil
+}
+
+func (q UserQuery) matches(u User, banned bool) bool {
+	if len(q.Role) != 0 && u.Role != q.Role {
+		return false
+	}
+
+	if len(q.FavoriteCake) != 0 && u.FavoriteCake != q.FavoriteCake {
+		return false
+	}
+
+	if q.Banned != nil && *q.Banned != banned {
+		return false
+	}
+
+	return strings.Contains(strings.ToLower(u.Email), strings.ToLower(q.EmailContains))
+}
+
+func (ur *InMemoryUserStorage) List(ctx context.Context, q UserQuery) (UserPage, error) {
+	if err := ctx.Err(); err != nil {
+		return UserPage{}, err
+	}
+
+	if err := validateUserQuery(&q); err != nil {
+		return UserPage{}, err
+	}
+
+	cursor, err := decodeCursor(q.Cursor)
+	if err != nil {
+		return UserPage{}, err
+	}
+
+	ur.lock.RLock()
+	users := []User{}
+	for _, u := range ur.storage {
+		history := ur.banHistory[u.Email]
+		banned := len(history) != 0 && history[len(history)-1].UnbannedAt.IsZero()
+		if q.matches(u, banned) {
+			users = append(users, u)
+		}
+	}
+	ur.lock.RUnlock()
+
+	key := sortableUserFields[q.SortBy]
+	less := func(a listCursor, b listCursor) bool {
+		if a.Key != b.Key {
+			return a.Key < b.Key
+		}
+		return a.Email < b.Email
+	}
+	position := func(u User) listCursor {
+		return listCursor{Key: key(u), Email: u.Email}
+	}
+
+	sort.Slice(users, func(i, j int) bool {
+		if q.Descending {
+			return less(position(users[j]), position(users[i]))
+		}
+		return less(position(users[i]), position(users[j]))
+	})
+
+	page := UserPage{Users: []User{}}
+	for _, u := range users {
+		if cursor != nil {
+			if !q.Descending && !less(*cursor, position(u)) {
+				continue
+			}
+			if q.Descending && !less(position(u), *cursor) {
+				continue
+			}
+		}
+
+		if len(page.Users) == q.Limit {
+			page.NextCursor = encodeCursor(position(page.Users[len(page.Users)-1]))
+			break
+		}
+		page.Users = append(page.Users, u)
+	}
+
+	return page, nil
+}
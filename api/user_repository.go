@@ -1,54 +1,123 @@
 package main
 
 import (
-	"crypto/md5"
+	"context"
 	"errors"
 	"os"
 	"sync"
+	"time"
 )
 
+// InMemoryUserStorage keeps everything in maps guarded by lock. Every method
+// holds it for the whole operation, so checks and the writes depending on
+// them can not interleave with other calls.
 type InMemoryUserStorage struct {
 	lock       sync.RWMutex
 	storage    map[string]User
-	invTokenDB map[string]struct{}
+	invTokenDB map[string]time.Time
 	banHistory map[string][]Ban
+	tombstones map[string]time.Time
+	sessions   map[string][]Session
+	journal    *journal
+
+	refreshTokens map[string]RefreshToken
+	identities    map[string]Identity
+	apiKeys       map[string]APIKey
+	// generations outlive users: an account registered under an email
+	// starts at its generation, past the tokens of whoever had it before.
+	generations map[string]int
+	// seq is the sequence number of the last journal entry applied.
+	seq uint64
 }
 
 func NewInMemoryUserStorage() *InMemoryUserStorage {
 	ur := InMemoryUserStorage{
 		lock:       sync.RWMutex{},
 		storage:    make(map[string]User),
-		invTokenDB: make(map[string]struct{}),
+		invTokenDB: make(map[string]time.Time),
 		banHistory: make(map[string][]Ban),
+		tombstones: make(map[string]time.Time),
+		sessions:   make(map[string][]Session),
+
+		refreshTokens: make(map[string]RefreshToken),
+		identities:    make(map[string]Identity),
+		apiKeys:       make(map[string]APIKey),
+		generations:   make(map[string]int),
 	}
+	if dir := os.Getenv("CAKE_DATA_DIR"); len(dir) != 0 {
+		if err := ur.restore(dir); err != nil {
+			panic(err)
+		}
+		go ur.runSnapshots(snapshotInterval())
+	}
+
+	if err := addSuperadmin(context.Background(), &ur); err != nil {
+		panic(err)
+	}
+	return &ur
+}
+
+// addSuperadmin adds the superadmin CAKE_ADMIN_EMAIL and CAKE_ADMIN_PASSWORD
+// give, unless it is there already. Without both there is no superadmin: an
+// empty email or password would be one anybody can log in as.
+func addSuperadmin(ctx context.Context, ur UserRepository) error {
 	su_login := os.Getenv("CAKE_ADMIN_EMAIL")
 	su_password := os.Getenv("CAKE_ADMIN_PASSWORD")
-	if len(su_login) != 0 && len(su_password) != 0 {
-		panic("CAKE_ADMIN_EMAIL=" + su_login + " and CAKE_ADMIN_PASSWORD=" + su_password)
+	if len(su_login) == 0 || len(su_password) == 0 {
+		return nil
+	}
+
+	if _, err := ur.Get(ctx, su_login); err == nil {
+		return nil
+	}
+
+	hasher, err := newPasswordHasher()
+	if err != nil {
+		return err
+	}
+
+	su_digest, err := hasher.Hash(su_password)
+	if err != nil {
+		return err
 	}
 
-	_ = ur.Add(su_login, User{
+	return ur.Add(ctx, su_login, User{
 		Email:          su_login,
-		PasswordDigest: string(md5.New().Sum([]byte(su_password))),
+		PasswordDigest: su_digest,
 		Role:           "superadmin",
 		FavoriteCake:   "supercake",
 	})
-	return &ur
 }
 
-func (ur *InMemoryUserStorage) Add(login string, u User) error {
-	if _, ok := ur.storage[login]; ok {
-		return errors.New("user with given login is already present")
+func (ur *InMemoryUserStorage) Add(ctx context.Context, login string, u User) error {
+	if err := ctx.Err(); err != nil {
+		return err
 	}
 
 	ur.lock.Lock()
 	defer ur.lock.Unlock()
 
-	ur.storage[login] = u
-	return nil
+	if _, ok := ur.storage[login]; ok {
+		return errors.New("user with given login is already present")
+	}
+
+	if until, ok := ur.tombstones[login]; ok && until.After(time.Now()) {
+		return errors.New("email was recently deleted")
+	}
+
+	u.Version = 1
+	u.TokenGeneration = ur.generations[login]
+	return ur.commit(journalEntry{Op: "add", Login: login, User: u, At: time.Now()})
 }
 
-func (ur *InMemoryUserStorage) Get(login string) (User, error) {
+func (ur *InMemoryUserStorage) Get(ctx context.Context, login string) (User, error) {
+	if err := ctx.Err(); err != nil {
+		return User{}, err
+	}
+
+	ur.lock.RLock()
+	defer ur.lock.RUnlock()
+
 	u, ok := ur.storage[login]
 
 	if !ok {
@@ -58,47 +127,205 @@ func (ur *InMemoryUserStorage) Get(login string) (User, error) {
 	}
 }
 
-func (ur *InMemoryUserStorage) Update(login string, u User) error {
-	if _, ok := ur.storage[login]; !ok {
-		return errors.New("there is no such user to update")
+// Update overwrites the user only if it is still at u.Version and bumps the
+// version.
+func (ur *InMemoryUserStorage) Update(ctx context.Context, login string, u User) error {
+	if err := ctx.Err(); err != nil {
+		return err
 	}
 
 	ur.lock.Lock()
 	defer ur.lock.Unlock()
 
-	ur.storage[login] = u
-	return nil
+	stored, ok := ur.storage[login]
+	if !ok {
+		return errors.New("there is no such user to update")
+	}
+
+	if stored.Version != u.Version {
+		return errStaleVersion
+	}
+
+	// the generation only moves through RevokeAllTokens
+	u.TokenGeneration = stored.TokenGeneration
+	u.Version++
+	return ur.commit(journalEntry{Op: "update", Login: login, User: u, At: time.Now()})
 }
 
-func (ur *InMemoryUserStorage) Delete(login string) (User, error) {
-	u, ok := ur.storage[login]
+func (ur *InMemoryUserStorage) Delete(ctx context.Context, login string) (User, error) {
+	if err := ctx.Err(); err != nil {
+		return User{}, err
+	}
 
 	ur.lock.Lock()
-	delete(ur.storage, login)
-	ur.lock.Unlock()
+	defer ur.lock.Unlock()
 
+	u, ok := ur.storage[login]
 	if !ok {
 		return User{}, errors.New("there is no such user to delete")
-	} else {
-		return u, nil
 	}
+
+	if err := ur.commit(journalEntry{Op: "delete", Login: login, At: time.Now()}); err != nil {
+		return User{}, err
+	}
+	return u, nil
 }
 
-func (ur *InMemoryUserStorage) CheckNotInDB(jwtToken string) error {
-	if _, ok := ur.invTokenDB[jwtToken]; ok {
+// Rename moves the user together with its ban history, linked identities and
+// api keys to newLogin and revokes token, all under one lock, if the user is
+// still at version. The new email is left unverified.
+func (ur *InMemoryUserStorage) Rename(ctx context.Context, login string, newLogin string, version int, token RevokedToken) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	ur.lock.Lock()
+	defer ur.lock.Unlock()
+
+	stored, ok := ur.storage[login]
+	if !ok {
+		return errors.New("there is no such user to rename")
+	}
+
+	if stored.Version != version {
+		return errStaleVersion
+	}
+
+	if _, ok := ur.storage[newLogin]; ok {
+		return errors.New("user with given login is already present")
+	}
+
+	if _, ok := ur.banHistory[newLogin]; ok {
+		return errors.New("email is not available")
+	}
+
+	if until, ok := ur.tombstones[newLogin]; ok && until.After(time.Now()) {
+		return errors.New("email was recently deleted")
+	}
+
+	return ur.commit(journalEntry{
+		Op:      "rename",
+		Login:   login,
+		To:      newLogin,
+		Token:   token.ID,
+		Expires: token.ExpiresAt,
+		At:      time.Now(),
+	})
+}
+
+// Tombstone deletes the user and keeps its email from being registered
+// again until the given time. Ban history stays in place.
+func (ur *InMemoryUserStorage) Tombstone(ctx context.Context, login string, until time.Time, token RevokedToken) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	ur.lock.Lock()
+	defer ur.lock.Unlock()
+
+	if _, ok := ur.storage[login]; !ok {
+		return errors.New("there is no such user to delete")
+	}
+
+	return ur.commit(journalEntry{
+		Op:      "tombstone",
+		Login:   login,
+		Until:   until,
+		Token:   token.ID,
+		Expires: token.ExpiresAt,
+		At:      time.Now(),
+	})
+}
+
+// Tombstoned tells whether an account with the email was ever deleted, even
+// if the email can be registered again by now.
+func (ur *InMemoryUserStorage) Tombstoned(ctx context.Context, login string) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+
+	ur.lock.RLock()
+	defer ur.lock.RUnlock()
+
+	_, ok := ur.tombstones[login]
+	return ok, nil
+}
+
+func (ur *InMemoryUserStorage) CheckNotInDB(ctx context.Context, tokenID string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	ur.lock.RLock()
+	defer ur.lock.RUnlock()
+
+	if _, ok := ur.invTokenDB[tokenID]; ok {
 		return errors.New("token is banned")
 	}
 	return nil
 }
 
-func (ur *InMemoryUserStorage) AddToken(jwtToken string) error {
-	if err := ur.CheckNotInDB(jwtToken); err != nil {
+func (ur *InMemoryUserStorage) AddToken(ctx context.Context, token RevokedToken) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	ur.lock.Lock()
+	defer ur.lock.Unlock()
+
+	if _, ok := ur.invTokenDB[token.ID]; ok {
 		return errors.New("token is already banned")
 	}
 
+	return ur.commit(journalEntry{Op: "token", Token: token.ID, Expires: token.ExpiresAt, At: time.Now()})
+}
+
+// PurgeExpiredTokens forgets revoked tokens that expired before now and
+// returns how many are still on the list.
+func (ur *InMemoryUserStorage) PurgeExpiredTokens(ctx context.Context, now time.Time) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
 	ur.lock.Lock()
 	defer ur.lock.Unlock()
 
-	ur.invTokenDB[jwtToken] = struct{}{}
-	return nil
+	expired := false
+	for _, expiresAt := range ur.invTokenDB {
+		if !expiresAt.IsZero() && expiresAt.Before(now) {
+			expired = true
+			break
+		}
+	}
+
+	for _, sessions := range ur.sessions {
+		for _, s := range sessions {
+			if !s.ExpiresAt.IsZero() && s.ExpiresAt.Before(now) {
+				expired = true
+				break
+			}
+		}
+	}
+
+	for _, t := range ur.refreshTokens {
+		if t.ExpiresAt.Before(now) {
+			expired = true
+			break
+		}
+	}
+
+	for _, k := range ur.apiKeys {
+		if !k.ExpiresAt.IsZero() && k.ExpiresAt.Before(now) {
+			expired = true
+			break
+		}
+	}
+
+	if expired {
+		if err := ur.commit(journalEntry{Op: "purge", At: now}); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(ur.invTokenDB), nil
 }
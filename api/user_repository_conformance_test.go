@@ -0,0 +1,737 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func assertError(t *testing.T, expected string, err error) {
+	if err == nil {
+		t.Errorf("Expected error: %s, got nil", expected)
+	} else if err.Error() != expected {
+		t.Errorf("Unexpected error. Expected: %s, actual: %s", expected, err.Error())
+	}
+}
+
+func assertNoError(t *testing.T, err error) {
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+// testUserRepository is the behaviour every UserRepository has to share.
+// newRepository is called once per subtest and must return an empty store.
+func testUserRepository(t *testing.T, newRepository func(t *testing.T) UserRepository) {
+	ctx := context.Background()
+	user := User{
+		Email:          "test@mail.com",
+		PasswordDigest: "digest",
+		Role:           "user",
+		FavoriteCake:   "somecake",
+	}
+
+	t.Run("users", func(t *testing.T) {
+		ur := newRepository(t)
+
+		assertNoError(t, ur.Add(ctx, user.Email, user))
+		assertError(t, "user with given login is already present", ur.Add(ctx, user.Email, user))
+
+		u, err := ur.Get(ctx, user.Email)
+		assertNoError(t, err)
+		expected := user
+		expected.Version = 1
+		if !reflect.DeepEqual(u, expected) {
+			t.Errorf("Unexpected user. Expected: %v, actual: %v", expected, u)
+		}
+
+		u.FavoriteCake = "othercake"
+		assertNoError(t, ur.Update(ctx, u.Email, u))
+		assertError(t, "user was modified by another request", ur.Update(ctx, u.Email, u))
+		assertError(t, "there is no such user to update", ur.Update(ctx, "other@mail.com", u))
+
+		u, err = ur.Get(ctx, user.Email)
+		assertNoError(t, err)
+		if u.Version != 2 {
+			t.Errorf("Unexpected version. Expected: 2, actual: %d", u.Version)
+		}
+
+		u.TOTP = TOTP{Secret: "SECRET", Enabled: true, LastStep: 42, RecoveryCodes: []string{"a", "b"}}
+		assertNoError(t, ur.Update(ctx, u.Email, u))
+
+		u, err = ur.Get(ctx, user.Email)
+		assertNoError(t, err)
+		if !reflect.DeepEqual(u.TOTP, TOTP{Secret: "SECRET", Enabled: true, LastStep: 42, RecoveryCodes: []string{"a", "b"}}) {
+			t.Errorf("Unexpected two-factor state: %v", u.TOTP)
+		}
+
+		deleted, err := ur.Delete(ctx, user.Email)
+		assertNoError(t, err)
+		if deleted.FavoriteCake != "othercake" {
+			t.Errorf("Unexpected favorite cake. Expected: othercake, actual: %s", deleted.FavoriteCake)
+		}
+
+		_, err = ur.Get(ctx, user.Email)
+		assertError(t, "there is no such user to get", err)
+
+		_, err = ur.Delete(ctx, user.Email)
+		assertError(t, "there is no such user to delete", err)
+	})
+
+	t.Run("renaming", func(t *testing.T) {
+		ur := newRepository(t)
+
+		assertNoError(t, ur.Add(ctx, user.Email, user))
+		assertNoError(t, ur.Add(ctx, "taken@mail.com", user))
+		assertNoError(t, ur.Ban(ctx, user.Email, "admin@mail.com", "some reason"))
+
+		token := RevokedToken{ID: "token", ExpiresAt: time.Now().Add(time.Hour)}
+		assertError(t, "user with given login is already present", ur.Rename(ctx, user.Email, "taken@mail.com", 1, token))
+		assertError(t, "there is no such user to rename", ur.Rename(ctx, "nobody@mail.com", "new@mail.com", 1, token))
+		if err := ur.Rename(ctx, user.Email, "new@mail.com", 2, token); !errors.Is(err, errStaleVersion) {
+			t.Errorf("Unexpected error. Expected: %v, actual: %v", errStaleVersion, err)
+		}
+		assertNoError(t, ur.CheckNotInDB(ctx, "token"))
+
+		assertNoError(t, ur.Rename(ctx, user.Email, "new@mail.com", 1, token))
+		assertError(t, "token is banned", ur.CheckNotInDB(ctx, "token"))
+		assertNoError(t, ur.IsBanned(ctx, user.Email))
+		assertError(t, "user is banned with reason \"some reason\" by \"admin@mail.com\"", ur.IsBanned(ctx, "new@mail.com"))
+
+		u, err := ur.Get(ctx, "new@mail.com")
+		assertNoError(t, err)
+		if u.Email != "new@mail.com" || u.FavoriteCake != user.FavoriteCake || !u.Unverified {
+			t.Errorf("Unexpected user: %v", u)
+		}
+
+		_, err = ur.Get(ctx, user.Email)
+		assertError(t, "there is no such user to get", err)
+
+		assertNoError(t, ur.Add(ctx, user.Email, user))
+		u, err = ur.Get(ctx, user.Email)
+		assertNoError(t, err)
+		if u.TokenGeneration != 1 {
+			t.Errorf("Unexpected token generation of the re-registered user: %d", u.TokenGeneration)
+		}
+
+		assertNoError(t, ur.Ban(ctx, "ghost@mail.com", "admin@mail.com", "some reason"))
+		assertError(t, "email is not available", ur.Rename(ctx, "taken@mail.com", "ghost@mail.com", 1, RevokedToken{}))
+	})
+
+	t.Run("listing", func(t *testing.T) {
+		ur := newRepository(t)
+
+		for _, u := range []User{
+			{Email: "c@mail.com", Role: "user", FavoriteCake: "cheesecake"},
+			{Email: "a@mail.com", Role: "admin", FavoriteCake: "brownie"},
+			{Email: "b_1@other.com", Role: "user", FavoriteCake: "cheesecake"},
+			{Email: "d@mail.com", Role: "user", FavoriteCake: "brownie"},
+		} {
+			assertNoError(t, ur.Add(ctx, u.Email, u))
+		}
+		assertNoError(t, ur.Ban(ctx, "d@mail.com", "a@mail.com", "some reason"))
+
+		emails := func(page UserPage) string {
+			result := []string{}
+			for _, u := range page.Users {
+				result = append(result, u.Email)
+			}
+			return strings.Join(result, ",")
+		}
+
+		banned := true
+		for _, c := range []struct {
+			query    UserQuery
+			expected string
+		}{
+			{UserQuery{Role: "user"}, "b_1@other.com,c@mail.com,d@mail.com"},
+			{UserQuery{FavoriteCake: "brownie", Descending: true}, "d@mail.com,a@mail.com"},
+			{UserQuery{Banned: &banned}, "d@mail.com"},
+			{UserQuery{EmailContains: "_1@"}, "b_1@other.com"},
+			{UserQuery{EmailContains: "MAIL", SortBy: "favorite_cake"}, "a@mail.com,d@mail.com,c@mail.com"},
+		} {
+			page, err := ur.List(ctx, c.query)
+			assertNoError(t, err)
+			if emails(page) != c.expected {
+				t.Errorf("Unexpected users for %+v. Expected: %s, actual: %s", c.query, c.expected, emails(page))
+			}
+		}
+
+		query := UserQuery{Role: "user", SortBy: "favorite_cake", Descending: true, Limit: 2}
+		page, err := ur.List(ctx, query)
+		assertNoError(t, err)
+		if emails(page) != "c@mail.com,b_1@other.com" || len(page.NextCursor) == 0 {
+			t.Errorf("Unexpected first page: %s, %q", emails(page), page.NextCursor)
+		}
+
+		query.Cursor = page.NextCursor
+		page, err = ur.List(ctx, query)
+		assertNoError(t, err)
+		if emails(page) != "d@mail.com" || len(page.NextCursor) != 0 {
+			t.Errorf("Unexpected second page: %s, %q", emails(page), page.NextCursor)
+		}
+
+		_, err = ur.List(ctx, UserQuery{SortBy: "password_digest"})
+		assertError(t, "users can not be sorted by \"password_digest\"", err)
+	})
+
+	t.Run("tombstones", func(t *testing.T) {
+		ur := newRepository(t)
+
+		assertNoError(t, ur.Add(ctx, user.Email, user))
+		assertNoError(t, ur.Add(ctx, "other@mail.com", user))
+		assertNoError(t, ur.Ban(ctx, user.Email, "admin@mail.com", "some reason"))
+
+		token := RevokedToken{ID: "token", ExpiresAt: time.Now().Add(time.Hour)}
+		assertNoError(t, ur.Tombstone(ctx, user.Email, time.Now().Add(time.Hour), token))
+		assertError(t, "there is no such user to delete", ur.Tombstone(ctx, user.Email, time.Now().Add(time.Hour), token))
+		assertError(t, "token is banned", ur.CheckNotInDB(ctx, token.ID))
+
+		_, err := ur.Get(ctx, user.Email)
+		assertError(t, "there is no such user to get", err)
+		assertError(t, "email was recently deleted", ur.Add(ctx, user.Email, user))
+
+		_, err = ur.BanHistory(ctx, user.Email)
+		assertNoError(t, err)
+
+		deleted, err := ur.Tombstoned(ctx, user.Email)
+		if err != nil || !deleted {
+			t.Errorf("Expected %s to be tombstoned: %v", user.Email, err)
+		}
+
+		assertNoError(t, ur.Tombstone(ctx, "other@mail.com", time.Now().Add(-time.Second), RevokedToken{}))
+		assertNoError(t, ur.Add(ctx, "other@mail.com", user))
+
+		u, err := ur.Get(ctx, "other@mail.com")
+		assertNoError(t, err)
+		if u.TokenGeneration != 1 {
+			t.Errorf("Unexpected token generation of the re-registered user: %d", u.TokenGeneration)
+		}
+
+		deleted, err = ur.Tombstoned(ctx, "nobody@mail.com")
+		if err != nil || deleted {
+			t.Errorf("Unexpected tombstone of nobody@mail.com: %v", err)
+		}
+	})
+
+	t.Run("sessions", func(t *testing.T) {
+		ur := newRepository(t)
+
+		now := time.Now()
+		assertError(t, "there is no such user to log in", ur.AddSession(ctx, Session{ID: "first", Email: user.Email}))
+
+		assertNoError(t, ur.Add(ctx, user.Email, user))
+		assertNoError(t, ur.AddSession(ctx, Session{ID: "first", Email: user.Email, IssuedAt: now, ExpiresAt: now.Add(time.Hour)}))
+		assertNoError(t, ur.AddSession(ctx, Session{ID: "second", Email: user.Email, IssuedAt: now, ExpiresAt: now.Add(time.Hour)}))
+		assertNoError(t, ur.AddSession(ctx, Session{ID: "expired", Email: user.Email, IssuedAt: now, ExpiresAt: now.Add(-time.Hour)}))
+		assertNoError(t, ur.AddToken(ctx, RevokedToken{ID: "second", ExpiresAt: now.Add(time.Hour)}))
+
+		sessions, err := ur.Sessions(ctx, user.Email)
+		assertNoError(t, err)
+		if len(sessions) != 1 || sessions[0].ID != "first" {
+			t.Errorf("Unexpected sessions: %v", sessions)
+		}
+
+		assertNoError(t, ur.Rename(ctx, user.Email, "new@mail.com", 1, RevokedToken{}))
+		sessions, err = ur.Sessions(ctx, "new@mail.com")
+		assertNoError(t, err)
+		if len(sessions) != 0 {
+			t.Errorf("Unexpected sessions after renaming: %v", sessions)
+		}
+	})
+
+	t.Run("identities", func(t *testing.T) {
+		ur := newRepository(t)
+
+		id := Identity{Issuer: "https://idp.test", Subject: "42", Email: user.Email, LinkedAt: time.Now().Truncate(time.Second)}
+		assertError(t, "there is no such user to link", ur.LinkIdentity(ctx, id))
+
+		assertNoError(t, ur.Add(ctx, user.Email, user))
+		assertNoError(t, ur.LinkIdentity(ctx, id))
+		assertError(t, "identity is already linked", ur.LinkIdentity(ctx, id))
+
+		_, err := ur.GetIdentity(ctx, id.Issuer, "43")
+		assertError(t, "there is no such identity", err)
+
+		assertNoError(t, ur.Rename(ctx, user.Email, "new@mail.com", 1, RevokedToken{}))
+		linked, err := ur.GetIdentity(ctx, id.Issuer, id.Subject)
+		assertNoError(t, err)
+		if linked.Email != "new@mail.com" || !linked.LinkedAt.Equal(id.LinkedAt) {
+			t.Errorf("Unexpected identity after renaming: %v", linked)
+		}
+
+		identities, err := ur.Identities(ctx, "new@mail.com")
+		assertNoError(t, err)
+		if len(identities) != 1 || identities[0].Subject != id.Subject {
+			t.Errorf("Unexpected identities: %v", identities)
+		}
+
+		assertNoError(t, ur.Tombstone(ctx, "new@mail.com", time.Now().Add(time.Hour), RevokedToken{}))
+		_, err = ur.GetIdentity(ctx, id.Issuer, id.Subject)
+		assertError(t, "there is no such identity", err)
+	})
+
+	t.Run("taking over", func(t *testing.T) {
+		ur := newRepository(t)
+
+		linkedAt := time.Now().Truncate(time.Second)
+		assertNoError(t, ur.Add(ctx, user.Email, user))
+		assertNoError(t, ur.Add(ctx, "other@mail.com", user))
+		for _, id := range []Identity{
+			{Issuer: "https://idp.test", Subject: "42", Email: user.Email, LinkedAt: linkedAt},
+			{Issuer: "https://idp.test", Subject: "43", Email: user.Email, LinkedAt: linkedAt},
+			{Issuer: "https://idp.test", Subject: "99", Email: "other@mail.com", LinkedAt: linkedAt},
+		} {
+			assertNoError(t, ur.LinkIdentity(ctx, id))
+		}
+
+		u, err := ur.Get(ctx, user.Email)
+		assertNoError(t, err)
+		u.PasswordDigest = ""
+		u.Unverified = false
+
+		id := Identity{Issuer: "https://idp.test", Subject: "44", LinkedAt: linkedAt}
+		assertError(t, "there is no such user to update", ur.TakeOver(ctx, "nobody@mail.com", u, id))
+		assertError(t, "identity is already linked", ur.TakeOver(ctx, user.Email, u, Identity{Issuer: id.Issuer, Subject: "99"}))
+
+		stale := u
+		stale.Version++
+		if err = ur.TakeOver(ctx, user.Email, stale, id); !errors.Is(err, errStaleVersion) {
+			t.Errorf("Unexpected error. Expected: %v, actual: %v", errStaleVersion, err)
+		}
+
+		identities, err := ur.Identities(ctx, user.Email)
+		assertNoError(t, err)
+		if len(identities) != 2 {
+			t.Errorf("Expected identities to stay when taking over fails: %v", identities)
+		}
+
+		assertNoError(t, ur.TakeOver(ctx, user.Email, u, id))
+		identities, err = ur.Identities(ctx, user.Email)
+		assertNoError(t, err)
+		if len(identities) != 1 || identities[0].Subject != "44" || identities[0].Email != user.Email {
+			t.Errorf("Unexpected identities after taking over: %v", identities)
+		}
+
+		taken, err := ur.Get(ctx, user.Email)
+		assertNoError(t, err)
+		if len(taken.PasswordDigest) != 0 || taken.Version != u.Version+1 {
+			t.Errorf("Unexpected user after taking over: %v", taken)
+		}
+
+		if _, err = ur.GetIdentity(ctx, id.Issuer, "99"); err != nil {
+			t.Errorf("Expected identities of other users to stay, got %v", err)
+		}
+	})
+
+	t.Run("api keys", func(t *testing.T) {
+		ur := newRepository(t)
+
+		now := time.Now().Truncate(time.Second)
+		key := APIKey{
+			ID:        "key",
+			Email:     user.Email,
+			Name:      "deploy",
+			Scopes:    []string{"profile:read", "admin:ban"},
+			Hash:      "hash",
+			CreatedAt: now,
+			ExpiresAt: now.Add(time.Hour),
+		}
+		assertError(t, "there is no such user to add a key to", ur.AddAPIKey(ctx, key))
+
+		assertNoError(t, ur.Add(ctx, user.Email, user))
+		assertNoError(t, ur.AddAPIKey(ctx, key))
+		assertError(t, "api key is already present", ur.AddAPIKey(ctx, key))
+
+		expired := key
+		expired.ID, expired.ExpiresAt = "expired", now.Add(-time.Hour)
+		assertNoError(t, ur.AddAPIKey(ctx, expired))
+
+		forever := key
+		forever.ID, forever.ExpiresAt, forever.CreatedAt = "forever", time.Time{}, now.Add(time.Second)
+		assertNoError(t, ur.AddAPIKey(ctx, forever))
+
+		stored, err := ur.GetAPIKey(ctx, "key")
+		assertNoError(t, err)
+		if !stored.CreatedAt.Equal(key.CreatedAt) || !stored.ExpiresAt.Equal(key.ExpiresAt) {
+			t.Errorf("Unexpected key times: %v", stored)
+		}
+		stored.CreatedAt, stored.ExpiresAt = key.CreatedAt, key.ExpiresAt
+		if !reflect.DeepEqual(stored, key) {
+			t.Errorf("Unexpected key. Expected: %v, actual: %v", key, stored)
+		}
+
+		keys, err := ur.APIKeys(ctx, user.Email)
+		assertNoError(t, err)
+		if len(keys) != 2 || keys[0].ID != "key" || keys[1].ID != "forever" || !keys[1].ExpiresAt.IsZero() {
+			t.Errorf("Unexpected keys: %v", keys)
+		}
+
+		_, err = ur.PurgeExpiredTokens(ctx, now)
+		assertNoError(t, err)
+		_, err = ur.GetAPIKey(ctx, "expired")
+		assertError(t, "there is no such api key", err)
+
+		assertError(t, "there is no such api key", ur.UseAPIKey(ctx, "nokey", now))
+		assertNoError(t, ur.UseAPIKey(ctx, "forever", now.Add(time.Minute)))
+		stored, err = ur.GetAPIKey(ctx, "forever")
+		assertNoError(t, err)
+		if !stored.LastUsedAt.Equal(now.Add(time.Minute)) {
+			t.Errorf("Unexpected last use: %v", stored.LastUsedAt)
+		}
+
+		assertError(t, "there is no such api key", ur.RevokeAPIKey(ctx, "other@mail.com", "key"))
+		assertNoError(t, ur.RevokeAPIKey(ctx, user.Email, "key"))
+		assertError(t, "there is no such api key", ur.RevokeAPIKey(ctx, user.Email, "key"))
+
+		assertNoError(t, ur.Rename(ctx, user.Email, "new@mail.com", 1, RevokedToken{}))
+		stored, err = ur.GetAPIKey(ctx, "forever")
+		assertNoError(t, err)
+		if stored.Email != "new@mail.com" {
+			t.Errorf("Expected the key to move along, got %s", stored.Email)
+		}
+
+		assertNoError(t, ur.Tombstone(ctx, "new@mail.com", time.Now().Add(time.Hour), RevokedToken{}))
+		_, err = ur.GetAPIKey(ctx, "forever")
+		assertError(t, "there is no such api key", err)
+	})
+
+	t.Run("audit trail", func(t *testing.T) {
+		ur := newRepository(t)
+
+		assertNoError(t, ur.Ban(ctx, user.Email, "admin@mail.com", "some reason"))
+		assertNoError(t, ur.Unban(ctx, user.Email, "admin@mail.com"))
+		assertNoError(t, ur.Ban(ctx, "other@mail.com", user.Email, "other reason"))
+		assertNoError(t, ur.Ban(ctx, "third@mail.com", "admin@mail.com", "other reason"))
+
+		trail, err := ur.AuditTrail(ctx, user.Email)
+		assertNoError(t, err)
+
+		actions := []string{}
+		for _, e := range trail {
+			actions = append(actions, e.Action+" "+e.Subject+" by "+e.Actor)
+		}
+		expected := "ban test@mail.com by admin@mail.com, unban test@mail.com by admin@mail.com, " +
+			"ban other@mail.com by test@mail.com"
+		if strings.Join(actions, ", ") != expected {
+			t.Errorf("Unexpected audit trail: %v", actions)
+		}
+	})
+
+	t.Run("tokens", func(t *testing.T) {
+		ur := newRepository(t)
+
+		now := time.Now()
+		expired := RevokedToken{ID: "expired", ExpiresAt: now.Add(-time.Minute)}
+		active := RevokedToken{ID: "active", ExpiresAt: now.Add(time.Minute)}
+		eternal := RevokedToken{ID: "eternal"}
+
+		assertNoError(t, ur.CheckNotInDB(ctx, active.ID))
+		assertNoError(t, ur.AddToken(ctx, active))
+		assertError(t, "token is banned", ur.CheckNotInDB(ctx, active.ID))
+		assertError(t, "token is already banned", ur.AddToken(ctx, active))
+
+		assertNoError(t, ur.AddToken(ctx, expired))
+		assertNoError(t, ur.AddToken(ctx, eternal))
+
+		remaining, err := ur.PurgeExpiredTokens(ctx, now)
+		assertNoError(t, err)
+		if remaining != 2 {
+			t.Errorf("Unexpected number of revoked tokens. Expected: 2, actual: %d", remaining)
+		}
+
+		assertNoError(t, ur.CheckNotInDB(ctx, expired.ID))
+		assertError(t, "token is banned", ur.CheckNotInDB(ctx, active.ID))
+		assertError(t, "token is banned", ur.CheckNotInDB(ctx, eternal.ID))
+	})
+
+	t.Run("refresh tokens", func(t *testing.T) {
+		ur := newRepository(t)
+
+		now := time.Now()
+		first := RefreshToken{
+			ID:          "first",
+			Family:      "family",
+			Email:       user.Email,
+			ExpiresAt:   now.Add(time.Hour),
+			AccessToken: RevokedToken{ID: "access1", ExpiresAt: now.Add(time.Minute)},
+		}
+		assertError(t, "there is no such user to log in", ur.AddRefreshToken(ctx, first))
+
+		assertNoError(t, ur.Add(ctx, user.Email, user))
+		assertNoError(t, ur.AddRefreshToken(ctx, first))
+
+		_, err := ur.GetRefreshToken(ctx, "unknown")
+		assertError(t, "refresh token is not valid", err)
+		assertError(t, "refresh token is not valid", ur.RotateRefreshToken(ctx, "unknown", RefreshToken{ID: "next"}))
+
+		second := RefreshToken{
+			ID:          "second",
+			ExpiresAt:   now.Add(time.Hour),
+			AccessToken: RevokedToken{ID: "access2", ExpiresAt: now.Add(time.Minute)},
+		}
+		assertNoError(t, ur.RotateRefreshToken(ctx, first.ID, second))
+
+		rotated, err := ur.GetRefreshToken(ctx, second.ID)
+		assertNoError(t, err)
+		if rotated.Family != "family" || rotated.Email != user.Email || rotated.AccessToken.ID != "access2" {
+			t.Errorf("Unexpected rotated token: %v", rotated)
+		}
+
+		used, err := ur.GetRefreshToken(ctx, first.ID)
+		assertNoError(t, err)
+		if used.UsedAt.IsZero() {
+			t.Errorf("Expected first token to be used: %v", used)
+		}
+
+		assertError(t, "refresh token was already used", ur.RotateRefreshToken(ctx, first.ID, RefreshToken{ID: "third"}))
+		assertError(t, "refresh token is not valid", ur.RotateRefreshToken(ctx, second.ID, RefreshToken{ID: "third"}))
+		assertError(t, "token is banned", ur.CheckNotInDB(ctx, "access1"))
+		assertError(t, "token is banned", ur.CheckNotInDB(ctx, "access2"))
+
+		expired := RefreshToken{ID: "expired", Family: "other", Email: user.Email, ExpiresAt: now.Add(-time.Minute)}
+		assertNoError(t, ur.AddRefreshToken(ctx, expired))
+		assertError(t, "refresh token has expired", ur.RotateRefreshToken(ctx, expired.ID, RefreshToken{ID: "third"}))
+
+		_, err = ur.PurgeExpiredTokens(ctx, now)
+		assertNoError(t, err)
+		_, err = ur.GetRefreshToken(ctx, expired.ID)
+		assertError(t, "refresh token is not valid", err)
+
+		assertNoError(t, ur.Rename(ctx, user.Email, "new@mail.com", 1, RevokedToken{}))
+		_, err = ur.GetRefreshToken(ctx, second.ID)
+		assertError(t, "refresh token is not valid", err)
+	})
+
+	t.Run("logging out", func(t *testing.T) {
+		ur := newRepository(t)
+
+		now := time.Now()
+		assertNoError(t, ur.Add(ctx, user.Email, user))
+		for _, id := range []string{"first", "second"} {
+			assertNoError(t, ur.AddRefreshToken(ctx, RefreshToken{
+				ID:          id,
+				Family:      id,
+				Email:       user.Email,
+				ExpiresAt:   now.Add(time.Hour),
+				AccessToken: RevokedToken{ID: id + "-access", ExpiresAt: now.Add(time.Minute)},
+			}))
+			assertNoError(t, ur.AddSession(ctx, Session{ID: id + "-access", Email: user.Email, IssuedAt: now}))
+		}
+
+		assertNoError(t, ur.RevokeSession(ctx, RevokedToken{ID: "first-access", ExpiresAt: now.Add(time.Minute)}))
+		assertError(t, "token is banned", ur.CheckNotInDB(ctx, "first-access"))
+		assertNoError(t, ur.CheckNotInDB(ctx, "second-access"))
+		assertError(t, "refresh token is not valid", ur.RotateRefreshToken(ctx, "first", RefreshToken{ID: "third"}))
+
+		sessions, err := ur.Sessions(ctx, user.Email)
+		assertNoError(t, err)
+		if len(sessions) != 1 || sessions[0].ID != "second-access" {
+			t.Errorf("Unexpected sessions: %v", sessions)
+		}
+
+		u, err := ur.Get(ctx, user.Email)
+		assertNoError(t, err)
+
+		assertNoError(t, ur.AddAPIKey(ctx, APIKey{ID: "key", Email: user.Email, Scopes: []string{"profile:read"}, CreatedAt: now}))
+		assertNoError(t, ur.RevokeAllTokens(ctx, user.Email))
+		assertError(t, "there is no such user to log out", ur.RevokeAllTokens(ctx, "other@mail.com"))
+
+		// a stale copy of the user must not roll the generation back
+		assertNoError(t, ur.Update(ctx, user.Email, u))
+
+		u, err = ur.Get(ctx, user.Email)
+		assertNoError(t, err)
+		if u.TokenGeneration != 1 {
+			t.Errorf("Unexpected token generation. Expected: 1, actual: %d", u.TokenGeneration)
+		}
+
+		_, err = ur.GetRefreshToken(ctx, "second")
+		assertError(t, "refresh token is not valid", err)
+
+		sessions, err = ur.Sessions(ctx, user.Email)
+		assertNoError(t, err)
+		if len(sessions) != 0 {
+			t.Errorf("Unexpected sessions: %v", sessions)
+		}
+
+		_, err = ur.GetAPIKey(ctx, "key")
+		assertError(t, "there is no such api key", err)
+	})
+
+	t.Run("bans", func(t *testing.T) {
+		ur := newRepository(t)
+
+		_, err := ur.BanHistory(ctx, user.Email)
+		assertError(t, "user history is clear", err)
+		assertError(t, "user history is clear", ur.Unban(ctx, user.Email, "admin@mail.com"))
+
+		assertNoError(t, ur.Ban(ctx, user.Email, "admin@mail.com", "some reason"))
+		assertError(t, "user is already banned", ur.Ban(ctx, user.Email, "admin@mail.com", "other reason"))
+		assertError(t, "user is banned with reason \"some reason\" by \"admin@mail.com\"", ur.IsBanned(ctx, user.Email))
+
+		assertNoError(t, ur.Unban(ctx, user.Email, "root@mail.com"))
+		assertError(t, "user is not banned", ur.Unban(ctx, user.Email, "root@mail.com"))
+		assertNoError(t, ur.IsBanned(ctx, user.Email))
+
+		assertNoError(t, ur.Ban(ctx, user.Email, "admin@mail.com", "other reason"))
+
+		history, err := ur.BanHistory(ctx, user.Email)
+		assertNoError(t, err)
+		if len(history) != 2 {
+			t.Fatalf("Unexpected history length. Expected: 2, actual: %d", len(history))
+		}
+
+		if history[0].WhoUnbanned != "root@mail.com" || history[0].UnbannedAt.IsZero() {
+			t.Errorf("Unexpected first ban: %v", history[0])
+		}
+
+		if history[1].Reason != "other reason" || !history[1].UnbannedAt.IsZero() {
+			t.Errorf("Unexpected second ban: %v", history[1])
+		}
+	})
+
+	t.Run("cancelled context", func(t *testing.T) {
+		ur := newRepository(t)
+
+		cancelled, cancel := context.WithCancel(ctx)
+		cancel()
+
+		if err := ur.Add(cancelled, user.Email, user); !errors.Is(err, context.Canceled) {
+			t.Errorf("Unexpected error. Expected: %v, actual: %v", context.Canceled, err)
+		}
+
+		_, err := ur.Get(ctx, user.Email)
+		assertError(t, "there is no such user to get", err)
+	})
+}
+
+// testConcurrentUserRepository races writers against each other and against
+// readers. Run it with -race.
+func testConcurrentUserRepository(t *testing.T, newRepository func(t *testing.T) UserRepository) {
+	const workers = 20
+
+	ctx := context.Background()
+	user := User{
+		Email:          "test@mail.com",
+		PasswordDigest: "digest",
+		Role:           "user",
+		FavoriteCake:   "somecake",
+	}
+
+	race := func(f func(i int) error) int {
+		var (
+			wg        sync.WaitGroup
+			lock      sync.Mutex
+			succeeded int
+		)
+
+		for i := 0; i < workers; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				if f(i) == nil {
+					lock.Lock()
+					succeeded++
+					lock.Unlock()
+				}
+			}(i)
+		}
+
+		wg.Wait()
+		return succeeded
+	}
+
+	t.Run("concurrent registration", func(t *testing.T) {
+		ur := newRepository(t)
+
+		succeeded := race(func(i int) error {
+			return ur.Add(ctx, user.Email, user)
+		})
+		if succeeded != 1 {
+			t.Errorf("Unexpected number of registrations. Expected: 1, actual: %d", succeeded)
+		}
+
+		page, err := ur.List(ctx, UserQuery{EmailContains: user.Email})
+		assertNoError(t, err)
+		if len(page.Users) != 1 {
+			t.Errorf("Unexpected users: %v", page.Users)
+		}
+	})
+
+	t.Run("concurrent bans", func(t *testing.T) {
+		ur := newRepository(t)
+		assertNoError(t, ur.Add(ctx, user.Email, user))
+
+		succeeded := race(func(i int) error {
+			if i%2 == 0 {
+				ur.IsBanned(ctx, user.Email)
+				ur.BanHistory(ctx, user.Email)
+			}
+			return ur.Ban(ctx, user.Email, "admin@mail.com", "some reason")
+		})
+		if succeeded != 1 {
+			t.Errorf("Unexpected number of bans. Expected: 1, actual: %d", succeeded)
+		}
+
+		history, err := ur.BanHistory(ctx, user.Email)
+		assertNoError(t, err)
+		if len(history) != 1 {
+			t.Errorf("Unexpected ban history: %v", history)
+		}
+
+		succeeded = race(func(i int) error {
+			return ur.Unban(ctx, user.Email, "admin@mail.com")
+		})
+		if succeeded != 1 {
+			t.Errorf("Unexpected number of unbans. Expected: 1, actual: %d", succeeded)
+		}
+	})
+
+	t.Run("concurrent updates", func(t *testing.T) {
+		ur := newRepository(t)
+		assertNoError(t, ur.Add(ctx, user.Email, user))
+
+		succeeded := race(func(i int) error {
+			for {
+				u, err := ur.Get(ctx, user.Email)
+				if err != nil {
+					return err
+				}
+
+				u.FavoriteCake = strings.Repeat("cake", i+1)
+				err = ur.Update(ctx, user.Email, u)
+				if !errors.Is(err, errStaleVersion) {
+					return err
+				}
+			}
+		})
+		if succeeded != workers {
+			t.Errorf("Unexpected number of updates. Expected: %d, actual: %d", workers, succeeded)
+		}
+
+		u, err := ur.Get(ctx, user.Email)
+		assertNoError(t, err)
+		if u.Version != workers+1 {
+			t.Errorf("Unexpected version. Expected: %d, actual: %d", workers+1, u.Version)
+		}
+	})
+
+	t.Run("concurrent token revocation", func(t *testing.T) {
+		ur := newRepository(t)
+		token := RevokedToken{ID: "token", ExpiresAt: time.Now().Add(time.Hour)}
+
+		succeeded := race(func(i int) error {
+			ur.CheckNotInDB(ctx, token.ID)
+			return ur.AddToken(ctx, token)
+		})
+		if succeeded != 1 {
+			t.Errorf("Unexpected number of revocations. Expected: 1, actual: %d", succeeded)
+		}
+		assertError(t, "token is banned", ur.CheckNotInDB(ctx, token.ID))
+	})
+}
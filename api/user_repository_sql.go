@@ -0,0 +1,1264 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	_ "github.com/lib/pq"
+)
+
+// sqlMigrations is applied in order, each step exactly once. Append new
+// steps to the end, never edit the ones that are already released.
+var sqlMigrations = []string{
+	`CREATE TABLE users (
+		email           VARCHAR(255) PRIMARY KEY,
+		password_digest VARCHAR(255) NOT NULL,
+		role            VARCHAR(32)  NOT NULL,
+		favorite_cake   VARCHAR(255) NOT NULL
+	)`,
+	`CREATE TABLE bans (
+		email        VARCHAR(255) NOT NULL,
+		seq          INTEGER      NOT NULL,
+		banned_at    TIMESTAMP    NOT NULL,
+		who_banned   VARCHAR(255) NOT NULL,
+		unbanned_at  TIMESTAMP,
+		who_unbanned VARCHAR(255) NOT NULL DEFAULT '',
+		reason       TEXT         NOT NULL,
+		PRIMARY KEY (email, seq)
+	)`,
+	`CREATE TABLE revoked_tokens (
+		token TEXT PRIMARY KEY
+	)`,
+	`DROP TABLE revoked_tokens`,
+	`CREATE TABLE revoked_tokens (
+		id         VARCHAR(64) PRIMARY KEY,
+		expires_at TIMESTAMP
+	)`,
+	`CREATE INDEX revoked_tokens_expires_at ON revoked_tokens (expires_at)`,
+	`CREATE TABLE tombstones (
+		email      VARCHAR(255) PRIMARY KEY,
+		expires_at TIMESTAMP    NOT NULL
+	)`,
+	`CREATE TABLE sessions (
+		id          VARCHAR(64)  PRIMARY KEY,
+		email       VARCHAR(255) NOT NULL,
+		issued_at   TIMESTAMP    NOT NULL,
+		expires_at  TIMESTAMP,
+		user_agent  TEXT         NOT NULL,
+		remote_addr VARCHAR(255) NOT NULL
+	)`,
+	`CREATE INDEX sessions_email ON sessions (email)`,
+	`ALTER TABLE users ADD COLUMN version INTEGER NOT NULL DEFAULT 1`,
+	`CREATE TABLE refresh_tokens (
+		id                VARCHAR(64)  PRIMARY KEY,
+		family            VARCHAR(64)  NOT NULL,
+		email             VARCHAR(255) NOT NULL,
+		expires_at        TIMESTAMP    NOT NULL,
+		access_token_id   VARCHAR(64)  NOT NULL,
+		access_expires_at TIMESTAMP,
+		used_at           TIMESTAMP,
+		revoked           BOOLEAN      NOT NULL DEFAULT FALSE
+	)`,
+	`CREATE INDEX refresh_tokens_family ON refresh_tokens (family)`,
+	`CREATE INDEX refresh_tokens_email ON refresh_tokens (email)`,
+	`ALTER TABLE users ADD COLUMN token_generation INTEGER NOT NULL DEFAULT 0`,
+	`ALTER TABLE users ADD COLUMN totp_secret VARCHAR(64) NOT NULL DEFAULT ''`,
+	`ALTER TABLE users ADD COLUMN totp_enabled BOOLEAN NOT NULL DEFAULT FALSE`,
+	`ALTER TABLE users ADD COLUMN totp_last_step BIGINT NOT NULL DEFAULT 0`,
+	`ALTER TABLE users ADD COLUMN recovery_codes TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE users ADD COLUMN unverified BOOLEAN NOT NULL DEFAULT FALSE`,
+	`CREATE TABLE identities (
+		issuer    VARCHAR(255) NOT NULL,
+		subject   VARCHAR(255) NOT NULL,
+		email     VARCHAR(255) NOT NULL,
+		linked_at TIMESTAMP    NOT NULL,
+		PRIMARY KEY (issuer, subject)
+	)`,
+	`CREATE INDEX identities_email ON identities (email)`,
+	`CREATE TABLE api_keys (
+		id         VARCHAR(32)  PRIMARY KEY,
+		email      VARCHAR(255) NOT NULL,
+		name       VARCHAR(255) NOT NULL,
+		scopes     TEXT         NOT NULL,
+		hash       VARCHAR(64)  NOT NULL,
+		created_at TIMESTAMP    NOT NULL,
+		expires_at TIMESTAMP
+	)`,
+	`CREATE INDEX api_keys_email ON api_keys (email)`,
+	`CREATE TABLE token_generations (
+		email      VARCHAR(255) PRIMARY KEY,
+		generation INTEGER      NOT NULL
+	)`,
+	`ALTER TABLE api_keys ADD COLUMN last_used_at TIMESTAMP`,
+}
+
+const userColumns = "email, password_digest, role, favorite_cake, version, token_generation, " +
+	"totp_secret, totp_enabled, totp_last_step, recovery_codes, unverified"
+
+type rowScanner interface {
+	Scan(...interface{}) error
+}
+
+func scanUser(row rowScanner) (User, error) {
+	u := User{}
+	var recoveryCodes string
+	err := row.Scan(&u.Email, &u.PasswordDigest, &u.Role, &u.FavoriteCake, &u.Version, &u.TokenGeneration,
+		&u.TOTP.Secret, &u.TOTP.Enabled, &u.TOTP.LastStep, &recoveryCodes, &u.Unverified)
+	if len(recoveryCodes) != 0 {
+		u.TOTP.RecoveryCodes = strings.Split(recoveryCodes, " ")
+	}
+	return u, err
+}
+
+const insertRevokedToken = `INSERT INTO revoked_tokens (id, expires_at) VALUES ($1, $2)
+	ON CONFLICT (id) DO NOTHING`
+
+type SQLUserStorage struct {
+	db *sql.DB
+}
+
+func NewSQLUserStorage(driver string, dsn string) (*SQLUserStorage, error) {
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx := context.Background()
+	if err = db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	ur := &SQLUserStorage{db: db}
+	if err = ur.migrate(ctx); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	if err = addSuperadmin(ctx, ur); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return ur, nil
+}
+
+func (ur *SQLUserStorage) migrate(ctx context.Context) error {
+	_, err := ur.db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER NOT NULL)`)
+	if err != nil {
+		return err
+	}
+
+	var version int
+	err = ur.db.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&version)
+	if err != nil {
+		return err
+	}
+
+	for i := version; i < len(sqlMigrations); i++ {
+		tx, err := ur.db.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+
+		if _, err = tx.ExecContext(ctx, sqlMigrations[i]); err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		if _, err = tx.ExecContext(ctx, `INSERT INTO schema_migrations (version) VALUES ($1)`, i+1); err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		if err = tx.Commit(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (ur *SQLUserStorage) Close() error {
+	return ur.db.Close()
+}
+
+func (ur *SQLUserStorage) Add(ctx context.Context, login string, u User) error {
+	tx, err := ur.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err = checkTombstone(ctx, tx, login); err != nil {
+		return err
+	}
+
+	generation, err := generationFloor(ctx, tx, login)
+	if err != nil {
+		return err
+	}
+
+	res, err := tx.ExecContext(ctx,
+		`INSERT INTO users (`+userColumns+`) VALUES ($1, $2, $3, $4, 1, $5, '', FALSE, 0, '', $6)
+		ON CONFLICT (email) DO NOTHING`,
+		login, u.PasswordDigest, u.Role, u.FavoriteCake, generation, u.Unverified,
+	)
+	if err != nil {
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return errors.New("user with given login is already present")
+	}
+
+	return tx.Commit()
+}
+
+func checkTombstone(ctx context.Context, q queryRower, login string) error {
+	var found int
+	err := q.QueryRowContext(ctx,
+		`SELECT 1 FROM tombstones WHERE email = $1 AND expires_at > $2`,
+		login, time.Now().UTC(),
+	).Scan(&found)
+
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	return errors.New("email was recently deleted")
+}
+
+type queryRower interface {
+	QueryRowContext(context.Context, string, ...interface{}) *sql.Row
+}
+
+func generationFloor(ctx context.Context, q queryRower, login string) (int, error) {
+	var generation int
+	err := q.QueryRowContext(ctx, `SELECT generation FROM token_generations WHERE email = $1`, login).Scan(&generation)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	return generation, err
+}
+
+// retireGeneration makes an account registered under login later on start
+// past the tokens issued to the one leaving it. It has to run before the
+// user row is deleted.
+func retireGeneration(ctx context.Context, e execer, login string) error {
+	_, err := e.ExecContext(ctx,
+		`INSERT INTO token_generations (email, generation)
+		SELECT email, token_generation + 1 FROM users WHERE email = $1
+		ON CONFLICT (email) DO UPDATE SET generation = excluded.generation`,
+		login,
+	)
+	return err
+}
+
+func queryUser(ctx context.Context, q queryRower, login string) (User, error) {
+	return scanUser(q.QueryRowContext(ctx, `SELECT `+userColumns+` FROM users WHERE email = $1`, login))
+}
+
+func (ur *SQLUserStorage) Get(ctx context.Context, login string) (User, error) {
+	u, err := queryUser(ctx, ur.db, login)
+	if errors.Is(err, sql.ErrNoRows) {
+		return User{}, errors.New("there is no such user to get")
+	} else if err != nil {
+		return User{}, err
+	}
+
+	return u, nil
+}
+
+func (ur *SQLUserStorage) List(ctx context.Context, q UserQuery) (UserPage, error) {
+	if err := validateUserQuery(&q); err != nil {
+		return UserPage{}, err
+	}
+
+	cursor, err := decodeCursor(q.Cursor)
+	if err != nil {
+		return UserPage{}, err
+	}
+
+	where := []string{}
+	args := []interface{}{}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return "$" + strconv.Itoa(len(args))
+	}
+
+	if len(q.Role) != 0 {
+		where = append(where, "role = "+arg(q.Role))
+	}
+
+	if len(q.FavoriteCake) != 0 {
+		where = append(where, "favorite_cake = "+arg(q.FavoriteCake))
+	}
+
+	if len(q.EmailContains) != 0 {
+		pattern := likeEscaper.Replace(strings.ToLower(q.EmailContains))
+		where = append(where, "LOWER(email) LIKE "+arg("%"+pattern+"%")+` ESCAPE '\'`)
+	}
+
+	if q.Banned != nil {
+		banned := "EXISTS (SELECT 1 FROM bans WHERE bans.email = users.email AND bans.unbanned_at IS NULL)"
+		if !*q.Banned {
+			banned = "NOT " + banned
+		}
+		where = append(where, banned)
+	}
+
+	// sortable field names double as column names
+	column, op, order := q.SortBy, ">", "ASC"
+	if q.Descending {
+		op, order = "<", "DESC"
+	}
+
+	if cursor != nil {
+		key, email := arg(cursor.Key), arg(cursor.Email)
+		where = append(where, "("+column+" "+op+" "+key+" OR ("+column+" = "+key+" AND email "+op+" "+email+"))")
+	}
+
+	query := "SELECT " + userColumns + " FROM users"
+	if len(where) != 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += " ORDER BY " + column + " " + order + ", email " + order + " LIMIT " + arg(q.Limit+1)
+
+	rows, err := ur.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return UserPage{}, err
+	}
+	defer rows.Close()
+
+	page := UserPage{Users: []User{}}
+	for rows.Next() {
+		u, err := scanUser(rows)
+		if err != nil {
+			return UserPage{}, err
+		}
+		page.Users = append(page.Users, u)
+	}
+
+	if err = rows.Err(); err != nil {
+		return UserPage{}, err
+	}
+
+	if len(page.Users) > q.Limit {
+		page.Users = page.Users[:q.Limit]
+		last := page.Users[q.Limit-1]
+		page.NextCursor = encodeCursor(listCursor{Key: sortableUserFields[q.SortBy](last), Email: last.Email})
+	}
+
+	return page, nil
+}
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// Update overwrites the user only if it is still at u.Version and bumps the
+// version.
+func (ur *SQLUserStorage) Update(ctx context.Context, login string, u User) error {
+	return updateUser(ctx, ur.db, login, u)
+}
+
+func updateUser(ctx context.Context, db queryExecer, login string, u User) error {
+	res, err := db.ExecContext(ctx,
+		`UPDATE users SET password_digest = $1, role = $2, favorite_cake = $3, version = version + 1,
+			totp_secret = $4, totp_enabled = $5, totp_last_step = $6, recovery_codes = $7, unverified = $8
+		WHERE email = $9 AND version = $10`,
+		u.PasswordDigest, u.Role, u.FavoriteCake,
+		u.TOTP.Secret, u.TOTP.Enabled, u.TOTP.LastStep, strings.Join(u.TOTP.RecoveryCodes, " "), u.Unverified,
+		login, u.Version,
+	)
+	if err != nil {
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n != 0 {
+		return nil
+	}
+
+	if _, err = queryUser(ctx, db, login); errors.Is(err, sql.ErrNoRows) {
+		return errors.New("there is no such user to update")
+	} else if err != nil {
+		return err
+	}
+
+	return errStaleVersion
+}
+
+func (ur *SQLUserStorage) Delete(ctx context.Context, login string) (User, error) {
+	tx, err := ur.db.BeginTx(ctx, nil)
+	if err != nil {
+		return User{}, err
+	}
+	defer tx.Rollback()
+
+	u, err := queryUser(ctx, tx, login)
+	if errors.Is(err, sql.ErrNoRows) {
+		return User{}, errors.New("there is no such user to delete")
+	} else if err != nil {
+		return User{}, err
+	}
+
+	if err = retireGeneration(ctx, tx, login); err != nil {
+		return User{}, err
+	}
+
+	if _, err = tx.ExecContext(ctx, `DELETE FROM users WHERE email = $1`, login); err != nil {
+		return User{}, err
+	}
+
+	if _, err = tx.ExecContext(ctx, `DELETE FROM identities WHERE email = $1`, login); err != nil {
+		return User{}, err
+	}
+
+	if _, err = tx.ExecContext(ctx, `DELETE FROM api_keys WHERE email = $1`, login); err != nil {
+		return User{}, err
+	}
+
+	return u, tx.Commit()
+}
+
+// Rename moves the user to newLogin if it is still at version, see
+// InMemoryUserStorage.Rename.
+func (ur *SQLUserStorage) Rename(ctx context.Context, login string, newLogin string, version int, token RevokedToken) error {
+	tx, err := ur.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx,
+		`INSERT INTO users (`+userColumns+`)
+		SELECT $1, password_digest, role, favorite_cake, version + 1, token_generation,
+			totp_secret, totp_enabled, totp_last_step, recovery_codes, TRUE
+		FROM users WHERE email = $2 AND version = $3
+		ON CONFLICT (email) DO NOTHING`,
+		newLogin, login, version,
+	)
+	if err != nil {
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		u, err := queryUser(ctx, tx, login)
+		if err != nil {
+			return errors.New("there is no such user to rename")
+		}
+		if u.Version != version {
+			return errStaleVersion
+		}
+		return errors.New("user with given login is already present")
+	}
+
+	var bans int
+	if err = tx.QueryRowContext(ctx, `SELECT COUNT(*) FROM bans WHERE email = $1`, newLogin).Scan(&bans); err != nil {
+		return err
+	}
+
+	if bans != 0 {
+		return errors.New("email is not available")
+	}
+
+	if err = checkTombstone(ctx, tx, newLogin); err != nil {
+		return err
+	}
+
+	if _, err = tx.ExecContext(ctx, `UPDATE bans SET email = $1 WHERE email = $2`, newLogin, login); err != nil {
+		return err
+	}
+
+	generation, err := generationFloor(ctx, tx, newLogin)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx,
+		`UPDATE users SET token_generation = $1 WHERE email = $2 AND token_generation < $1`,
+		generation, newLogin,
+	)
+	if err != nil {
+		return err
+	}
+
+	if err = retireGeneration(ctx, tx, login); err != nil {
+		return err
+	}
+
+	if _, err = tx.ExecContext(ctx, `DELETE FROM users WHERE email = $1`, login); err != nil {
+		return err
+	}
+
+	if _, err = tx.ExecContext(ctx, `DELETE FROM sessions WHERE email = $1`, login); err != nil {
+		return err
+	}
+
+	if _, err = tx.ExecContext(ctx, `DELETE FROM refresh_tokens WHERE email = $1`, login); err != nil {
+		return err
+	}
+
+	if _, err = tx.ExecContext(ctx, `UPDATE identities SET email = $1 WHERE email = $2`, newLogin, login); err != nil {
+		return err
+	}
+
+	if _, err = tx.ExecContext(ctx, `UPDATE api_keys SET email = $1 WHERE email = $2`, newLogin, login); err != nil {
+		return err
+	}
+
+	if len(token.ID) != 0 {
+		_, err = tx.ExecContext(ctx,
+			insertRevokedToken,
+			token.ID, nullTime(token.ExpiresAt),
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (ur *SQLUserStorage) Tombstone(ctx context.Context, login string, until time.Time, token RevokedToken) error {
+	tx, err := ur.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err = retireGeneration(ctx, tx, login); err != nil {
+		return err
+	}
+
+	res, err := tx.ExecContext(ctx, `DELETE FROM users WHERE email = $1`, login)
+	if err != nil {
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return errors.New("there is no such user to delete")
+	}
+
+	if _, err = tx.ExecContext(ctx, `DELETE FROM sessions WHERE email = $1`, login); err != nil {
+		return err
+	}
+
+	if _, err = tx.ExecContext(ctx, `DELETE FROM refresh_tokens WHERE email = $1`, login); err != nil {
+		return err
+	}
+
+	if _, err = tx.ExecContext(ctx, `DELETE FROM identities WHERE email = $1`, login); err != nil {
+		return err
+	}
+
+	if _, err = tx.ExecContext(ctx, `DELETE FROM api_keys WHERE email = $1`, login); err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx,
+		`INSERT INTO tombstones (email, expires_at) VALUES ($1, $2)
+		ON CONFLICT (email) DO UPDATE SET expires_at = excluded.expires_at`,
+		login, until.UTC(),
+	)
+	if err != nil {
+		return err
+	}
+
+	if len(token.ID) != 0 {
+		_, err = tx.ExecContext(ctx,
+			insertRevokedToken,
+			token.ID, nullTime(token.ExpiresAt),
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// Tombstoned tells whether an account with the email was ever deleted, even
+// if the email can be registered again by now.
+func (ur *SQLUserStorage) Tombstoned(ctx context.Context, login string) (bool, error) {
+	var found int
+	err := ur.db.QueryRowContext(ctx, `SELECT 1 FROM tombstones WHERE email = $1`, login).Scan(&found)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func nullTime(t time.Time) sql.NullTime {
+	if t.IsZero() {
+		return sql.NullTime{}
+	}
+	return sql.NullTime{Time: t.UTC(), Valid: true}
+}
+
+func (ur *SQLUserStorage) CheckNotInDB(ctx context.Context, tokenID string) error {
+	var found int
+	err := ur.db.QueryRowContext(ctx, `SELECT 1 FROM revoked_tokens WHERE id = $1`, tokenID).Scan(&found)
+
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	return errors.New("token is banned")
+}
+
+func (ur *SQLUserStorage) AddToken(ctx context.Context, token RevokedToken) error {
+	res, err := ur.db.ExecContext(ctx,
+		insertRevokedToken,
+		token.ID, nullTime(token.ExpiresAt),
+	)
+	if err != nil {
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return errors.New("token is already banned")
+	}
+
+	return nil
+}
+
+func (ur *SQLUserStorage) PurgeExpiredTokens(ctx context.Context, now time.Time) (int, error) {
+	_, err := ur.db.ExecContext(ctx,
+		`DELETE FROM revoked_tokens WHERE expires_at IS NOT NULL AND expires_at < $1`,
+		now.UTC(),
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = ur.db.ExecContext(ctx,
+		`DELETE FROM sessions WHERE expires_at IS NOT NULL AND expires_at < $1`,
+		now.UTC(),
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = ur.db.ExecContext(ctx, `DELETE FROM refresh_tokens WHERE expires_at < $1`, now.UTC())
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = ur.db.ExecContext(ctx,
+		`DELETE FROM api_keys WHERE expires_at IS NOT NULL AND expires_at < $1`,
+		now.UTC(),
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	var remaining int
+	err = ur.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM revoked_tokens`).Scan(&remaining)
+	return remaining, err
+}
+
+func (ur *SQLUserStorage) AddSession(ctx context.Context, s Session) error {
+	res, err := ur.db.ExecContext(ctx,
+		`INSERT INTO sessions (id, email, issued_at, expires_at, user_agent, remote_addr)
+		SELECT $1, $2, $3, $4, $5, $6 WHERE EXISTS (SELECT 1 FROM users WHERE email = $2)`,
+		s.ID, s.Email, s.IssuedAt.UTC(), nullTime(s.ExpiresAt), s.UserAgent, s.RemoteAddr,
+	)
+	if err != nil {
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return errors.New("there is no such user to log in")
+	}
+
+	return nil
+}
+
+func (ur *SQLUserStorage) Sessions(ctx context.Context, login string) ([]Session, error) {
+	rows, err := ur.db.QueryContext(ctx,
+		`SELECT s.id, s.email, s.issued_at, s.expires_at, s.user_agent, s.remote_addr
+		FROM sessions s LEFT JOIN revoked_tokens r ON r.id = s.id
+		WHERE s.email = $1 AND r.id IS NULL AND (s.expires_at IS NULL OR s.expires_at > $2)
+		ORDER BY s.issued_at`,
+		login, time.Now().UTC(),
+	)
+	if err != nil {
+		return []Session{}, err
+	}
+	defer rows.Close()
+
+	sessions := []Session{}
+	for rows.Next() {
+		s := Session{}
+		expiresAt := sql.NullTime{}
+		if err = rows.Scan(&s.ID, &s.Email, &s.IssuedAt, &expiresAt, &s.UserAgent, &s.RemoteAddr); err != nil {
+			return []Session{}, err
+		}
+
+		if expiresAt.Valid {
+			s.ExpiresAt = expiresAt.Time
+		}
+		sessions = append(sessions, s)
+	}
+
+	return sessions, rows.Err()
+}
+
+const refreshTokenColumns = "id, family, email, expires_at, access_token_id, access_expires_at, used_at, revoked"
+
+func queryRefreshToken(ctx context.Context, q queryRower, id string) (RefreshToken, error) {
+	t := RefreshToken{}
+	accessExpiresAt, usedAt := sql.NullTime{}, sql.NullTime{}
+	err := q.QueryRowContext(ctx, `SELECT `+refreshTokenColumns+` FROM refresh_tokens WHERE id = $1`, id).Scan(
+		&t.ID, &t.Family, &t.Email, &t.ExpiresAt, &t.AccessToken.ID, &accessExpiresAt, &usedAt, &t.Revoked,
+	)
+	if errors.Is(err, sql.ErrNoRows) {
+		return RefreshToken{}, errInvalidRefreshToken
+	} else if err != nil {
+		return RefreshToken{}, err
+	}
+
+	if accessExpiresAt.Valid {
+		t.AccessToken.ExpiresAt = accessExpiresAt.Time
+	}
+	if usedAt.Valid {
+		t.UsedAt = usedAt.Time
+	}
+	return t, nil
+}
+
+type execer interface {
+	ExecContext(context.Context, string, ...interface{}) (sql.Result, error)
+}
+
+type queryExecer interface {
+	execer
+	queryRower
+}
+
+func insertRefreshToken(ctx context.Context, e execer, t RefreshToken) (sql.Result, error) {
+	return e.ExecContext(ctx,
+		`INSERT INTO refresh_tokens (id, family, email, expires_at, access_token_id, access_expires_at)
+		SELECT $1, $2, $3, $4, $5, $6 WHERE EXISTS (SELECT 1 FROM users WHERE email = $3)`,
+		t.ID, t.Family, t.Email, t.ExpiresAt.UTC(), t.AccessToken.ID, nullTime(t.AccessToken.ExpiresAt),
+	)
+}
+
+func (ur *SQLUserStorage) AddRefreshToken(ctx context.Context, t RefreshToken) error {
+	res, err := insertRefreshToken(ctx, ur.db, t)
+	if err != nil {
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return errors.New("there is no such user to log in")
+	}
+
+	return nil
+}
+
+func (ur *SQLUserStorage) GetRefreshToken(ctx context.Context, id string) (RefreshToken, error) {
+	return queryRefreshToken(ctx, ur.db, id)
+}
+
+func (ur *SQLUserStorage) LinkIdentity(ctx context.Context, id Identity) error {
+	res, err := ur.db.ExecContext(ctx,
+		`INSERT INTO identities (issuer, subject, email, linked_at)
+		SELECT $1, $2, $3, $4 WHERE EXISTS (SELECT 1 FROM users WHERE email = $3)
+		ON CONFLICT (issuer, subject) DO NOTHING`,
+		id.Issuer, id.Subject, id.Email, id.LinkedAt.UTC(),
+	)
+	if err != nil {
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		if _, err = ur.GetIdentity(ctx, id.Issuer, id.Subject); err == nil {
+			return errors.New("identity is already linked")
+		}
+		return errors.New("there is no such user to link")
+	}
+
+	return nil
+}
+
+// TakeOver overwrites the user like Update does and leaves id the only
+// identity linked to it, in one transaction.
+func (ur *SQLUserStorage) TakeOver(ctx context.Context, login string, u User, id Identity) error {
+	tx, err := ur.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err = updateUser(ctx, tx, login, u); err != nil {
+		return err
+	}
+
+	if _, err = tx.ExecContext(ctx, `DELETE FROM identities WHERE email = $1`, login); err != nil {
+		return err
+	}
+
+	res, err := tx.ExecContext(ctx,
+		`INSERT INTO identities (issuer, subject, email, linked_at) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (issuer, subject) DO NOTHING`,
+		id.Issuer, id.Subject, login, id.LinkedAt.UTC(),
+	)
+	if err != nil {
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return errors.New("identity is already linked")
+	}
+
+	return tx.Commit()
+}
+
+func (ur *SQLUserStorage) GetIdentity(ctx context.Context, issuer string, subject string) (Identity, error) {
+	id := Identity{}
+	err := ur.db.QueryRowContext(ctx,
+		`SELECT issuer, subject, email, linked_at FROM identities WHERE issuer = $1 AND subject = $2`,
+		issuer, subject,
+	).Scan(&id.Issuer, &id.Subject, &id.Email, &id.LinkedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Identity{}, errNoSuchIdentity
+	}
+	return id, err
+}
+
+func (ur *SQLUserStorage) Identities(ctx context.Context, login string) ([]Identity, error) {
+	rows, err := ur.db.QueryContext(ctx,
+		`SELECT issuer, subject, email, linked_at FROM identities WHERE email = $1 ORDER BY linked_at`,
+		login,
+	)
+	if err != nil {
+		return []Identity{}, err
+	}
+	defer rows.Close()
+
+	identities := []Identity{}
+	for rows.Next() {
+		id := Identity{}
+		if err = rows.Scan(&id.Issuer, &id.Subject, &id.Email, &id.LinkedAt); err != nil {
+			return []Identity{}, err
+		}
+		identities = append(identities, id)
+	}
+
+	return identities, rows.Err()
+}
+
+const apiKeyColumns = "id, email, name, scopes, hash, created_at, expires_at, last_used_at"
+
+func scanAPIKey(row rowScanner) (APIKey, error) {
+	k := APIKey{}
+	var scopes string
+	expiresAt, lastUsedAt := sql.NullTime{}, sql.NullTime{}
+	if err := row.Scan(&k.ID, &k.Email, &k.Name, &scopes, &k.Hash, &k.CreatedAt, &expiresAt, &lastUsedAt); err != nil {
+		return APIKey{}, err
+	}
+
+	k.Scopes = strings.Fields(scopes)
+	if expiresAt.Valid {
+		k.ExpiresAt = expiresAt.Time
+	}
+	if lastUsedAt.Valid {
+		k.LastUsedAt = lastUsedAt.Time
+	}
+	return k, nil
+}
+
+func (ur *SQLUserStorage) AddAPIKey(ctx context.Context, k APIKey) error {
+	res, err := ur.db.ExecContext(ctx,
+		`INSERT INTO api_keys (`+apiKeyColumns+`)
+		SELECT $1, $2, $3, $4, $5, $6, $7, $8 WHERE EXISTS (SELECT 1 FROM users WHERE email = $2)
+		ON CONFLICT (id) DO NOTHING`,
+		k.ID, k.Email, k.Name, strings.Join(k.Scopes, " "), k.Hash, k.CreatedAt.UTC(), nullTime(k.ExpiresAt),
+		nullTime(k.LastUsedAt),
+	)
+	if err != nil {
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		if _, err = ur.GetAPIKey(ctx, k.ID); err == nil {
+			return errors.New("api key is already present")
+		}
+		return errors.New("there is no such user to add a key to")
+	}
+
+	return nil
+}
+
+func (ur *SQLUserStorage) GetAPIKey(ctx context.Context, id string) (APIKey, error) {
+	k, err := scanAPIKey(ur.db.QueryRowContext(ctx, `SELECT `+apiKeyColumns+` FROM api_keys WHERE id = $1`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return APIKey{}, errNoSuchAPIKey
+	}
+	return k, err
+}
+
+func (ur *SQLUserStorage) UseAPIKey(ctx context.Context, id string, at time.Time) error {
+	res, err := ur.db.ExecContext(ctx, `UPDATE api_keys SET last_used_at = $1 WHERE id = $2`, at.UTC(), id)
+	if err != nil {
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return errNoSuchAPIKey
+	}
+
+	return nil
+}
+
+func (ur *SQLUserStorage) APIKeys(ctx context.Context, login string) ([]APIKey, error) {
+	rows, err := ur.db.QueryContext(ctx,
+		`SELECT `+apiKeyColumns+` FROM api_keys
+		WHERE email = $1 AND (expires_at IS NULL OR expires_at > $2)
+		ORDER BY created_at`,
+		login, time.Now().UTC(),
+	)
+	if err != nil {
+		return []APIKey{}, err
+	}
+	defer rows.Close()
+
+	keys := []APIKey{}
+	for rows.Next() {
+		k, err := scanAPIKey(rows)
+		if err != nil {
+			return []APIKey{}, err
+		}
+		keys = append(keys, k)
+	}
+
+	return keys, rows.Err()
+}
+
+func (ur *SQLUserStorage) RevokeAPIKey(ctx context.Context, login string, id string) error {
+	res, err := ur.db.ExecContext(ctx, `DELETE FROM api_keys WHERE id = $1 AND email = $2`, id, login)
+	if err != nil {
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return errNoSuchAPIKey
+	}
+
+	return nil
+}
+
+// revokeRefreshFamily revokes every refresh token of family along with the
+// access tokens issued with them.
+func revokeRefreshFamily(ctx context.Context, e execer, family string) error {
+	_, err := e.ExecContext(ctx,
+		`INSERT INTO revoked_tokens (id, expires_at)
+		SELECT access_token_id, access_expires_at FROM refresh_tokens WHERE family = $1 AND access_token_id <> ''
+		ON CONFLICT (id) DO NOTHING`,
+		family,
+	)
+	if err != nil {
+		return err
+	}
+
+	_, err = e.ExecContext(ctx, `UPDATE refresh_tokens SET revoked = TRUE WHERE family = $1`, family)
+	return err
+}
+
+func (ur *SQLUserStorage) RevokeSession(ctx context.Context, token RevokedToken) error {
+	tx, err := ur.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err = tx.ExecContext(ctx, insertRevokedToken, token.ID, nullTime(token.ExpiresAt)); err != nil {
+		return err
+	}
+
+	var family string
+	err = tx.QueryRowContext(ctx, `SELECT family FROM refresh_tokens WHERE access_token_id = $1`, token.ID).Scan(&family)
+	if err == nil {
+		err = revokeRefreshFamily(ctx, tx, family)
+	}
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (ur *SQLUserStorage) RevokeAllTokens(ctx context.Context, login string) error {
+	tx, err := ur.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx, `UPDATE users SET token_generation = token_generation + 1 WHERE email = $1`, login)
+	if err != nil {
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return errors.New("there is no such user to log out")
+	}
+
+	if _, err = tx.ExecContext(ctx, `DELETE FROM sessions WHERE email = $1`, login); err != nil {
+		return err
+	}
+
+	if _, err = tx.ExecContext(ctx, `DELETE FROM refresh_tokens WHERE email = $1`, login); err != nil {
+		return err
+	}
+
+	if _, err = tx.ExecContext(ctx, `DELETE FROM api_keys WHERE email = $1`, login); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (ur *SQLUserStorage) RotateRefreshToken(ctx context.Context, id string, next RefreshToken) error {
+	tx, err := ur.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	t, err := queryRefreshToken(ctx, tx, id)
+	if err != nil {
+		return err
+	}
+
+	if t.Revoked {
+		return errInvalidRefreshToken
+	}
+
+	now := time.Now()
+	if t.UsedAt.IsZero() && !t.ExpiresAt.After(now) {
+		return errors.New("refresh token has expired")
+	}
+
+	used := !t.UsedAt.IsZero()
+	if !used {
+		res, err := tx.ExecContext(ctx,
+			`UPDATE refresh_tokens SET used_at = $1 WHERE id = $2 AND used_at IS NULL`,
+			now.UTC(), id,
+		)
+		if err != nil {
+			return err
+		}
+
+		// somebody else got to rotate it between the read and the update
+		if n, err := res.RowsAffected(); err != nil {
+			return err
+		} else if n == 0 {
+			used = true
+		}
+	}
+
+	if used {
+		if err = revokeRefreshFamily(ctx, tx, t.Family); err != nil {
+			return err
+		}
+
+		if err = tx.Commit(); err != nil {
+			return err
+		}
+		return errRefreshTokenReused
+	}
+
+	next.Family = t.Family
+	next.Email = t.Email
+	res, err := insertRefreshToken(ctx, tx, next)
+	if err != nil {
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return errInvalidRefreshToken
+	}
+
+	return tx.Commit()
+}
+
+func (ur *SQLUserStorage) IsBanned(ctx context.Context, login string) error {
+	var reason, whoBanned string
+	err := ur.db.QueryRowContext(ctx,
+		`SELECT reason, who_banned FROM bans WHERE email = $1 AND unbanned_at IS NULL`,
+		login,
+	).Scan(&reason, &whoBanned)
+
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	return banError{reason: reason, whoBanned: whoBanned}
+}
+
+func (ur *SQLUserStorage) BanHistory(ctx context.Context, login string) ([]Ban, error) {
+	rows, err := ur.db.QueryContext(ctx,
+		`SELECT banned_at, who_banned, unbanned_at, who_unbanned, reason
+		FROM bans WHERE email = $1 ORDER BY seq`,
+		login,
+	)
+	if err != nil {
+		return []Ban{}, err
+	}
+	defer rows.Close()
+
+	history := []Ban{}
+	for rows.Next() {
+		b := Ban{}
+		unbannedAt := sql.NullTime{}
+		if err = rows.Scan(&b.BannedAt, &b.WhoBanned, &unbannedAt, &b.WhoUnbanned, &b.Reason); err != nil {
+			return []Ban{}, err
+		}
+
+		if unbannedAt.Valid {
+			b.UnbannedAt = unbannedAt.Time
+		}
+		history = append(history, b)
+	}
+
+	if err = rows.Err(); err != nil {
+		return []Ban{}, err
+	}
+
+	if len(history) == 0 {
+		return []Ban{}, errors.New("user history is clear")
+	}
+
+	return history, nil
+}
+
+func (ur *SQLUserStorage) AuditTrail(ctx context.Context, login string) ([]AuditEntry, error) {
+	rows, err := ur.db.QueryContext(ctx,
+		`SELECT banned_at, 'ban', who_banned, email, reason FROM bans
+		WHERE email = $1 OR who_banned = $1
+		UNION ALL
+		SELECT unbanned_at, 'unban', who_unbanned, email, '' FROM bans
+		WHERE unbanned_at IS NOT NULL AND (email = $1 OR who_unbanned = $1)
+		ORDER BY 1`,
+		login,
+	)
+	if err != nil {
+		return []AuditEntry{}, err
+	}
+	defer rows.Close()
+
+	trail := []AuditEntry{}
+	for rows.Next() {
+		e := AuditEntry{}
+		if err = rows.Scan(&e.At, &e.Action, &e.Actor, &e.Subject, &e.Reason); err != nil {
+			return []AuditEntry{}, err
+		}
+		trail = append(trail, e)
+	}
+
+	return trail, rows.Err()
+}
+
+func (ur *SQLUserStorage) Ban(ctx context.Context, login string, byLogin string, reason string) error {
+	tx, err := ur.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var total, active int
+	err = tx.QueryRowContext(ctx,
+		`SELECT COUNT(*), COUNT(*) - COUNT(unbanned_at) FROM bans WHERE email = $1`,
+		login,
+	).Scan(&total, &active)
+	if err != nil {
+		return err
+	}
+
+	if active != 0 {
+		return errors.New("user is already banned")
+	}
+
+	_, err = tx.ExecContext(ctx,
+		`INSERT INTO bans (email, seq, banned_at, who_banned, reason) VALUES ($1, $2, $3, $4, $5)`,
+		login, total, time.Now().UTC(), byLogin, reason,
+	)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (ur *SQLUserStorage) Unban(ctx context.Context, login string, byLogin string) error {
+	tx, err := ur.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var total int
+	err = tx.QueryRowContext(ctx, `SELECT COUNT(*) FROM bans WHERE email = $1`, login).Scan(&total)
+	if err != nil {
+		return err
+	}
+
+	if total == 0 {
+		return errors.New("user history is clear")
+	}
+
+	res, err := tx.ExecContext(ctx,
+		`UPDATE bans SET unbanned_at = $1, who_unbanned = $2 WHERE email = $3 AND unbanned_at IS NULL`,
+		time.Now().UTC(), byLogin, login,
+	)
+	if err != nil {
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return errors.New("user is not banned")
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sync"
+	"testing"
+)
+
+func TestInMemoryUserStorage(t *testing.T) {
+	testUserRepository(t, func(t *testing.T) UserRepository {
+		return NewInMemoryUserStorage()
+	})
+	testConcurrentUserRepository(t, func(t *testing.T) UserRepository {
+		return NewInMemoryUserStorage()
+	})
+}
+
+func TestAddSuperadmin(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("without credentials", func(t *testing.T) {
+		t.Setenv("CAKE_ADMIN_EMAIL", "")
+		t.Setenv("CAKE_ADMIN_PASSWORD", "")
+
+		for _, ur := range []UserRepository{NewInMemoryUserStorage(), newTestSQLUserStorage(t)} {
+			if _, err := ur.Get(ctx, ""); err == nil {
+				t.Errorf("Expected no superadmin without credentials in %T", ur)
+			}
+		}
+	})
+
+	t.Run("with credentials", func(t *testing.T) {
+		t.Setenv("CAKE_ADMIN_EMAIL", "superadmin@mail.com")
+		t.Setenv("CAKE_ADMIN_PASSWORD", "superpass")
+		t.Setenv("CAKE_DATA_DIR", t.TempDir())
+
+		ur := NewInMemoryUserStorage()
+		u, err := ur.Get(ctx, "superadmin@mail.com")
+		if err != nil || u.Role != "superadmin" {
+			t.Fatalf("Unexpected superadmin: %+v, %v", u, err)
+		}
+		if ok, _ := verifyPassword("superpass", u.PasswordDigest); !ok {
+			t.Errorf("Expected the superadmin to log in with CAKE_ADMIN_PASSWORD")
+		}
+		ur.Close()
+
+		// restarting finds the superadmin there already
+		ur = NewInMemoryUserStorage()
+		defer ur.Close()
+		if _, err = ur.Get(ctx, "superadmin@mail.com"); err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+	})
+}
+
+func TestInMemoryUserStorage_Stress(t *testing.T) {
+	const (
+		workers    = 16
+		iterations = 500
+		emails     = 8
+	)
+
+	ctx := context.Background()
+	ur := NewInMemoryUserStorage()
+
+	var (
+		wg            sync.WaitGroup
+		lock          sync.Mutex
+		registrations = map[string]int{}
+	)
+
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			rnd := rand.New(rand.NewSource(seed))
+
+			for i := 0; i < iterations; i++ {
+				email := fmt.Sprintf("user%d@mail.com", rnd.Intn(emails))
+
+				switch rnd.Intn(4) {
+				case 0:
+					if ur.Add(ctx, email, User{Email: email, Role: "user"}) == nil {
+						lock.Lock()
+						registrations[email]++
+						lock.Unlock()
+					}
+				case 1:
+					ur.Ban(ctx, email, "admin@mail.com", "stress")
+				case 2:
+					ur.Unban(ctx, email, "admin@mail.com")
+				case 3:
+					ur.IsBanned(ctx, email)
+					ur.Get(ctx, email)
+				}
+			}
+		}(int64(w))
+	}
+	wg.Wait()
+
+	for email, n := range registrations {
+		if n != 1 {
+			t.Errorf("%s was registered %d times", email, n)
+		}
+	}
+
+	for i := 0; i < emails; i++ {
+		email := fmt.Sprintf("user%d@mail.com", i)
+		history, err := ur.BanHistory(ctx, email)
+		if err != nil {
+			continue
+		}
+
+		for j, b := range history[:len(history)-1] {
+			if b.UnbannedAt.IsZero() {
+				t.Errorf("%s has an active ban %d before the last one: %v", email, j, history)
+			}
+		}
+	}
+}
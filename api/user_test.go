@@ -2,17 +2,27 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/md5"
 	"encoding/json"
 	"io"
 	"net/http"
+	"net/http/cookiejar"
 	"net/http/httptest"
-	"os"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/philanton/cake-service/pkg/jwt"
+	"github.com/philanton/cake-service/pkg/oidc"
+	"github.com/philanton/cake-service/pkg/oidc/oidctest"
 )
 
 type parsedResponse struct {
 	status int
 	body   []byte
+	header http.Header
 }
 
 func createRequester(t *testing.T) func(req *http.Request, err error) parsedResponse {
@@ -33,7 +43,7 @@ func createRequester(t *testing.T) func(req *http.Request, err error) parsedResp
 			t.Errorf("unexpected error: %v", err)
 		}
 
-		return parsedResponse{res.StatusCode, resp}
+		return parsedResponse{res.StatusCode, resp, res.Header}
 	}
 }
 
@@ -46,13 +56,75 @@ func prepareParams(t *testing.T, params map[string]interface{}) io.Reader {
 	return bytes.NewBuffer(body)
 }
 
+type mail struct {
+	to      string
+	subject string
+	body    string
+}
+
+type testMailer struct {
+	lock sync.Mutex
+	sent []mail
+}
+
+func (m *testMailer) Send(ctx context.Context, to string, subject string, body string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.sent = append(m.sent, mail{to: to, subject: subject, body: body})
+	return nil
+}
+
+// wait returns the n-th email sent, for emails sent in the background.
+func (m *testMailer) wait(t *testing.T, n int) mail {
+	for i := 0; i < 100; i++ {
+		m.lock.Lock()
+		if len(m.sent) >= n {
+			defer m.lock.Unlock()
+			return m.sent[n-1]
+		}
+		m.lock.Unlock()
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatalf("Expected %d emails to be sent", n)
+	return mail{}
+}
+
+func (m *testMailer) last(t *testing.T) mail {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if len(m.sent) == 0 {
+		t.Fatalf("Expected an email to be sent")
+	}
+	return m.sent[len(m.sent)-1]
+}
+
 func newTestUserService() *UserService {
 	return &UserService{
 		repository: NewInMemoryUserStorage(),
 		notifier:   make(chan []byte, 10),
-		reg:        make(chan bool, 5),
-		cake:       make(chan bool, 5),
+		hasher:     defaultArgon2idHasher,
+		throttle:   newLoginThrottle(defaultMaxLoginAttempts, defaultMaxAddrAttempts, defaultLoginLockout),
+		mailer:     &testMailer{},
+		verification: emailVerification{
+			secret:  []byte("secret"),
+			ttl:     time.Hour,
+			baseURL: "http://cake.test",
+			policy:  unverifiedFull,
+		},
+		reg:  make(chan bool, 5),
+		cake: make(chan bool, 5),
+	}
+}
+
+func accessToken(t *testing.T, r parsedResponse) string {
+	tokens := TokenResponse{}
+	if err := json.Unmarshal(r.body, &tokens); err != nil {
+		t.Errorf("unexpected error: %v", err)
 	}
+	return tokens.AccessToken
 }
 
 func assertStatus(t *testing.T, expected int, r parsedResponse) {
@@ -212,6 +284,59 @@ func TestUsers_JWT(t *testing.T) {
 		ts.Close()
 	})
 
+	t.Run("locking out after failed logins", func(t *testing.T) {
+		u := newTestUserService()
+		j, err := NewMyJWTService()
+		if err != nil {
+			t.FailNow()
+		}
+
+		ts := httptest.NewServer(http.HandlerFunc(u.Register))
+		params := map[string]interface{}{
+			"email":         "test@mail.com",
+			"password":      "correct_pass",
+			"favorite_cake": "somecake",
+		}
+		doRequest(http.NewRequest(http.MethodPost, ts.URL, prepareParams(t, params)))
+		ts.Close()
+		<-u.notifier
+
+		ts = httptest.NewServer(http.HandlerFunc(wrapJWT(j, u.JWT)))
+		defer ts.Close()
+
+		// made up emails lock out alike, but are not announced
+		params = map[string]interface{}{
+			"email":    "nobody@mail.com",
+			"password": "wrong_pass",
+		}
+		for i := 0; i < defaultMaxLoginAttempts; i++ {
+			resp := doRequest(http.NewRequest(http.MethodPost, ts.URL, prepareParams(t, params)))
+			assertStatus(t, 422, resp)
+		}
+		assertStatus(t, 429, doRequest(http.NewRequest(http.MethodPost, ts.URL, prepareParams(t, params))))
+		if len(u.notifier) != 0 {
+			t.Errorf("Unexpected event: %s", string(<-u.notifier))
+		}
+
+		params["email"] = "test@mail.com"
+		for i := 0; i < defaultMaxLoginAttempts; i++ {
+			resp := doRequest(http.NewRequest(http.MethodPost, ts.URL, prepareParams(t, params)))
+			assertStatus(t, 422, resp)
+		}
+
+		if event := string(<-u.notifier); event != "locked: test@mail.com" {
+			t.Errorf("Unexpected event: %s", event)
+		}
+
+		params["password"] = "correct_pass"
+		resp := doRequest(http.NewRequest(http.MethodPost, ts.URL, prepareParams(t, params)))
+		assertStatus(t, 429, resp)
+		assertBody(t, "too many failed logins, try again later", resp)
+		if resp.header.Get("Retry-After") != "60" {
+			t.Errorf("Unexpected Retry-After: %s", resp.header.Get("Retry-After"))
+		}
+	})
+
 	t.Run("unauthorized cake", func(t *testing.T) {
 		u := newTestUserService()
 		j, err := NewMyJWTService()
@@ -272,229 +397,1815 @@ func TestUsers_JWT(t *testing.T) {
 
 		ts = httptest.NewServer(http.HandlerFunc(j.jwtAuth(u.repository, u.getCakeHandler)))
 		req, err := http.NewRequest(http.MethodGet, ts.URL, nil)
-		req.Header.Set("Authorization", "Bearer "+string(resp.body))
+		req.Header.Set("Authorization", "Bearer "+accessToken(t, resp))
 		resp = doRequest(req, err)
 		assertStatus(t, 200, resp)
 		assertBody(t, "somecake", resp)
 		ts.Close()
 	})
-}
-
-func TestUsers_Update(t *testing.T) {
-	doRequest := createRequester(t)
 
-	t.Run("favorite cake updating", func(t *testing.T) {
-		us := newTestUserService()
-		js, err := NewMyJWTService()
+	t.Run("rehashing legacy password", func(t *testing.T) {
+		u := newTestUserService()
+		j, err := NewMyJWTService()
 		if err != nil {
 			t.FailNow()
 		}
 
-		ts := httptest.NewServer(http.HandlerFunc(us.Register))
-		params := map[string]interface{}{
-			"email":         "test@mail.com",
-			"password":      "somepass",
-			"favorite_cake": "somecake",
+		ctx := context.Background()
+		legacy := User{
+			Email:          "test@mail.com",
+			PasswordDigest: string(md5.New().Sum([]byte("somepass"))),
+			Role:           "user",
+			FavoriteCake:   "somecake",
+		}
+		if err = u.repository.Add(ctx, legacy.Email, legacy); err != nil {
+			t.Fatalf("unexpected error: %v", err)
 		}
 
-		resp := doRequest(http.NewRequest(http.MethodPost, ts.URL, prepareParams(t, params)))
-		ts.Close()
+		ts := httptest.NewServer(http.HandlerFunc(wrapJWT(j, u.JWT)))
+		defer ts.Close()
 
-		ts = httptest.NewServer(http.HandlerFunc(wrapJWT(js, us.JWT)))
-		params = map[string]interface{}{
+		params := map[string]interface{}{
 			"email":    "test@mail.com",
 			"password": "somepass",
 		}
 
-		resp = doRequest(http.NewRequest(http.MethodPost, ts.URL, prepareParams(t, params)))
-		jwtToken := string(resp.body)
-		ts.Close()
-
-		ts = httptest.NewServer(http.HandlerFunc(js.jwtAuth(us.repository, us.OverwriteCake)))
+		resp := doRequest(http.NewRequest(http.MethodPost, ts.URL, prepareParams(t, params)))
+		assertStatus(t, 200, resp)
 
-		params = map[string]interface{}{
-			"favorite_cake": "",
+		user, err := u.repository.Get(ctx, legacy.Email)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
 		}
-		req, err := http.NewRequest(http.MethodPut, ts.URL, prepareParams(t, params))
-		req.Header.Set("Authorization", "Bearer "+jwtToken)
-		resp = doRequest(req, err)
-		assertStatus(t, 422, resp)
-		assertBody(t, "favorite cake should not be empty", resp)
 
-		params["favorite_cake"] = "some cake"
-		req, err = http.NewRequest(http.MethodPut, ts.URL, prepareParams(t, params))
-		req.Header.Set("Authorization", "Bearer "+jwtToken)
-		resp = doRequest(req, err)
-		assertStatus(t, 422, resp)
-		assertBody(t, "favorite cake should have only alphabetic characters", resp)
+		if !strings.HasPrefix(user.PasswordDigest, "$argon2id$") {
+			t.Errorf("Expected password to be rehashed, got %q", user.PasswordDigest)
+		}
 
-		params["favorite_cake"] = "somecake"
-		req, err = http.NewRequest(http.MethodPut, ts.URL, prepareParams(t, params))
-		req.Header.Set("Authorization", "Bearer "+jwtToken)
-		resp = doRequest(req, err)
-		assertStatus(t, 201, resp)
-		assertBody(t, "favorite cake changed", resp)
+		resp = doRequest(http.NewRequest(http.MethodPost, ts.URL, prepareParams(t, params)))
+		assertStatus(t, 200, resp)
 	})
+}
 
-	t.Run("password updating", func(t *testing.T) {
-		us := newTestUserService()
-		js, err := NewMyJWTService()
-		if err != nil {
-			t.FailNow()
-		}
+func TestUsers_Refresh(t *testing.T) {
+	doRequest := createRequester(t)
 
-		ts := httptest.NewServer(http.HandlerFunc(us.Register))
-		params := map[string]interface{}{
-			"email":         "test@mail.com",
-			"password":      "somepass",
-			"favorite_cake": "somecake",
-		}
+	u := newTestUserService()
+	j, err := NewMyJWTService()
+	if err != nil {
+		t.FailNow()
+	}
 
-		resp := doRequest(http.NewRequest(http.MethodPost, ts.URL, prepareParams(t, params)))
-		ts.Close()
+	ts := httptest.NewServer(http.HandlerFunc(u.Register))
+	params := map[string]interface{}{
+		"email":         "test@mail.com",
+		"password":      "somepass",
+		"favorite_cake": "somecake",
+	}
+	doRequest(http.NewRequest(http.MethodPost, ts.URL, prepareParams(t, params)))
+	ts.Close()
+
+	login := httptest.NewServer(http.HandlerFunc(wrapJWT(j, u.JWT)))
+	defer login.Close()
+	refresh := httptest.NewServer(http.HandlerFunc(wrapJWT(j, u.Refresh)))
+	defer refresh.Close()
+	cake := httptest.NewServer(http.HandlerFunc(j.jwtAuth(u.repository, u.getCakeHandler)))
+	defer cake.Close()
+
+	getCake := func(token string) parsedResponse {
+		req, err := http.NewRequest(http.MethodGet, cake.URL, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		return doRequest(req, err)
+	}
 
-		ts = httptest.NewServer(http.HandlerFunc(wrapJWT(js, us.JWT)))
-		params = map[string]interface{}{
-			"email":    "test@mail.com",
-			"password": "somepass",
-		}
+	params = map[string]interface{}{
+		"email":    "test@mail.com",
+		"password": "somepass",
+	}
+	resp := doRequest(http.NewRequest(http.MethodPost, login.URL, prepareParams(t, params)))
+	assertStatus(t, 200, resp)
 
-		resp = doRequest(http.NewRequest(http.MethodPost, ts.URL, prepareParams(t, params)))
-		jwtToken := string(resp.body)
-		ts.Close()
+	first := TokenResponse{}
+	if err = json.Unmarshal(resp.body, &first); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if first.TokenType != "Bearer" || first.ExpiresIn <= 0 || len(first.RefreshToken) == 0 {
+		t.Errorf("Unexpected token response: %s", string(resp.body))
+	}
 
-		ts = httptest.NewServer(
-			http.HandlerFunc(js.jwtAuth(us.repository, us.OverwritePassword)),
-		)
+	t.Run("invalid refresh token", func(t *testing.T) {
+		params := map[string]interface{}{"refresh_token": "something strange"}
+		resp := doRequest(http.NewRequest(http.MethodPost, refresh.URL, prepareParams(t, params)))
+		assertStatus(t, 422, resp)
+		assertBody(t, "refresh token is not valid", resp)
+	})
 
-		params = map[string]interface{}{
-			"password": "pass",
-		}
-		req, err := http.NewRequest(http.MethodPut, ts.URL, prepareParams(t, params))
-		req.Header.Set("Authorization", "Bearer "+jwtToken)
-		resp = doRequest(req, err)
+	params = map[string]interface{}{"refresh_token": first.RefreshToken}
+	resp = doRequest(http.NewRequest(http.MethodPost, refresh.URL, prepareParams(t, params)))
+	assertStatus(t, 200, resp)
+
+	second := TokenResponse{}
+	if err = json.Unmarshal(resp.body, &second); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if second.RefreshToken == first.RefreshToken {
+		t.Errorf("Expected refresh token to be rotated")
+	}
+
+	resp = getCake(second.AccessToken)
+	assertStatus(t, 200, resp)
+	assertBody(t, "somecake", resp)
+
+	t.Run("reusing refresh token", func(t *testing.T) {
+		resp := doRequest(http.NewRequest(http.MethodPost, refresh.URL, prepareParams(t, params)))
 		assertStatus(t, 422, resp)
-		assertBody(t, "password should have at least 8 symbols", resp)
+		assertBody(t, "refresh token was already used", resp)
 
-		params["password"] = "somepass"
-		req, err = http.NewRequest(http.MethodPut, ts.URL, prepareParams(t, params))
-		req.Header.Set("Authorization", "Bearer "+jwtToken)
-		resp = doRequest(req, err)
-		assertStatus(t, 201, resp)
-		assertBody(t, "password changed", resp)
+		resp = getCake(first.AccessToken)
+		assertStatus(t, 401, resp)
+		assertBody(t, "token is banned", resp)
 
-		req, err = http.NewRequest(http.MethodPut, ts.URL, prepareParams(t, params))
-		req.Header.Set("Authorization", "Bearer "+jwtToken)
-		resp = doRequest(req, err)
+		resp = getCake(second.AccessToken)
 		assertStatus(t, 401, resp)
 		assertBody(t, "token is banned", resp)
+
+		params := map[string]interface{}{"refresh_token": second.RefreshToken}
+		resp = doRequest(http.NewRequest(http.MethodPost, refresh.URL, prepareParams(t, params)))
+		assertStatus(t, 422, resp)
+		assertBody(t, "refresh token is not valid", resp)
 	})
+}
 
-	t.Run("email updating", func(t *testing.T) {
-		us := newTestUserService()
-		js, err := NewMyJWTService()
-		if err != nil {
-			t.FailNow()
-		}
+func TestUsers_Verify(t *testing.T) {
+	doRequest := createRequester(t)
+
+	register := func(t *testing.T, u *UserService) string {
+		ts := httptest.NewServer(http.HandlerFunc(u.Register))
+		defer ts.Close()
 
-		ts := httptest.NewServer(http.HandlerFunc(us.Register))
 		params := map[string]interface{}{
 			"email":         "test@mail.com",
 			"password":      "somepass",
 			"favorite_cake": "somecake",
 		}
+		doRequest(http.NewRequest(http.MethodPost, ts.URL, prepareParams(t, params)))
+		<-u.notifier
 
-		resp := doRequest(http.NewRequest(http.MethodPost, ts.URL, prepareParams(t, params)))
-		ts.Close()
-
-		ts = httptest.NewServer(http.HandlerFunc(wrapJWT(js, us.JWT)))
-		params = map[string]interface{}{
-			"email":    "test@mail.com",
-			"password": "somepass",
+		sent := u.mailer.(*testMailer).last(t)
+		if sent.to != "test@mail.com" {
+			t.Errorf("Unexpected recipient: %s", sent.to)
 		}
 
-		resp = doRequest(http.NewRequest(http.MethodPost, ts.URL, prepareParams(t, params)))
-		jwtToken := string(resp.body)
-		ts.Close()
+		idx := strings.Index(sent.body, "http://cake.test/user/verify?token=")
+		if idx < 0 {
+			t.Fatalf("Expected a verification link in: %s", sent.body)
+		}
+		return strings.Fields(sent.body[idx:])[0]
+	}
 
-		ts = httptest.NewServer(
-			http.HandlerFunc(js.jwtAuth(us.repository, us.OverwriteEmail)),
-		)
+	t.Run("verifying", func(t *testing.T) {
+		u := newTestUserService()
+		link := register(t, u)
 
-		params = map[string]interface{}{
-			"email": "em@il",
+		user, _ := u.repository.Get(context.Background(), "test@mail.com")
+		if !user.Unverified {
+			t.Errorf("Expected a new account to start unverified")
 		}
-		req, err := http.NewRequest(http.MethodPut, ts.URL, prepareParams(t, params))
-		req.Header.Set("Authorization", "Bearer "+jwtToken)
-		resp = doRequest(req, err)
+
+		ts := httptest.NewServer(http.HandlerFunc(u.Verify))
+		defer ts.Close()
+		query := link[strings.Index(link, "?"):]
+
+		resp := doRequest(http.NewRequest(http.MethodGet, ts.URL+query+"x", nil))
 		assertStatus(t, 422, resp)
-		assertBody(t, "email is not valid", resp)
+		assertBody(t, "verification link is not valid", resp)
 
-		params["email"] = "test@penware.com"
-		req, err = http.NewRequest(http.MethodPut, ts.URL, prepareParams(t, params))
-		req.Header.Set("Authorization", "Bearer "+jwtToken)
-		resp = doRequest(req, err)
-		assertStatus(t, 201, resp)
-		assertBody(t, "email changed", resp)
+		resp = doRequest(http.NewRequest(http.MethodGet, ts.URL+query, nil))
+		assertStatus(t, 200, resp)
+		assertBody(t, "email is verified", resp)
+		if event := string(<-u.notifier); event != "verified: test@mail.com" {
+			t.Errorf("Unexpected event: %s", event)
+		}
 
-		req, err = http.NewRequest(http.MethodPut, ts.URL, prepareParams(t, params))
-		req.Header.Set("Authorization", "Bearer "+jwtToken)
-		resp = doRequest(req, err)
-		assertStatus(t, 401, resp)
-		assertBody(t, "unauthorized", resp)
-	})
-}
+		resp = doRequest(http.NewRequest(http.MethodGet, ts.URL+query, nil))
+		assertStatus(t, 200, resp)
+		assertBody(t, "email is already verified", resp)
 
-func TestUsers_Admin(t *testing.T) {
-	doRequest := createRequester(t)
-	su_login := os.Getenv("CAKE_ADMIN_EMAIL")
-	su_password := os.Getenv("CAKE_ADMIN_PASSWORD")
+		expired := u.verification.token("test@mail.com", time.Now().Add(-2*u.verification.ttl))
+		resp = doRequest(http.NewRequest(http.MethodGet, ts.URL+"?token="+expired, nil))
+		assertStatus(t, 422, resp)
+		assertBody(t, "verification link has expired", resp)
+	})
 
-	t.Run("banning user", func(t *testing.T) {
-		us := newTestUserService()
-		js, err := NewMyJWTService()
+	t.Run("unverified users", func(t *testing.T) {
+		u := newTestUserService()
+		register(t, u)
+		j, err := NewMyJWTService()
 		if err != nil {
 			t.FailNow()
 		}
 
-		ts := httptest.NewServer(http.HandlerFunc(us.Register))
+		login := httptest.NewServer(http.HandlerFunc(wrapJWT(j, u.JWT)))
+		defer login.Close()
 		params := map[string]interface{}{
-			"email":         "test@mail.com",
-			"password":      "somepass",
-			"favorite_cake": "somecake",
-		}
-
-		resp := doRequest(http.NewRequest(http.MethodPost, ts.URL, prepareParams(t, params)))
-		ts.Close()
-
-		ts = httptest.NewServer(http.HandlerFunc(wrapJWT(js, us.JWT)))
-		params = map[string]interface{}{
 			"email":    "test@mail.com",
 			"password": "somepass",
 		}
 
-		resp = doRequest(http.NewRequest(http.MethodPost, ts.URL, prepareParams(t, params)))
-		jwtToken := string(resp.body)
-
-		params = map[string]interface{}{
-			"email":    su_login,
-			"password": su_password,
-		}
-
-		resp = doRequest(http.NewRequest(http.MethodPost, ts.URL, prepareParams(t, params)))
-		su_jwtToken := string(resp.body)
+		u.verification.policy = unverifiedNone
+		resp := doRequest(http.NewRequest(http.MethodPost, login.URL, prepareParams(t, params)))
+		assertStatus(t, 422, resp)
+		assertBody(t, "email is not verified", resp)
 
-		ts = httptest.NewServer(http.HandlerFunc(js.jwtAuth(us.repository, us.History)))
+		u.verification.policy = unverifiedLimited
+		resp = doRequest(http.NewRequest(http.MethodPost, login.URL, prepareParams(t, params)))
+		assertStatus(t, 200, resp)
+		token := accessToken(t, resp)
 
-		url := ts.URL + "?email=test@mail.com"
-		req, err := http.NewRequest(http.MethodGet, url, nil)
-		req.Header.Set("Authorization", "Bearer "+su_jwtToken)
+		cake := httptest.NewServer(http.HandlerFunc(j.jwtAuth(u.repository, u.requireVerified(u.OverwriteCake))))
+		defer cake.Close()
+		req, err := http.NewRequest(http.MethodPut, cake.URL, prepareParams(t, map[string]interface{}{"favorite_cake": "othercake"}))
+		req.Header.Set("Authorization", "Bearer "+token)
 		resp = doRequest(req, err)
 		assertStatus(t, 422, resp)
-		assertBody(t, "user history is clear", resp)
-		ts.Close()
+		assertBody(t, "email is not verified", resp)
 
-		ts.Close()
+		resend := httptest.NewServer(http.HandlerFunc(j.jwtAuth(u.repository, u.ResendVerification)))
+		defer resend.Close()
+		req, err = http.NewRequest(http.MethodPost, resend.URL, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp = doRequest(req, err)
+		assertStatus(t, 202, resp)
+		if sent := u.mailer.(*testMailer).sent; len(sent) != 2 {
+			t.Errorf("Expected the link to be sent again, sent %d emails", len(sent))
+		}
+	})
+}
+
+func TestUsers_ResetPassword(t *testing.T) {
+	doRequest := createRequester(t)
+
+	u := newTestUserService()
+	mailer := u.mailer.(*testMailer)
+	j, err := NewMyJWTService()
+	if err != nil {
+		t.FailNow()
+	}
+
+	ts := httptest.NewServer(http.HandlerFunc(u.Register))
+	params := map[string]interface{}{
+		"email":         "test@mail.com",
+		"password":      "somepass",
+		"favorite_cake": "somecake",
+	}
+	doRequest(http.NewRequest(http.MethodPost, ts.URL, prepareParams(t, params)))
+	ts.Close()
+	<-u.notifier
+
+	login := httptest.NewServer(http.HandlerFunc(wrapJWT(j, u.JWT)))
+	defer login.Close()
+	forgot := httptest.NewServer(http.HandlerFunc(u.ForgotPassword))
+	defer forgot.Close()
+	reset := httptest.NewServer(http.HandlerFunc(u.ResetPassword))
+	defer reset.Close()
+	cake := httptest.NewServer(http.HandlerFunc(j.jwtAuth(u.repository, u.getCakeHandler, "profile:read")))
+	defer cake.Close()
+
+	params = map[string]interface{}{
+		"email":    "test@mail.com",
+		"password": "somepass",
+	}
+	token := accessToken(t, doRequest(http.NewRequest(http.MethodPost, login.URL, prepareParams(t, params))))
+
+	user, _ := u.repository.Get(context.Background(), "test@mail.com")
+	key, apiKey, err := newAPIKey(user, CreateAPIKeyParams{Name: "ci", Scopes: []string{"profile:read"}}, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = u.repository.AddAPIKey(context.Background(), key); err != nil {
+		t.Fatal(err)
+	}
+
+	unknown := doRequest(http.NewRequest(http.MethodPost, forgot.URL, prepareParams(t, map[string]interface{}{"email": "other@mail.com"})))
+	resp := doRequest(http.NewRequest(http.MethodPost, forgot.URL, prepareParams(t, map[string]interface{}{"email": "test@mail.com"})))
+	assertStatus(t, 202, resp)
+	assertStatus(t, resp.status, unknown)
+	assertBody(t, string(resp.body), unknown)
+
+	sent := mailer.wait(t, 2)
+	if sent.to != "test@mail.com" || len(mailer.sent) != 2 {
+		t.Errorf("Expected a single reset email to test@mail.com")
+	}
+	resetToken := strings.Split(sent.body, "\n\n")[2]
+
+	params = map[string]interface{}{"token": resetToken, "password": "short"}
+	resp = doRequest(http.NewRequest(http.MethodPost, reset.URL, prepareParams(t, params)))
+	assertStatus(t, 422, resp)
+	assertBody(t, "password should have at least 8 symbols", resp)
+
+	params["password"] = "newpassword"
+	resp = doRequest(http.NewRequest(http.MethodPost, reset.URL, prepareParams(t, params)))
+	assertStatus(t, 200, resp)
+	assertBody(t, "password is reset", resp)
+	if event := string(<-u.notifier); event != "password reset: test@mail.com" {
+		t.Errorf("Unexpected event: %s", event)
+	}
+
+	resp = doRequest(http.NewRequest(http.MethodPost, reset.URL, prepareParams(t, params)))
+	assertStatus(t, 422, resp)
+	assertBody(t, "reset token is not valid", resp)
+
+	req, err := http.NewRequest(http.MethodGet, cake.URL, nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp = doRequest(req, err)
+	assertStatus(t, 401, resp)
+
+	req, err = http.NewRequest(http.MethodGet, cake.URL, nil)
+	req.Header.Set("Authorization", "Bearer "+apiKey)
+	resp = doRequest(req, err)
+	assertStatus(t, 401, resp)
+	assertBody(t, "api key is not valid", resp)
+
+	params = map[string]interface{}{
+		"email":    "test@mail.com",
+		"password": "newpassword",
+	}
+	resp = doRequest(http.NewRequest(http.MethodPost, login.URL, prepareParams(t, params)))
+	assertStatus(t, 200, resp)
+}
+
+func TestUsers_TOTP(t *testing.T) {
+	doRequest := createRequester(t)
+
+	u := newTestUserService()
+	j, err := NewMyJWTService()
+	if err != nil {
+		t.FailNow()
+	}
+
+	ts := httptest.NewServer(http.HandlerFunc(u.Register))
+	params := map[string]interface{}{
+		"email":         "test@mail.com",
+		"password":      "somepass",
+		"favorite_cake": "somecake",
+	}
+	doRequest(http.NewRequest(http.MethodPost, ts.URL, prepareParams(t, params)))
+	ts.Close()
+	<-u.notifier
+
+	login := httptest.NewServer(http.HandlerFunc(wrapJWT(j, u.JWT)))
+	defer login.Close()
+	enroll := httptest.NewServer(http.HandlerFunc(j.jwtAuth(u.repository, u.EnrollTOTP)))
+	defer enroll.Close()
+	confirm := httptest.NewServer(http.HandlerFunc(j.jwtAuth(u.repository, u.ConfirmTOTP)))
+	defer confirm.Close()
+	disable := httptest.NewServer(http.HandlerFunc(j.jwtAuth(u.repository, u.DisableTOTP)))
+	defer disable.Close()
+
+	assertEvent := func() {
+		if event := string(<-u.notifier); event != "updated 2fa: test@mail.com" {
+			t.Errorf("Unexpected event: %s", event)
+		}
+	}
+
+	logIn := func(otp string) parsedResponse {
+		params := map[string]interface{}{
+			"email":    "test@mail.com",
+			"password": "somepass",
+			"otp":      otp,
+		}
+		return doRequest(http.NewRequest(http.MethodPost, login.URL, prepareParams(t, params)))
+	}
+
+	resp := logIn("")
+	assertStatus(t, 200, resp)
+	token := accessToken(t, resp)
+
+	req, err := http.NewRequest(http.MethodPost, enroll.URL, nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("If-Match", "\"1\"")
+	resp = doRequest(req, err)
+	assertStatus(t, 201, resp)
+	if tag := resp.header.Get("ETag"); tag != "\"2\"" {
+		t.Errorf("Unexpected ETag. Expected: \"2\", actual: %s", tag)
+	}
+
+	assertEvent()
+
+	enrollment := TOTPEnrollment{}
+	if err = json.Unmarshal(resp.body, &enrollment); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.HasPrefix(enrollment.URI, "otpauth://totp/cake-service:test@mail.com?") {
+		t.Errorf("Unexpected otpauth URI: %s", enrollment.URI)
+	}
+
+	key, _ := totpEncoding.DecodeString(enrollment.Secret)
+	step := time.Now().Unix() / totpPeriod
+
+	// enrolling moved the user past the version the client saw before
+	for _, url := range []string{enroll.URL, confirm.URL, disable.URL} {
+		req, err = http.NewRequest(http.MethodPost, url, prepareParams(t, map[string]interface{}{"code": totpCode(key, step)}))
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set("If-Match", "\"1\"")
+		resp = doRequest(req, err)
+		assertStatus(t, 412, resp)
+		assertBody(t, "user was modified by another request", resp)
+	}
+
+	req, err = http.NewRequest(http.MethodPost, confirm.URL, prepareParams(t, map[string]interface{}{"code": "000000"}))
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp = doRequest(req, err)
+	if totpCode(key, step) != "000000" {
+		assertStatus(t, 422, resp)
+		assertBody(t, "invalid two-factor code", resp)
+	}
+
+	req, err = http.NewRequest(http.MethodPost, confirm.URL, prepareParams(t, map[string]interface{}{"code": totpCode(key, step)}))
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp = doRequest(req, err)
+	assertStatus(t, 201, resp)
+	assertEvent()
+
+	codes := RecoveryCodesResponse{}
+	if err = json.Unmarshal(resp.body, &codes); err != nil || len(codes.RecoveryCodes) != recoveryCodes {
+		t.Fatalf("Unexpected recovery codes: %s", string(resp.body))
+	}
+
+	resp = logIn("")
+	assertStatus(t, 422, resp)
+	assertBody(t, "two-factor code is required", resp)
+
+	// the code that confirmed enrollment is used up
+	resp = logIn(totpCode(key, step))
+	assertStatus(t, 422, resp)
+	assertBody(t, "invalid two-factor code", resp)
+
+	resp = logIn(totpCode(key, step+1))
+	assertStatus(t, 200, resp)
+	assertEvent()
+
+	resp = logIn(codes.RecoveryCodes[0])
+	assertStatus(t, 200, resp)
+	assertEvent()
+
+	resp = logIn(codes.RecoveryCodes[0])
+	assertStatus(t, 422, resp)
+	assertBody(t, "invalid two-factor code", resp)
+
+	u.throttle = newLoginThrottle(2, 100, time.Minute)
+	disableWith := func(code string) parsedResponse {
+		req, err := http.NewRequest(http.MethodDelete, disable.URL, prepareParams(t, map[string]interface{}{"code": code}))
+		req.Header.Set("Authorization", "Bearer "+token)
+		return doRequest(req, err)
+	}
+
+	for i := 0; i < 2; i++ {
+		resp = disableWith(codes.RecoveryCodes[0])
+		assertStatus(t, 422, resp)
+		assertBody(t, "invalid two-factor code", resp)
+	}
+	if event := string(<-u.notifier); event != "locked: test@mail.com" {
+		t.Errorf("Unexpected event: %s", event)
+	}
+
+	resp = disableWith(codes.RecoveryCodes[1])
+	assertStatus(t, 429, resp)
+
+	u.throttle = newLoginThrottle(2, 100, time.Minute)
+	resp = disableWith(codes.RecoveryCodes[1])
+	assertStatus(t, 200, resp)
+	assertBody(t, "two-factor authentication is disabled", resp)
+	assertEvent()
+}
+
+func TestUsers_OIDC(t *testing.T) {
+	doRequest := createRequester(t)
+
+	idp := oidctest.NewServer("cake", "secret")
+	defer idp.Close()
+
+	u := newTestUserService()
+	j, err := NewMyJWTService()
+	if err != nil {
+		t.FailNow()
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/user/oidc/login", u.OIDCLogin)
+	mux.HandleFunc("/user/oidc/link", j.jwtAuth(u.repository, u.OIDCLink))
+	mux.HandleFunc("/user/oidc/callback", wrapJWT(j, u.OIDCCallback))
+	mux.HandleFunc("/user/export", j.jwtAuth(u.repository, u.Export))
+	mux.HandleFunc("/user/jwt", wrapJWT(j, u.JWT))
+	mux.HandleFunc("/user/delete", j.jwtAuth(u.repository, u.DeleteAccount))
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	u.identityProvider, err = oidc.NewProvider(context.Background(), oidc.Config{
+		Issuer:       idp.Issuer(),
+		ClientID:     "cake",
+		ClientSecret: "secret",
+		RedirectURL:  ts.URL + "/user/oidc/callback",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// login goes through the provider and back like a browser would, link
+	// does so for the user token is of
+	start := func(t *testing.T, id oidctest.Identity, req *http.Request) parsedResponse {
+		idp.SetIdentity(id)
+		jar, err := cookiejar.New(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		res, err := (&http.Client{Jar: jar}).Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+
+		body, err := io.ReadAll(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return parsedResponse{res.StatusCode, body, res.Header}
+	}
+	login := func(t *testing.T, id oidctest.Identity) parsedResponse {
+		req, err := http.NewRequest(http.MethodGet, ts.URL+"/user/oidc/login", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return start(t, id, req)
+	}
+	link := func(t *testing.T, id oidctest.Identity, token string) parsedResponse {
+		req, err := http.NewRequest(http.MethodPost, ts.URL+"/user/oidc/link", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		return start(t, id, req)
+	}
+	passwordLogin := func(t *testing.T, email string) parsedResponse {
+		params := map[string]interface{}{
+			"email":    email,
+			"password": "somepass",
+		}
+		return doRequest(http.NewRequest(http.MethodPost, ts.URL+"/user/jwt", prepareParams(t, params)))
+	}
+
+	t.Run("creating an account", func(t *testing.T) {
+		resp := login(t, oidctest.Identity{Subject: "1", Email: "new@mail.com", EmailVerified: true})
+		assertStatus(t, 200, resp)
+		if event := string(<-u.notifier); event != "registered: new@mail.com" {
+			t.Errorf("Unexpected event: %s", event)
+		}
+
+		user, err := u.repository.Get(context.Background(), "new@mail.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(user.PasswordDigest) != 0 || user.Unverified || user.Role != "user" {
+			t.Errorf("Unexpected user: %+v", user)
+		}
+
+		req, err := http.NewRequest(http.MethodGet, ts.URL+"/user/export", nil)
+		req.Header.Set("Authorization", "Bearer "+accessToken(t, resp))
+		resp = doRequest(req, err)
+		assertStatus(t, 200, resp)
+
+		export := UserExport{}
+		if err = json.Unmarshal(resp.body, &export); err != nil {
+			t.Fatal(err)
+		}
+		if len(export.Identities) != 1 || export.Identities[0].Subject != "1" || export.Identities[0].Issuer != idp.Issuer() {
+			t.Errorf("Unexpected identities: %+v", export.Identities)
+		}
+	})
+
+	t.Run("logging in again after the email changed at the provider", func(t *testing.T) {
+		resp := login(t, oidctest.Identity{Subject: "1", Email: "changed@mail.com", EmailVerified: true})
+		assertStatus(t, 200, resp)
+
+		claims, err := j.ParseJWT(accessToken(t, resp))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if claims.Email != "new@mail.com" {
+			t.Errorf("Expected to log in as the linked user, got %s", claims.Email)
+		}
+	})
+
+	t.Run("linking an existing account", func(t *testing.T) {
+		register := httptest.NewServer(http.HandlerFunc(u.Register))
+		defer register.Close()
+		params := map[string]interface{}{
+			"email":         "test@mail.com",
+			"password":      "somepass",
+			"favorite_cake": "somecake",
+		}
+		doRequest(http.NewRequest(http.MethodPost, register.URL, prepareParams(t, params)))
+		<-u.notifier
+
+		user, _ := u.repository.Get(context.Background(), "test@mail.com")
+		user.Unverified = false
+		if err := u.repository.Update(context.Background(), user.Email, user); err != nil {
+			t.Fatal(err)
+		}
+
+		// sharing the email is no proof of knowing the password
+		for _, verified := range []bool{false, true} {
+			resp := login(t, oidctest.Identity{Subject: "2", Email: "test@mail.com", EmailVerified: verified})
+			assertStatus(t, 422, resp)
+			assertBody(t, "email is already registered, log in and link the identity", resp)
+		}
+
+		resp := passwordLogin(t, "test@mail.com")
+		assertStatus(t, 200, resp)
+		token := accessToken(t, resp)
+
+		refreshed, err := j.GenerateJWTAuthenticatedAt("test@mail.com", 0, time.Time{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp = link(t, oidctest.Identity{Subject: "2", Email: "elsewhere@mail.com"}, refreshed)
+		assertStatus(t, 422, resp)
+		assertBody(t, "log in again to link an identity", resp)
+
+		resp = link(t, oidctest.Identity{Subject: "2", Email: "elsewhere@mail.com"}, token)
+		assertStatus(t, 200, resp)
+
+		id, err := u.repository.GetIdentity(context.Background(), idp.Issuer(), "2")
+		if err != nil || id.Email != "test@mail.com" {
+			t.Errorf("Expected the identity to be linked to test@mail.com: %v %v", id, err)
+		}
+
+		resp = login(t, oidctest.Identity{Subject: "2", Email: "elsewhere@mail.com"})
+		assertStatus(t, 200, resp)
+		if claims, err := j.ParseJWT(accessToken(t, resp)); err != nil || claims.Email != "test@mail.com" {
+			t.Errorf("Expected to log in as the linked user, got %+v, %v", claims, err)
+		}
+
+		resp = link(t, oidctest.Identity{Subject: "1", Email: "new@mail.com"}, token)
+		assertStatus(t, 422, resp)
+		assertBody(t, "identity is already linked", resp)
+
+		assertStatus(t, 200, passwordLogin(t, "test@mail.com"))
+	})
+
+	t.Run("taking over an unverified account", func(t *testing.T) {
+		register := httptest.NewServer(http.HandlerFunc(u.Register))
+		params := map[string]interface{}{
+			"email":         "victim@mail.com",
+			"password":      "somepass",
+			"favorite_cake": "somecake",
+		}
+		doRequest(http.NewRequest(http.MethodPost, register.URL, prepareParams(t, params)))
+		register.Close()
+		<-u.notifier
+
+		resp := passwordLogin(t, "victim@mail.com")
+		assertStatus(t, 200, resp)
+		token := accessToken(t, resp)
+
+		// whoever registered the address links an identity of their own
+		resp = link(t, oidctest.Identity{Subject: "6", Email: "squatter@mail.com"}, token)
+		assertStatus(t, 200, resp)
+
+		resp = login(t, oidctest.Identity{Subject: "4", Email: "victim@mail.com", EmailVerified: true})
+		assertStatus(t, 200, resp)
+		if event := string(<-u.notifier); event != "verified: victim@mail.com" {
+			t.Errorf("Unexpected event: %s", event)
+		}
+
+		user, err := u.repository.Get(context.Background(), "victim@mail.com")
+		if err != nil || user.Unverified || len(user.PasswordDigest) != 0 {
+			t.Errorf("Unexpected user: %+v, %v", user, err)
+		}
+
+		resp = passwordLogin(t, "victim@mail.com")
+		assertStatus(t, 422, resp)
+
+		if _, err = u.repository.GetIdentity(context.Background(), idp.Issuer(), "6"); err != errNoSuchIdentity {
+			t.Errorf("Expected the identity of the squatter to be unlinked, got %v", err)
+		}
+		resp = login(t, oidctest.Identity{Subject: "6", Email: "victim@mail.com"})
+		assertStatus(t, 422, resp)
+		assertBody(t, "email is already registered, log in and link the identity", resp)
+
+		req, err := http.NewRequest(http.MethodGet, ts.URL+"/user/export", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp = doRequest(req, err)
+		assertStatus(t, 401, resp)
+	})
+
+	t.Run("creating an account with an unverified email", func(t *testing.T) {
+		resp := login(t, oidctest.Identity{Subject: "3", Email: "other@mail.com"})
+		assertStatus(t, 200, resp)
+		<-u.notifier
+
+		user, _ := u.repository.Get(context.Background(), "other@mail.com")
+		if !user.Unverified {
+			t.Errorf("Expected the account to start unverified")
+		}
+		if sent := u.mailer.(*testMailer).last(t); sent.to != "other@mail.com" {
+			t.Errorf("Expected a verification email to other@mail.com, sent to %s", sent.to)
+		}
+	})
+
+	t.Run("deleting an account without a password", func(t *testing.T) {
+		resp := login(t, oidctest.Identity{Subject: "5", Email: "passwordless@mail.com", EmailVerified: true})
+		assertStatus(t, 200, resp)
+		<-u.notifier
+		token := accessToken(t, resp)
+
+		stale, err := j.GenerateJWTAuthenticatedAt("passwordless@mail.com", 0, time.Now().Add(-time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, c := range []struct {
+			token  string
+			status int
+			body   string
+		}{
+			{stale, 422, "log in again to delete the account"},
+			{token, 200, "account deleted"},
+		} {
+			req, err := http.NewRequest(http.MethodDelete, ts.URL+"/user/delete", prepareParams(t, map[string]interface{}{"password": ""}))
+			req.Header.Set("Authorization", "Bearer "+c.token)
+			resp = doRequest(req, err)
+			assertStatus(t, c.status, resp)
+			assertBody(t, c.body, resp)
+		}
+
+		if event := string(<-u.notifier); event != "deleted: passwordless@mail.com" {
+			t.Errorf("Unexpected event: %s", event)
+		}
+	})
+
+	t.Run("refused logins", func(t *testing.T) {
+		resp := login(t, oidctest.Identity{})
+		assertStatus(t, 422, resp)
+		assertBody(t, "identity provider refused the login: access_denied", resp)
+
+		resp = doRequest(http.NewRequest(http.MethodGet, ts.URL+"/user/oidc/callback?code=code&state=state", nil))
+		assertStatus(t, 422, resp)
+		assertBody(t, "login with the identity provider is not valid, start over", resp)
+
+		forged := u.verification.oidcCookie(oidcLogin{state: "state", nonce: "nonce", verifier: "verifier"}, time.Now())
+		req, err := http.NewRequest(http.MethodGet, ts.URL+"/user/oidc/callback?code=code&state=other", nil)
+		req.AddCookie(&http.Cookie{Name: oidcCookie, Value: forged})
+		resp = doRequest(req, err)
+		assertStatus(t, 422, resp)
+		assertBody(t, "login with the identity provider is not valid, start over", resp)
+	})
+}
+
+func TestUsers_Logout(t *testing.T) {
+	doRequest := createRequester(t)
+
+	u := newTestUserService()
+	j, err := NewMyJWTService()
+	if err != nil {
+		t.FailNow()
+	}
+
+	ts := httptest.NewServer(http.HandlerFunc(u.Register))
+	params := map[string]interface{}{
+		"email":         "test@mail.com",
+		"password":      "somepass",
+		"favorite_cake": "somecake",
+	}
+	doRequest(http.NewRequest(http.MethodPost, ts.URL, prepareParams(t, params)))
+	ts.Close()
+	<-u.notifier
+
+	login := httptest.NewServer(http.HandlerFunc(wrapJWT(j, u.JWT)))
+	defer login.Close()
+	refresh := httptest.NewServer(http.HandlerFunc(wrapJWT(j, u.Refresh)))
+	defer refresh.Close()
+	cake := httptest.NewServer(http.HandlerFunc(j.jwtAuth(u.repository, u.getCakeHandler)))
+	defer cake.Close()
+	logout := httptest.NewServer(http.HandlerFunc(j.jwtAuth(u.repository, u.Logout)))
+	defer logout.Close()
+	logoutAll := httptest.NewServer(http.HandlerFunc(j.jwtAuth(u.repository, u.LogoutAll)))
+	defer logoutAll.Close()
+
+	logIn := func() TokenResponse {
+		params := map[string]interface{}{
+			"email":    "test@mail.com",
+			"password": "somepass",
+		}
+		resp := doRequest(http.NewRequest(http.MethodPost, login.URL, prepareParams(t, params)))
+		assertStatus(t, 200, resp)
+
+		tokens := TokenResponse{}
+		if err := json.Unmarshal(resp.body, &tokens); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return tokens
+	}
+
+	withToken := func(method string, url string, token string) parsedResponse {
+		req, err := http.NewRequest(method, url, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		return doRequest(req, err)
+	}
+
+	t.Run("logging out", func(t *testing.T) {
+		first, second := logIn(), logIn()
+
+		resp := withToken(http.MethodPost, logout.URL, first.AccessToken)
+		assertStatus(t, 200, resp)
+		assertBody(t, "logged out", resp)
+
+		resp = withToken(http.MethodGet, cake.URL, first.AccessToken)
+		assertStatus(t, 401, resp)
+		assertBody(t, "token is banned", resp)
+
+		params := map[string]interface{}{"refresh_token": first.RefreshToken}
+		resp = doRequest(http.NewRequest(http.MethodPost, refresh.URL, prepareParams(t, params)))
+		assertStatus(t, 422, resp)
+		assertBody(t, "refresh token is not valid", resp)
+
+		resp = withToken(http.MethodGet, cake.URL, second.AccessToken)
+		assertStatus(t, 200, resp)
+	})
+
+	t.Run("logging out everywhere", func(t *testing.T) {
+		first, second := logIn(), logIn()
+
+		resp := withToken(http.MethodPost, logoutAll.URL, first.AccessToken)
+		assertStatus(t, 200, resp)
+		assertBody(t, "logged out everywhere", resp)
+		if event := string(<-u.notifier); event != "logged out everywhere: test@mail.com" {
+			t.Errorf("Unexpected event: %s", event)
+		}
+
+		for _, tokens := range []TokenResponse{first, second} {
+			resp = withToken(http.MethodGet, cake.URL, tokens.AccessToken)
+			assertStatus(t, 401, resp)
+			assertBody(t, "token is banned", resp)
+
+			params := map[string]interface{}{"refresh_token": tokens.RefreshToken}
+			resp = doRequest(http.NewRequest(http.MethodPost, refresh.URL, prepareParams(t, params)))
+			assertStatus(t, 422, resp)
+			assertBody(t, "refresh token is not valid", resp)
+		}
+
+		resp = withToken(http.MethodGet, cake.URL, logIn().AccessToken)
+		assertStatus(t, 200, resp)
+		assertBody(t, "somecake", resp)
+	})
+}
+
+func TestUsers_JWKS(t *testing.T) {
+	doRequest := createRequester(t)
+	t.Setenv("CAKE_JWT_KEY_DIR", t.TempDir())
+
+	j, err := NewMyJWTService()
+	if err != nil {
+		t.FailNow()
+	}
+	if _, err = j.JWTService.RotateKeys(); err != nil {
+		t.FailNow()
+	}
+
+	ts := httptest.NewServer(http.HandlerFunc(j.JWKS))
+	defer ts.Close()
+
+	resp := doRequest(http.NewRequest(http.MethodGet, ts.URL, nil))
+	assertStatus(t, 200, resp)
+
+	jwks := jwt.JWKS{}
+	if err = json.Unmarshal(resp.body, &jwks); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(jwks.Keys) != 2 || jwks.Keys[0].Kty != "RSA" || len(jwks.Keys[1].Kid) == 0 {
+		t.Errorf("Unexpected keys: %s", string(resp.body))
+	}
+}
+
+func TestUsers_APIKeys(t *testing.T) {
+	doRequest := createRequester(t)
+
+	us := newTestUserService()
+	js, err := NewMyJWTService()
+	if err != nil {
+		t.FailNow()
+	}
+
+	ts := httptest.NewServer(http.HandlerFunc(us.Register))
+	params := map[string]interface{}{
+		"email":         "test@mail.com",
+		"password":      "somepass",
+		"favorite_cake": "somecake",
+	}
+	doRequest(http.NewRequest(http.MethodPost, ts.URL, prepareParams(t, params)))
+	<-us.notifier
+	ts.Close()
+
+	ts = httptest.NewServer(http.HandlerFunc(wrapJWT(js, us.JWT)))
+	params = map[string]interface{}{
+		"email":    "test@mail.com",
+		"password": "somepass",
+	}
+	jwtToken := accessToken(t, doRequest(http.NewRequest(http.MethodPost, ts.URL, prepareParams(t, params))))
+	ts.Close()
+
+	create := httptest.NewServer(http.HandlerFunc(js.jwtAuth(us.repository, us.CreateAPIKey)))
+	defer create.Close()
+	list := httptest.NewServer(http.HandlerFunc(js.jwtAuth(us.repository, us.ListAPIKeys)))
+	defer list.Close()
+	revoke := httptest.NewServer(http.HandlerFunc(js.jwtAuth(us.repository, us.RevokeAPIKey)))
+	defer revoke.Close()
+	cake := httptest.NewServer(http.HandlerFunc(js.jwtAuth(us.repository, us.getCakeHandler, "profile:read")))
+	defer cake.Close()
+	overwrite := httptest.NewServer(http.HandlerFunc(js.jwtAuth(us.repository, us.OverwriteCake, "profile:write")))
+	defer overwrite.Close()
+	logout := httptest.NewServer(http.HandlerFunc(js.jwtAuth(us.repository, us.Logout)))
+	defer logout.Close()
+
+	request := func(method string, url string, token string, params map[string]interface{}) parsedResponse {
+		req, err := http.NewRequest(method, url, prepareParams(t, params))
+		req.Header.Set("Authorization", "Bearer "+token)
+		return doRequest(req, err)
+	}
+
+	createKey := func(t *testing.T, params map[string]interface{}) APIKeyResponse {
+		resp := request(http.MethodPost, create.URL, jwtToken, params)
+		assertStatus(t, 201, resp)
+
+		key := APIKeyResponse{}
+		if err := json.Unmarshal(resp.body, &key); err != nil {
+			t.Fatal(err)
+		}
+		return key
+	}
+
+	t.Run("refusing invalid keys", func(t *testing.T) {
+		resp := request(http.MethodPost, create.URL, jwtToken, map[string]interface{}{"name": "ci", "scopes": []string{"cake:eat"}})
+		assertStatus(t, 422, resp)
+		assertBody(t, "unknown scope \"cake:eat\"", resp)
+
+		resp = request(http.MethodPost, create.URL, jwtToken, map[string]interface{}{"name": "ci", "scopes": []string{"admin:ban"}})
+		assertStatus(t, 422, resp)
+		assertBody(t, "not enough privileges for scope \"admin:ban\"", resp)
+
+		resp = request(http.MethodPost, create.URL, jwtToken, map[string]interface{}{"name": "ci"})
+		assertStatus(t, 422, resp)
+		assertBody(t, "api key should have at least one scope", resp)
+
+		resp = request(http.MethodPost, create.URL, jwtToken, map[string]interface{}{
+			"name":       "ci",
+			"scopes":     []string{"profile:read"},
+			"expires_at": time.Now().Add(-time.Hour),
+		})
+		assertStatus(t, 422, resp)
+		assertBody(t, "api key should expire in the future", resp)
+	})
+
+	t.Run("enforcing scopes", func(t *testing.T) {
+		key := createKey(t, map[string]interface{}{"name": "ci", "scopes": []string{"profile:read"}})
+		if !strings.HasPrefix(key.Key, "cake_"+key.ID+"_") {
+			t.Errorf("Unexpected key: %s", key.Key)
+		}
+
+		resp := request(http.MethodGet, cake.URL, key.Key, nil)
+		assertStatus(t, 200, resp)
+		assertBody(t, "somecake", resp)
+
+		resp = request(http.MethodPut, overwrite.URL, key.Key, map[string]interface{}{"favorite_cake": "othercake"})
+		assertStatus(t, 403, resp)
+		assertBody(t, "api key lacks scope \"profile:write\"", resp)
+
+		resp = request(http.MethodPost, logout.URL, key.Key, nil)
+		assertStatus(t, 403, resp)
+		assertBody(t, "api keys are not accepted here", resp)
+
+		resp = request(http.MethodGet, cake.URL, key.Key+"x", nil)
+		assertStatus(t, 401, resp)
+		assertBody(t, "api key is not valid", resp)
+
+		resp = request(http.MethodGet, list.URL, key.Key, nil)
+		assertStatus(t, 403, resp)
+	})
+
+	t.Run("expiring keys", func(t *testing.T) {
+		user, _ := us.repository.Get(context.Background(), "test@mail.com")
+		expiresAt := time.Now().Add(-time.Minute)
+		key, token, err := newAPIKey(user, CreateAPIKeyParams{Name: "old", Scopes: []string{"profile:read"}, ExpiresAt: &expiresAt}, time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = us.repository.AddAPIKey(context.Background(), key); err != nil {
+			t.Fatal(err)
+		}
+
+		resp := request(http.MethodGet, cake.URL, token, nil)
+		assertStatus(t, 401, resp)
+		assertBody(t, "api key has expired", resp)
+	})
+
+	t.Run("listing and revoking keys", func(t *testing.T) {
+		key := createKey(t, map[string]interface{}{
+			"name":       "backup",
+			"scopes":     []string{"profile:read", "profile:write"},
+			"expires_at": time.Now().Add(time.Hour),
+		})
+
+		resp := request(http.MethodGet, list.URL, jwtToken, nil)
+		assertStatus(t, 200, resp)
+		if bytes.Contains(resp.body, []byte(key.Key)) || bytes.Contains(resp.body, []byte("\"key\"")) {
+			t.Errorf("Listing shows the keys: %s", resp.body)
+		}
+
+		keys := []APIKeyResponse{}
+		if err := json.Unmarshal(resp.body, &keys); err != nil {
+			t.Fatal(err)
+		}
+		if len(keys) != 2 || keys[1].ID != key.ID || keys[1].Name != "backup" || keys[1].ExpiresAt == nil {
+			t.Errorf("Unexpected keys: %+v", keys)
+		}
+		if len(keys) == 2 && (keys[0].LastUsedAt == nil || keys[1].LastUsedAt != nil) {
+			t.Errorf("Expected only the key used before to have a last use: %+v", keys)
+		}
+
+		resp = request(http.MethodPut, overwrite.URL, key.Key, map[string]interface{}{"favorite_cake": "othercake"})
+		assertStatus(t, 201, resp)
+		<-us.notifier
+
+		resp = request(http.MethodDelete, revoke.URL+"?id="+key.ID, jwtToken, nil)
+		assertStatus(t, 200, resp)
+
+		resp = request(http.MethodGet, cake.URL, key.Key, nil)
+		assertStatus(t, 401, resp)
+		assertBody(t, "api key is not valid", resp)
+
+		resp = request(http.MethodDelete, revoke.URL+"?id="+key.ID, jwtToken, nil)
+		assertStatus(t, 422, resp)
+		assertBody(t, "there is no such api key", resp)
+	})
+
+	t.Run("logging out everywhere", func(t *testing.T) {
+		logoutAll := httptest.NewServer(http.HandlerFunc(js.jwtAuth(us.repository, us.LogoutAll)))
+		defer logoutAll.Close()
+
+		key := createKey(t, map[string]interface{}{"name": "ci", "scopes": []string{"profile:read"}})
+
+		resp := request(http.MethodPost, logoutAll.URL, jwtToken, nil)
+		assertStatus(t, 200, resp)
+		<-us.notifier
+
+		resp = request(http.MethodGet, cake.URL, key.Key, nil)
+		assertStatus(t, 401, resp)
+		assertBody(t, "api key is not valid", resp)
+	})
+}
+
+func TestUsers_Update(t *testing.T) {
+	doRequest := createRequester(t)
+
+	t.Run("favorite cake updating", func(t *testing.T) {
+		us := newTestUserService()
+		js, err := NewMyJWTService()
+		if err != nil {
+			t.FailNow()
+		}
+
+		ts := httptest.NewServer(http.HandlerFunc(us.Register))
+		params := map[string]interface{}{
+			"email":         "test@mail.com",
+			"password":      "somepass",
+			"favorite_cake": "somecake",
+		}
+
+		resp := doRequest(http.NewRequest(http.MethodPost, ts.URL, prepareParams(t, params)))
+		ts.Close()
+
+		ts = httptest.NewServer(http.HandlerFunc(wrapJWT(js, us.JWT)))
+		params = map[string]interface{}{
+			"email":    "test@mail.com",
+			"password": "somepass",
+		}
+
+		resp = doRequest(http.NewRequest(http.MethodPost, ts.URL, prepareParams(t, params)))
+		jwtToken := accessToken(t, resp)
+		ts.Close()
+
+		ts = httptest.NewServer(http.HandlerFunc(js.jwtAuth(us.repository, us.OverwriteCake)))
+
+		params = map[string]interface{}{
+			"favorite_cake": "",
+		}
+		req, err := http.NewRequest(http.MethodPut, ts.URL, prepareParams(t, params))
+		req.Header.Set("Authorization", "Bearer "+jwtToken)
+		resp = doRequest(req, err)
+		assertStatus(t, 422, resp)
+		assertBody(t, "favorite cake should not be empty", resp)
+
+		params["favorite_cake"] = "some cake"
+		req, err = http.NewRequest(http.MethodPut, ts.URL, prepareParams(t, params))
+		req.Header.Set("Authorization", "Bearer "+jwtToken)
+		resp = doRequest(req, err)
+		assertStatus(t, 422, resp)
+		assertBody(t, "favorite cake should have only alphabetic characters", resp)
+
+		params["favorite_cake"] = "somecake"
+		req, err = http.NewRequest(http.MethodPut, ts.URL, prepareParams(t, params))
+		req.Header.Set("Authorization", "Bearer "+jwtToken)
+		resp = doRequest(req, err)
+		assertStatus(t, 201, resp)
+		assertBody(t, "favorite cake changed", resp)
+	})
+
+	t.Run("conditional updating", func(t *testing.T) {
+		us := newTestUserService()
+		js, err := NewMyJWTService()
+		if err != nil {
+			t.FailNow()
+		}
+
+		ts := httptest.NewServer(http.HandlerFunc(us.Register))
+		params := map[string]interface{}{
+			"email":         "test@mail.com",
+			"password":      "somepass",
+			"favorite_cake": "somecake",
+		}
+
+		resp := doRequest(http.NewRequest(http.MethodPost, ts.URL, prepareParams(t, params)))
+		ts.Close()
+
+		ts = httptest.NewServer(http.HandlerFunc(wrapJWT(js, us.JWT)))
+		params = map[string]interface{}{
+			"email":    "test@mail.com",
+			"password": "somepass",
+		}
+
+		resp = doRequest(http.NewRequest(http.MethodPost, ts.URL, prepareParams(t, params)))
+		jwtToken := accessToken(t, resp)
+		ts.Close()
+
+		ts = httptest.NewServer(http.HandlerFunc(js.jwtAuth(us.repository, us.getCakeHandler)))
+		req, err := http.NewRequest(http.MethodGet, ts.URL, nil)
+		req.Header.Set("Authorization", "Bearer "+jwtToken)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		res.Body.Close()
+		ts.Close()
+
+		tag := res.Header.Get("ETag")
+		if tag != "\"1\"" {
+			t.Errorf("Unexpected ETag. Expected: \"1\", actual: %s", tag)
+		}
+
+		ts = httptest.NewServer(http.HandlerFunc(js.jwtAuth(us.repository, us.OverwriteCake)))
+		defer ts.Close()
+
+		params = map[string]interface{}{
+			"favorite_cake": "othercake",
+		}
+		req, err = http.NewRequest(http.MethodPut, ts.URL, prepareParams(t, params))
+		req.Header.Set("Authorization", "Bearer "+jwtToken)
+		req.Header.Set("If-Match", tag)
+		resp = doRequest(req, err)
+		assertStatus(t, 201, resp)
+		assertBody(t, "favorite cake changed", resp)
+
+		params["favorite_cake"] = "lostcake"
+		req, err = http.NewRequest(http.MethodPut, ts.URL, prepareParams(t, params))
+		req.Header.Set("Authorization", "Bearer "+jwtToken)
+		req.Header.Set("If-Match", tag)
+		resp = doRequest(req, err)
+		assertStatus(t, 412, resp)
+		assertBody(t, "user was modified by another request", resp)
+
+		stale, err := us.repository.Get(context.Background(), "test@mail.com")
+		if err != nil {
+			t.FailNow()
+		}
+		stale.Version--
+		stale.FavoriteCake = "lostcake"
+		if err = us.repository.Update(context.Background(), stale.Email, stale); err != errStaleVersion {
+			t.Errorf("Unexpected error. Expected: %v, actual: %v", errStaleVersion, err)
+		}
+
+		u, err := us.repository.Get(context.Background(), "test@mail.com")
+		if err != nil || u.FavoriteCake != "othercake" || u.Version != 2 {
+			t.Errorf("Unexpected user: %v, %v", u, err)
+		}
+	})
+
+	t.Run("password updating", func(t *testing.T) {
+		us := newTestUserService()
+		js, err := NewMyJWTService()
+		if err != nil {
+			t.FailNow()
+		}
+
+		ts := httptest.NewServer(http.HandlerFunc(us.Register))
+		params := map[string]interface{}{
+			"email":         "test@mail.com",
+			"password":      "somepass",
+			"favorite_cake": "somecake",
+		}
+
+		resp := doRequest(http.NewRequest(http.MethodPost, ts.URL, prepareParams(t, params)))
+		ts.Close()
+
+		ts = httptest.NewServer(http.HandlerFunc(wrapJWT(js, us.JWT)))
+		params = map[string]interface{}{
+			"email":    "test@mail.com",
+			"password": "somepass",
+		}
+
+		resp = doRequest(http.NewRequest(http.MethodPost, ts.URL, prepareParams(t, params)))
+		jwtToken := accessToken(t, resp)
+		ts.Close()
+
+		ts = httptest.NewServer(
+			http.HandlerFunc(js.jwtAuth(us.repository, us.OverwritePassword)),
+		)
+
+		params = map[string]interface{}{
+			"password": "pass",
+		}
+		req, err := http.NewRequest(http.MethodPut, ts.URL, prepareParams(t, params))
+		req.Header.Set("Authorization", "Bearer "+jwtToken)
+		resp = doRequest(req, err)
+		assertStatus(t, 422, resp)
+		assertBody(t, "password should have at least 8 symbols", resp)
+
+		params["password"] = "somepass"
+		req, err = http.NewRequest(http.MethodPut, ts.URL, prepareParams(t, params))
+		req.Header.Set("Authorization", "Bearer "+jwtToken)
+		resp = doRequest(req, err)
+		assertStatus(t, 201, resp)
+		assertBody(t, "password changed", resp)
+
+		req, err = http.NewRequest(http.MethodPut, ts.URL, prepareParams(t, params))
+		req.Header.Set("Authorization", "Bearer "+jwtToken)
+		resp = doRequest(req, err)
+		assertStatus(t, 401, resp)
+		assertBody(t, "token is banned", resp)
+	})
+
+	t.Run("email updating", func(t *testing.T) {
+		us := newTestUserService()
+		js, err := NewMyJWTService()
+		if err != nil {
+			t.FailNow()
+		}
+
+		ts := httptest.NewServer(http.HandlerFunc(us.Register))
+		params := map[string]interface{}{
+			"email":         "test@mail.com",
+			"password":      "somepass",
+			"favorite_cake": "somecake",
+		}
+
+		resp := doRequest(http.NewRequest(http.MethodPost, ts.URL, prepareParams(t, params)))
+		ts.Close()
+
+		ts = httptest.NewServer(http.HandlerFunc(wrapJWT(js, us.JWT)))
+		params = map[string]interface{}{
+			"email":    "test@mail.com",
+			"password": "somepass",
+		}
+
+		resp = doRequest(http.NewRequest(http.MethodPost, ts.URL, prepareParams(t, params)))
+		jwtToken := accessToken(t, resp)
+		ts.Close()
+
+		ts = httptest.NewServer(
+			http.HandlerFunc(js.jwtAuth(us.repository, us.OverwriteEmail)),
+		)
+
+		params = map[string]interface{}{
+			"email": "em@il",
+		}
+		req, err := http.NewRequest(http.MethodPut, ts.URL, prepareParams(t, params))
+		req.Header.Set("Authorization", "Bearer "+jwtToken)
+		resp = doRequest(req, err)
+		assertStatus(t, 422, resp)
+		assertBody(t, "email is not valid", resp)
+
+		// the user jwtAuth loaded may be out of date by the time it is renamed
+		stale, err := us.repository.Get(context.Background(), "test@mail.com")
+		assertNoError(t, err)
+		updated := stale
+		updated.FavoriteCake = "othercake"
+		assertNoError(t, us.repository.Update(context.Background(), updated.Email, updated))
+
+		params["email"] = "test@penware.com"
+		rec := httptest.NewRecorder()
+		us.OverwriteEmail(rec, httptest.NewRequest(http.MethodPut, "/", prepareParams(t, params)), stale)
+		if rec.Code != 412 {
+			t.Errorf("Expected renaming a stale user to fail with 412, got %d", rec.Code)
+		}
+
+		req, err = http.NewRequest(http.MethodPut, ts.URL, prepareParams(t, params))
+		req.Header.Set("Authorization", "Bearer "+jwtToken)
+		resp = doRequest(req, err)
+		assertStatus(t, 201, resp)
+		assertBody(t, "email changed", resp)
+
+		if sent := us.mailer.(*testMailer).last(t); sent.to != "test@penware.com" || !strings.Contains(sent.body, "/user/verify?token=") {
+			t.Errorf("Expected a verification link sent to the new email: %+v", sent)
+		}
+
+		if user, err := us.repository.Get(context.Background(), "test@penware.com"); err != nil || !user.Unverified {
+			t.Errorf("Expected the new email to be unverified: %+v, %v", user, err)
+		}
+
+		req, err = http.NewRequest(http.MethodPut, ts.URL, prepareParams(t, params))
+		req.Header.Set("Authorization", "Bearer "+jwtToken)
+		resp = doRequest(req, err)
+		assertStatus(t, 401, resp)
+		assertBody(t, "token is banned", resp)
+	})
+
+	t.Run("email updating keeps ban history", func(t *testing.T) {
+		us := newTestUserService()
+		js, err := NewMyJWTService()
+		if err != nil {
+			t.FailNow()
+		}
+
+		ts := httptest.NewServer(http.HandlerFunc(us.Register))
+		params := map[string]interface{}{
+			"email":         "test@mail.com",
+			"password":      "somepass",
+			"favorite_cake": "somecake",
+		}
+
+		resp := doRequest(http.NewRequest(http.MethodPost, ts.URL, prepareParams(t, params)))
+		params["email"] = "taken@mail.com"
+		resp = doRequest(http.NewRequest(http.MethodPost, ts.URL, prepareParams(t, params)))
+		ts.Close()
+
+		if err = us.repository.Ban(context.Background(), "test@mail.com", "admin@mail.com", "some reason"); err != nil {
+			t.FailNow()
+		}
+		if err = us.repository.Unban(context.Background(), "test@mail.com", "admin@mail.com"); err != nil {
+			t.FailNow()
+		}
+
+		ts = httptest.NewServer(http.HandlerFunc(wrapJWT(js, us.JWT)))
+		params = map[string]interface{}{
+			"email":    "test@mail.com",
+			"password": "somepass",
+		}
+
+		resp = doRequest(http.NewRequest(http.MethodPost, ts.URL, prepareParams(t, params)))
+		jwtToken := accessToken(t, resp)
+		ts.Close()
+
+		ts = httptest.NewServer(
+			http.HandlerFunc(js.jwtAuth(us.repository, us.OverwriteEmail)),
+		)
+		defer ts.Close()
+
+		params = map[string]interface{}{
+			"email": "taken@mail.com",
+		}
+		req, err := http.NewRequest(http.MethodPut, ts.URL, prepareParams(t, params))
+		req.Header.Set("Authorization", "Bearer "+jwtToken)
+		resp = doRequest(req, err)
+		assertStatus(t, 422, resp)
+		assertBody(t, "user with given login is already present", resp)
+
+		params["email"] = "new@mail.com"
+		req, err = http.NewRequest(http.MethodPut, ts.URL, prepareParams(t, params))
+		req.Header.Set("Authorization", "Bearer "+jwtToken)
+		resp = doRequest(req, err)
+		assertStatus(t, 201, resp)
+		assertBody(t, "email changed", resp)
+
+		if _, err = us.repository.BanHistory(context.Background(), "test@mail.com"); err == nil {
+			t.Errorf("ban history is still kept under the old email")
+		}
+
+		history, err := us.repository.BanHistory(context.Background(), "new@mail.com")
+		if err != nil || len(history) != 1 {
+			t.Errorf("Unexpected ban history: %v, %v", history, err)
+		}
+	})
+
+	t.Run("re-registering a changed email", func(t *testing.T) {
+		us := newTestUserService()
+		js, err := NewMyJWTService()
+		if err != nil {
+			t.FailNow()
+		}
+
+		ts := httptest.NewServer(http.HandlerFunc(us.Register))
+		registerParams := map[string]interface{}{
+			"email":         "test@mail.com",
+			"password":      "somepass",
+			"favorite_cake": "somecake",
+		}
+
+		resp := doRequest(http.NewRequest(http.MethodPost, ts.URL, prepareParams(t, registerParams)))
+		ts.Close()
+
+		ts = httptest.NewServer(http.HandlerFunc(wrapJWT(js, us.JWT)))
+		params := map[string]interface{}{
+			"email":    "test@mail.com",
+			"password": "somepass",
+		}
+
+		resp = doRequest(http.NewRequest(http.MethodPost, ts.URL, prepareParams(t, params)))
+		jwtToken := accessToken(t, resp)
+		resp = doRequest(http.NewRequest(http.MethodPost, ts.URL, prepareParams(t, params)))
+		otherToken := accessToken(t, resp)
+		ts.Close()
+
+		ts = httptest.NewServer(
+			http.HandlerFunc(js.jwtAuth(us.repository, us.OverwriteEmail)),
+		)
+
+		params = map[string]interface{}{
+			"email": "new@mail.com",
+		}
+		req, err := http.NewRequest(http.MethodPut, ts.URL, prepareParams(t, params))
+		req.Header.Set("Authorization", "Bearer "+jwtToken)
+		resp = doRequest(req, err)
+		assertStatus(t, 201, resp)
+		ts.Close()
+
+		ts = httptest.NewServer(http.HandlerFunc(us.Register))
+		resp = doRequest(http.NewRequest(http.MethodPost, ts.URL, prepareParams(t, registerParams)))
+		assertStatus(t, 201, resp)
+		ts.Close()
+
+		ts = httptest.NewServer(http.HandlerFunc(js.jwtAuth(us.repository, us.getCakeHandler)))
+		defer ts.Close()
+
+		req, err = http.NewRequest(http.MethodGet, ts.URL, nil)
+		req.Header.Set("Authorization", "Bearer "+otherToken)
+		resp = doRequest(req, err)
+		assertStatus(t, 401, resp)
+		assertBody(t, "token is banned", resp)
+	})
+}
+
+func TestUsers_Delete(t *testing.T) {
+	doRequest := createRequester(t)
+	t.Setenv("CAKE_ADMIN_EMAIL", "superadmin@cake.test")
+	t.Setenv("CAKE_ADMIN_PASSWORD", "superpass")
+
+	t.Run("account deletion", func(t *testing.T) {
+		us := newTestUserService()
+		js, err := NewMyJWTService()
+		if err != nil {
+			t.FailNow()
+		}
+
+		ts := httptest.NewServer(http.HandlerFunc(us.Register))
+		registerParams := map[string]interface{}{
+			"email":         "test@mail.com",
+			"password":      "somepass",
+			"favorite_cake": "somecake",
+		}
+
+		resp := doRequest(http.NewRequest(http.MethodPost, ts.URL, prepareParams(t, registerParams)))
+		<-us.notifier
+		ts.Close()
+
+		if err = us.repository.Ban(context.Background(), "test@mail.com", "admin@mail.com", "some reason"); err != nil {
+			t.FailNow()
+		}
+		if err = us.repository.Unban(context.Background(), "test@mail.com", "admin@mail.com"); err != nil {
+			t.FailNow()
+		}
+
+		ts = httptest.NewServer(http.HandlerFunc(wrapJWT(js, us.JWT)))
+		params := map[string]interface{}{
+			"email":    "test@mail.com",
+			"password": "somepass",
+		}
+
+		resp = doRequest(http.NewRequest(http.MethodPost, ts.URL, prepareParams(t, params)))
+		jwtToken := accessToken(t, resp)
+		ts.Close()
+
+		ts = httptest.NewServer(http.HandlerFunc(js.jwtAuth(us.repository, us.DeleteAccount)))
+
+		params = map[string]interface{}{
+			"password": "wrongpass",
+		}
+		req, err := http.NewRequest(http.MethodDelete, ts.URL, prepareParams(t, params))
+		req.Header.Set("Authorization", "Bearer "+jwtToken)
+		resp = doRequest(req, err)
+		assertStatus(t, 422, resp)
+		assertBody(t, "invalid password", resp)
+
+		params["password"] = "somepass"
+		req, err = http.NewRequest(http.MethodDelete, ts.URL, prepareParams(t, params))
+		req.Header.Set("Authorization", "Bearer "+jwtToken)
+		resp = doRequest(req, err)
+		assertStatus(t, 200, resp)
+		assertBody(t, "account deleted", resp)
+
+		if event := string(<-us.notifier); event != "deleted: test@mail.com" {
+			t.Errorf("Unexpected event: %s", event)
+		}
+
+		req, err = http.NewRequest(http.MethodDelete, ts.URL, prepareParams(t, params))
+		req.Header.Set("Authorization", "Bearer "+jwtToken)
+		resp = doRequest(req, err)
+		assertStatus(t, 401, resp)
+		assertBody(t, "token is banned", resp)
+		ts.Close()
+
+		ts = httptest.NewServer(http.HandlerFunc(us.Register))
+		defer ts.Close()
+
+		resp = doRequest(http.NewRequest(http.MethodPost, ts.URL, prepareParams(t, registerParams)))
+		assertStatus(t, 422, resp)
+		assertBody(t, "email was recently deleted", resp)
+
+		if history, err := us.repository.BanHistory(context.Background(), "test@mail.com"); err != nil || len(history) != 1 {
+			t.Errorf("Unexpected ban history: %v, %v", history, err)
+		}
+		ts.Close()
+
+		ts = httptest.NewServer(http.HandlerFunc(wrapJWT(js, us.JWT)))
+		params = map[string]interface{}{
+			"email":    "superadmin@cake.test",
+			"password": "superpass",
+		}
+
+		resp = doRequest(http.NewRequest(http.MethodPost, ts.URL, prepareParams(t, params)))
+		su_jwtToken := accessToken(t, resp)
+		ts.Close()
+
+		ts = httptest.NewServer(http.HandlerFunc(js.jwtAuth(us.repository, us.History)))
+
+		req, err = http.NewRequest(http.MethodGet, ts.URL+"?email=test@mail.com", nil)
+		req.Header.Set("Authorization", "Bearer "+su_jwtToken)
+		resp = doRequest(req, err)
+		assertStatus(t, 200, resp)
+
+		history := []Ban{}
+		if err = json.Unmarshal(resp.body, &history); err != nil || len(history) != 1 {
+			t.Errorf("Unexpected ban history: %s", resp.body)
+		}
+
+		req, err = http.NewRequest(http.MethodGet, ts.URL+"?email=nobody@mail.com", nil)
+		req.Header.Set("Authorization", "Bearer "+su_jwtToken)
+		resp = doRequest(req, err)
+		assertStatus(t, 422, resp)
+		assertBody(t, "there is no such user to get", resp)
+	})
+
+	t.Run("re-registering after the cooldown", func(t *testing.T) {
+		t.Setenv("CAKE_DELETION_COOLDOWN", "0s")
+
+		us := newTestUserService()
+		js, err := NewMyJWTService()
+		if err != nil {
+			t.FailNow()
+		}
+
+		ts := httptest.NewServer(http.HandlerFunc(us.Register))
+		registerParams := map[string]interface{}{
+			"email":         "test@mail.com",
+			"password":      "somepass",
+			"favorite_cake": "somecake",
+		}
+
+		resp := doRequest(http.NewRequest(http.MethodPost, ts.URL, prepareParams(t, registerParams)))
+		<-us.notifier
+		ts.Close()
+
+		ts = httptest.NewServer(http.HandlerFunc(wrapJWT(js, us.JWT)))
+		params := map[string]interface{}{
+			"email":    "test@mail.com",
+			"password": "somepass",
+		}
+
+		resp = doRequest(http.NewRequest(http.MethodPost, ts.URL, prepareParams(t, params)))
+		jwtToken := accessToken(t, resp)
+		resp = doRequest(http.NewRequest(http.MethodPost, ts.URL, prepareParams(t, params)))
+		otherToken := accessToken(t, resp)
+		ts.Close()
+
+		ts = httptest.NewServer(http.HandlerFunc(js.jwtAuth(us.repository, us.DeleteAccount)))
+
+		params = map[string]interface{}{
+			"password": "somepass",
+		}
+		req, err := http.NewRequest(http.MethodDelete, ts.URL, prepareParams(t, params))
+		req.Header.Set("Authorization", "Bearer "+jwtToken)
+		resp = doRequest(req, err)
+		assertStatus(t, 200, resp)
+		<-us.notifier
+		ts.Close()
+
+		ts = httptest.NewServer(http.HandlerFunc(us.Register))
+		resp = doRequest(http.NewRequest(http.MethodPost, ts.URL, prepareParams(t, registerParams)))
+		assertStatus(t, 201, resp)
+		<-us.notifier
+		ts.Close()
+
+		ts = httptest.NewServer(http.HandlerFunc(js.jwtAuth(us.repository, us.getCakeHandler)))
+		defer ts.Close()
+
+		req, err = http.NewRequest(http.MethodGet, ts.URL, nil)
+		req.Header.Set("Authorization", "Bearer "+otherToken)
+		resp = doRequest(req, err)
+		assertStatus(t, 401, resp)
+		assertBody(t, "token is banned", resp)
+	})
+}
+
+func TestUsers_Export(t *testing.T) {
+	doRequest := createRequester(t)
+
+	t.Run("personal data export", func(t *testing.T) {
+		us := newTestUserService()
+		js, err := NewMyJWTService()
+		if err != nil {
+			t.FailNow()
+		}
+
+		ts := httptest.NewServer(http.HandlerFunc(us.Register))
+		for _, email := range []string{"test@mail.com", "other@mail.com"} {
+			params := map[string]interface{}{
+				"email":         email,
+				"password":      "somepass",
+				"favorite_cake": "somecake",
+			}
+			doRequest(http.NewRequest(http.MethodPost, ts.URL, prepareParams(t, params)))
+		}
+		ts.Close()
+
+		if err = us.repository.Ban(context.Background(), "test@mail.com", "admin@mail.com", "some reason"); err != nil {
+			t.FailNow()
+		}
+		if err = us.repository.Unban(context.Background(), "test@mail.com", "admin@mail.com"); err != nil {
+			t.FailNow()
+		}
+		if err = us.repository.Ban(context.Background(), "other@mail.com", "test@mail.com", "other reason"); err != nil {
+			t.FailNow()
+		}
+
+		ts = httptest.NewServer(http.HandlerFunc(wrapJWT(js, us.JWT)))
+		params := map[string]interface{}{
+			"email":    "test@mail.com",
+			"password": "somepass",
+		}
+
+		resp := doRequest(http.NewRequest(http.MethodPost, ts.URL, prepareParams(t, params)))
+		jwtToken := accessToken(t, resp)
+		ts.Close()
+
+		ctx := context.Background()
+		user, err := us.repository.Get(ctx, "test@mail.com")
+		assertNoError(t, err)
+		user.TOTP = TOTP{Secret: "TOTPSECRET", Enabled: true, RecoveryCodes: []string{"recoveryhash1", "recoveryhash2"}}
+		assertNoError(t, us.repository.Update(ctx, user.Email, user))
+
+		now := time.Now().Truncate(time.Second)
+		for _, k := range []APIKey{
+			{ID: "used", Email: user.Email, Name: "ci", Scopes: []string{"profile:read"}, Hash: "keyhash1", CreatedAt: now},
+			{ID: "unused", Email: user.Email, Name: "backup", Scopes: []string{"profile:write"}, Hash: "keyhash2", CreatedAt: now, ExpiresAt: now.Add(time.Hour)},
+		} {
+			assertNoError(t, us.repository.AddAPIKey(ctx, k))
+		}
+		assertNoError(t, us.repository.UseAPIKey(ctx, "used", now))
+		assertNoError(t, us.repository.LinkIdentity(ctx, Identity{Issuer: "https://idp.test", Subject: "42", Email: user.Email, LinkedAt: now}))
+
+		ts = httptest.NewServer(http.HandlerFunc(js.jwtAuth(us.repository, us.Export)))
+		defer ts.Close()
+
+		req, err := http.NewRequest(http.MethodGet, ts.URL, nil)
+		req.Header.Set("Authorization", "Bearer "+jwtToken)
+		resp = doRequest(req, err)
+		assertStatus(t, 200, resp)
+
+		if bytes.Contains(resp.body, []byte("digest")) {
+			t.Errorf("export contains password digest: %s", string(resp.body))
+		}
+
+		for _, secret := range []string{user.PasswordDigest, "TOTPSECRET", "recoveryhash", "keyhash"} {
+			if bytes.Contains(resp.body, []byte(secret)) {
+				t.Errorf("export contains %s: %s", secret, string(resp.body))
+			}
+		}
+
+		export := UserExport{}
+		if err = json.Unmarshal(resp.body, &export); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if export.User.Email != "test@mail.com" || export.User.FavoriteCake != "somecake" {
+			t.Errorf("Unexpected user: %+v", export.User)
+		}
+
+		if tf := export.User.TwoFactor; !tf.Enabled || tf.Enrolling || tf.RecoveryCodesLeft != 2 {
+			t.Errorf("Unexpected two-factor state: %+v", tf)
+		}
+
+		if len(export.APIKeys) != 2 {
+			t.Fatalf("Unexpected api keys: %+v", export.APIKeys)
+		}
+		used, unused := export.APIKeys[0], export.APIKeys[1]
+		if used.ID == "unused" {
+			used, unused = unused, used
+		}
+		if used.Name != "ci" || used.LastUsedAt == nil || !used.LastUsedAt.Equal(now) || used.ExpiresAt != nil {
+			t.Errorf("Unexpected api key: %+v", used)
+		}
+		if unused.Name != "backup" || unused.LastUsedAt != nil || unused.ExpiresAt == nil || len(unused.Scopes) != 1 {
+			t.Errorf("Unexpected api key: %+v", unused)
+		}
+
+		if len(export.BanHistory) != 1 || export.BanHistory[0].UnbannedAt == nil {
+			t.Errorf("Unexpected ban history: %+v", export.BanHistory)
+		}
+
+		if len(export.Sessions) != 1 || export.Sessions[0].ExpiresAt.IsZero() {
+			t.Errorf("Unexpected sessions: %+v", export.Sessions)
+		}
+
+		if len(export.Identities) != 1 || export.Identities[0].Subject != "42" || export.Identities[0].Issuer != "https://idp.test" {
+			t.Errorf("Unexpected identities: %+v", export.Identities)
+		}
+
+		actions := []string{}
+		for _, e := range export.Audit {
+			actions = append(actions, e.Action+" "+e.Subject+" by "+e.Actor)
+		}
+		expected := []string{
+			"ban test@mail.com by admin@mail.com",
+			"unban test@mail.com by admin@mail.com",
+			"ban other@mail.com by test@mail.com",
+		}
+		if strings.Join(actions, ", ") != strings.Join(expected, ", ") {
+			t.Errorf("Unexpected audit: %v", actions)
+		}
+	})
+}
+
+func TestUsers_Admin(t *testing.T) {
+	doRequest := createRequester(t)
+	su_login := "superadmin@cake.test"
+	su_password := "superpass"
+	t.Setenv("CAKE_ADMIN_EMAIL", su_login)
+	t.Setenv("CAKE_ADMIN_PASSWORD", su_password)
+
+	t.Run("banning user", func(t *testing.T) {
+		us := newTestUserService()
+		js, err := NewMyJWTService()
+		if err != nil {
+			t.FailNow()
+		}
+
+		ts := httptest.NewServer(http.HandlerFunc(us.Register))
+		params := map[string]interface{}{
+			"email":         "test@mail.com",
+			"password":      "somepass",
+			"favorite_cake": "somecake",
+		}
+
+		resp := doRequest(http.NewRequest(http.MethodPost, ts.URL, prepareParams(t, params)))
+		ts.Close()
+
+		ts = httptest.NewServer(http.HandlerFunc(wrapJWT(js, us.JWT)))
+		params = map[string]interface{}{
+			"email":    "test@mail.com",
+			"password": "somepass",
+		}
+
+		resp = doRequest(http.NewRequest(http.MethodPost, ts.URL, prepareParams(t, params)))
+		jwtToken := accessToken(t, resp)
+
+		params = map[string]interface{}{
+			"email":    su_login,
+			"password": su_password,
+		}
+
+		resp = doRequest(http.NewRequest(http.MethodPost, ts.URL, prepareParams(t, params)))
+		su_jwtToken := accessToken(t, resp)
+
+		ts = httptest.NewServer(http.HandlerFunc(js.jwtAuth(us.repository, us.History)))
+
+		url := ts.URL + "?email=test@mail.com"
+		req, err := http.NewRequest(http.MethodGet, url, nil)
+		req.Header.Set("Authorization", "Bearer "+su_jwtToken)
+		resp = doRequest(req, err)
+		assertStatus(t, 422, resp)
+		assertBody(t, "user history is clear", resp)
+		ts.Close()
+
+		ts.Close()
 
 		ts = httptest.NewServer(http.HandlerFunc(js.jwtAuth(us.repository, us.BanUser)))
 		defer ts.Close()
@@ -540,7 +2251,7 @@ func TestUsers_Admin(t *testing.T) {
 		}
 
 		resp = doRequest(http.NewRequest(http.MethodPost, ts.URL, prepareParams(t, params)))
-		jwtToken := string(resp.body)
+		jwtToken := accessToken(t, resp)
 
 		params = map[string]interface{}{
 			"email":    su_login,
@@ -548,7 +2259,7 @@ func TestUsers_Admin(t *testing.T) {
 		}
 
 		resp = doRequest(http.NewRequest(http.MethodPost, ts.URL, prepareParams(t, params)))
-		su_jwtToken := string(resp.body)
+		su_jwtToken := accessToken(t, resp)
 
 		ts.Close()
 
@@ -583,4 +2294,143 @@ func TestUsers_Admin(t *testing.T) {
 		assertStatus(t, 422, resp)
 		assertBody(t, "not enough privileges", resp)
 	})
+
+	t.Run("listing users", func(t *testing.T) {
+		us := newTestUserService()
+		js, err := NewMyJWTService()
+		if err != nil {
+			t.FailNow()
+		}
+
+		ts := httptest.NewServer(http.HandlerFunc(us.Register))
+		for _, email := range []string{"c@mail.com", "a@mail.com", "b@other.com"} {
+			params := map[string]interface{}{
+				"email":         email,
+				"password":      "somepass",
+				"favorite_cake": "somecake",
+			}
+			doRequest(http.NewRequest(http.MethodPost, ts.URL, prepareParams(t, params)))
+		}
+		ts.Close()
+
+		if err = us.repository.Ban(context.Background(), "b@other.com", su_login, "some reason"); err != nil {
+			t.FailNow()
+		}
+
+		ts = httptest.NewServer(http.HandlerFunc(wrapJWT(js, us.JWT)))
+		params := map[string]interface{}{
+			"email":    "a@mail.com",
+			"password": "somepass",
+		}
+		resp := doRequest(http.NewRequest(http.MethodPost, ts.URL, prepareParams(t, params)))
+		jwtToken := accessToken(t, resp)
+
+		params = map[string]interface{}{
+			"email":    su_login,
+			"password": su_password,
+		}
+		resp = doRequest(http.NewRequest(http.MethodPost, ts.URL, prepareParams(t, params)))
+		su_jwtToken := accessToken(t, resp)
+		ts.Close()
+
+		ts = httptest.NewServer(http.HandlerFunc(js.jwtAuth(us.repository, us.ListUsers)))
+		defer ts.Close()
+
+		req, err := http.NewRequest(http.MethodGet, ts.URL, nil)
+		req.Header.Set("Authorization", "Bearer "+jwtToken)
+		resp = doRequest(req, err)
+		assertStatus(t, 422, resp)
+		assertBody(t, "not enough privileges", resp)
+
+		req, err = http.NewRequest(http.MethodGet, ts.URL+"?role=user&sort=-email&limit=2", nil)
+		req.Header.Set("Authorization", "Bearer "+su_jwtToken)
+		resp = doRequest(req, err)
+		assertStatus(t, 200, resp)
+
+		page := UserListResponse{}
+		if err = json.Unmarshal(resp.body, &page); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(page.Users) != 2 || page.Users[0].Email != "c@mail.com" || page.Users[1].Email != "b@other.com" {
+			t.Errorf("Unexpected first page: %s", string(resp.body))
+		}
+
+		req, err = http.NewRequest(http.MethodGet, ts.URL+"?role=user&sort=-email&limit=2&cursor="+page.NextCursor, nil)
+		req.Header.Set("Authorization", "Bearer "+su_jwtToken)
+		resp = doRequest(req, err)
+		assertStatus(t, 200, resp)
+		assertBody(t, `{"users":[{"email":"a@mail.com","role":"user","favorite_cake":"somecake"}]}`, resp)
+
+		req, err = http.NewRequest(http.MethodGet, ts.URL+"?banned=false&email=MAIL.com", nil)
+		req.Header.Set("Authorization", "Bearer "+su_jwtToken)
+		resp = doRequest(req, err)
+		assertStatus(t, 200, resp)
+		assertBody(t, `{"users":[{"email":"a@mail.com","role":"user","favorite_cake":"somecake"},`+
+			`{"email":"c@mail.com","role":"user","favorite_cake":"somecake"}]}`, resp)
+
+		req, err = http.NewRequest(http.MethodGet, ts.URL+"?sort=password_digest", nil)
+		req.Header.Set("Authorization", "Bearer "+su_jwtToken)
+		resp = doRequest(req, err)
+		assertStatus(t, 422, resp)
+		assertBody(t, "users can not be sorted by \"password_digest\"", resp)
+	})
+
+	t.Run("rotating signing keys", func(t *testing.T) {
+		t.Setenv("CAKE_JWT_KEY_DIR", t.TempDir())
+
+		us := newTestUserService()
+		js, err := NewMyJWTService()
+		if err != nil {
+			t.FailNow()
+		}
+
+		ts := httptest.NewServer(http.HandlerFunc(us.Register))
+		params := map[string]interface{}{
+			"email":         "test@mail.com",
+			"password":      "somepass",
+			"favorite_cake": "somecake",
+		}
+		doRequest(http.NewRequest(http.MethodPost, ts.URL, prepareParams(t, params)))
+		ts.Close()
+
+		ts = httptest.NewServer(http.HandlerFunc(wrapJWT(js, us.JWT)))
+		params = map[string]interface{}{
+			"email":    "test@mail.com",
+			"password": "somepass",
+		}
+		resp := doRequest(http.NewRequest(http.MethodPost, ts.URL, prepareParams(t, params)))
+		jwtToken := accessToken(t, resp)
+
+		params = map[string]interface{}{
+			"email":    su_login,
+			"password": su_password,
+		}
+		resp = doRequest(http.NewRequest(http.MethodPost, ts.URL, prepareParams(t, params)))
+		su_jwtToken := accessToken(t, resp)
+		ts.Close()
+
+		ts = httptest.NewServer(http.HandlerFunc(js.jwtAuth(us.repository, js.RotateKeys)))
+		defer ts.Close()
+
+		req, err := http.NewRequest(http.MethodPost, ts.URL, nil)
+		req.Header.Set("Authorization", "Bearer "+jwtToken)
+		resp = doRequest(req, err)
+		assertStatus(t, 422, resp)
+		assertBody(t, "not enough privileges", resp)
+
+		req, err = http.NewRequest(http.MethodPost, ts.URL, nil)
+		req.Header.Set("Authorization", "Bearer "+su_jwtToken)
+		resp = doRequest(req, err)
+		assertStatus(t, 201, resp)
+
+		// tokens signed with the replaced key are still accepted
+		cake := httptest.NewServer(http.HandlerFunc(js.jwtAuth(us.repository, us.getCakeHandler)))
+		defer cake.Close()
+
+		req, err = http.NewRequest(http.MethodGet, cake.URL, nil)
+		req.Header.Set("Authorization", "Bearer "+jwtToken)
+		resp = doRequest(req, err)
+		assertStatus(t, 200, resp)
+		assertBody(t, "somecake", resp)
+	})
 }
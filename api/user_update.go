@@ -1,10 +1,10 @@
 package main
 
 import (
-	"crypto/md5"
 	"encoding/json"
 	"errors"
 	"net/http"
+	"strconv"
 	"strings"
 )
 
@@ -20,7 +20,45 @@ type EmailOverwriteParams struct {
 	Email string `json:"email"`
 }
 
+func etag(u User) string {
+	return "\"" + strconv.Itoa(u.Version) + "\""
+}
+
+// ifMatch reports whether the If-Match header, if any, matches the version of
+// the user the request was authenticated as.
+func ifMatch(r *http.Request, u User) bool {
+	header := r.Header.Get("If-Match")
+	if len(header) == 0 || strings.TrimSpace(header) == "*" {
+		return true
+	}
+
+	for _, tag := range strings.Split(header, ",") {
+		if strings.TrimSpace(tag) == etag(u) {
+			return true
+		}
+	}
+	return false
+}
+
+func handlePreconditionFailed(w http.ResponseWriter) {
+	w.WriteHeader(http.StatusPreconditionFailed)
+	w.Write([]byte(errStaleVersion.Error()))
+}
+
+func handleUpdateError(err error, w http.ResponseWriter) {
+	if errors.Is(err, errStaleVersion) {
+		handlePreconditionFailed(w)
+		return
+	}
+	handleError(err, w)
+}
+
 func (us *UserService) OverwriteCake(w http.ResponseWriter, r *http.Request, u User) {
+	if !ifMatch(r, u) {
+		handlePreconditionFailed(w)
+		return
+	}
+
 	params := &CakeOverwriteParams{}
 	if err := json.NewDecoder(r.Body).Decode(params); err != nil {
 		handleError(errors.New("could not read params"), w)
@@ -33,17 +71,24 @@ func (us *UserService) OverwriteCake(w http.ResponseWriter, r *http.Request, u U
 	}
 
 	u.FavoriteCake = params.FavoriteCake
-	if err := us.repository.Update(u.Email, u); err != nil {
-		handleError(err, w)
+	if err := us.repository.Update(r.Context(), u.Email, u); err != nil {
+		handleUpdateError(err, w)
 		return
 	}
 
+	u.Version++
+	w.Header().Set("ETag", etag(u))
 	w.WriteHeader(http.StatusCreated)
 	w.Write([]byte("favorite cake changed"))
 	us.notifier <- []byte("updated cake: " + u.Email)
 }
 
 func (us *UserService) OverwritePassword(w http.ResponseWriter, r *http.Request, u User) {
+	if !ifMatch(r, u) {
+		handlePreconditionFailed(w)
+		return
+	}
+
 	params := &PasswordOverwriteParams{}
 	if err := json.NewDecoder(r.Body).Decode(params); err != nil {
 		handleError(errors.New("could not read params"), w)
@@ -55,24 +100,36 @@ func (us *UserService) OverwritePassword(w http.ResponseWriter, r *http.Request,
 		return
 	}
 
-	u.PasswordDigest = string(md5.New().Sum([]byte(params.Password)))
-	if err := us.repository.Update(u.Email, u); err != nil {
+	digest, err := us.hasher.Hash(params.Password)
+	if err != nil {
 		handleError(err, w)
 		return
 	}
 
-	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
-	if err := us.repository.AddToken(token); err != nil {
+	u.PasswordDigest = digest
+	if err := us.repository.Update(r.Context(), u.Email, u); err != nil {
+		handleUpdateError(err, w)
+		return
+	}
+
+	if err := us.repository.AddToken(r.Context(), currentToken(r)); err != nil {
 		handleError(err, w)
 		return
 	}
 
+	u.Version++
+	w.Header().Set("ETag", etag(u))
 	w.WriteHeader(http.StatusCreated)
 	w.Write([]byte("password changed"))
 	us.notifier <- []byte("updated password: " + u.Email)
 }
 
 func (us *UserService) OverwriteEmail(w http.ResponseWriter, r *http.Request, u User) {
+	if !ifMatch(r, u) {
+		handlePreconditionFailed(w)
+		return
+	}
+
 	params := &EmailOverwriteParams{}
 	if err := json.NewDecoder(r.Body).Decode(params); err != nil {
 		handleError(errors.New("could not read params"), w)
@@ -84,17 +141,16 @@ func (us *UserService) OverwriteEmail(w http.ResponseWriter, r *http.Request, u
 		return
 	}
 
-	if newU, err := us.repository.Delete(u.Email); err != nil {
-		handleError(err, w)
+	if err := us.repository.Rename(r.Context(), u.Email, params.Email, u.Version, currentToken(r)); err != nil {
+		handleUpdateError(err, w)
 		return
-	} else {
-		newU.Email = params.Email
-		if err = us.repository.Add(newU.Email, newU); err != nil {
-			handleError(err, w)
-			return
-		}
 	}
 
+	// nobody proved to own the new address yet
+	us.sendVerification(r, User{Email: params.Email, Unverified: true})
+
+	u.Version++
+	w.Header().Set("ETag", etag(u))
 	w.WriteHeader(http.StatusCreated)
 	w.Write([]byte("email changed"))
 	us.notifier <- []byte("updated email: " + u.Email + " -> " + params.Email)
@@ -1,11 +1,14 @@
 package main
 
 import (
-	"crypto/md5"
+	"context"
 	"encoding/json"
 	"errors"
 	"net/http"
 	"regexp"
+	"time"
+
+	"github.com/philanton/cake-service/pkg/oidc"
 )
 
 type User struct {
@@ -13,28 +16,69 @@ type User struct {
 	PasswordDigest string
 	Role           string
 	FavoriteCake   string
+	Version        int
+	// TokenGeneration is bumped to revoke every token issued so far.
+	TokenGeneration int
+	TOTP            TOTP
+	// Unverified users registered but did not open the verification link
+	// yet. Accounts from before verification existed count as verified.
+	Unverified bool
 }
 
+var errStaleVersion = errors.New("user was modified by another request")
+
 type UserRepository interface {
-	Add(string, User) error
-	Get(string) (User, error)
-	Update(string, User) error
-	Delete(string) (User, error)
-
-	CheckNotInDB(string) error
-	AddToken(string) error
-
-	IsBanned(string) error
-	BanHistory(string) ([]Ban, error)
-	Ban(string, string, string) error
-	Unban(string, string) error
+	Add(context.Context, string, User) error
+	Get(context.Context, string) (User, error)
+	List(context.Context, UserQuery) (UserPage, error)
+	Update(context.Context, string, User) error
+	Delete(context.Context, string) (User, error)
+	Rename(context.Context, string, string, int, RevokedToken) error
+	Tombstone(context.Context, string, time.Time, RevokedToken) error
+	Tombstoned(context.Context, string) (bool, error)
+
+	CheckNotInDB(context.Context, string) error
+	AddToken(context.Context, RevokedToken) error
+	PurgeExpiredTokens(context.Context, time.Time) (int, error)
+
+	AddSession(context.Context, Session) error
+	Sessions(context.Context, string) ([]Session, error)
+
+	AddRefreshToken(context.Context, RefreshToken) error
+	GetRefreshToken(context.Context, string) (RefreshToken, error)
+	RotateRefreshToken(context.Context, string, RefreshToken) error
+	RevokeSession(context.Context, RevokedToken) error
+	RevokeAllTokens(context.Context, string) error
+
+	LinkIdentity(context.Context, Identity) error
+	TakeOver(context.Context, string, User, Identity) error
+	GetIdentity(context.Context, string, string) (Identity, error)
+	Identities(context.Context, string) ([]Identity, error)
+
+	AddAPIKey(context.Context, APIKey) error
+	GetAPIKey(context.Context, string) (APIKey, error)
+	APIKeys(context.Context, string) ([]APIKey, error)
+	UseAPIKey(context.Context, string, time.Time) error
+	RevokeAPIKey(context.Context, string, string) error
+
+	IsBanned(context.Context, string) error
+	BanHistory(context.Context, string) ([]Ban, error)
+	Ban(context.Context, string, string, string) error
+	Unban(context.Context, string, string) error
+	AuditTrail(context.Context, string) ([]AuditEntry, error)
 }
 
 type UserService struct {
-	repository UserRepository
-	notifier   chan []byte
-	reg        chan bool
-	cake       chan bool
+	repository   UserRepository
+	notifier     chan []byte
+	hasher       PasswordHasher
+	throttle     *loginThrottle
+	mailer       Mailer
+	verification emailVerification
+	reg          chan bool
+	cake         chan bool
+	// identityProvider is nil unless logging in with OpenID Connect is set up.
+	identityProvider *oidc.Provider
 }
 
 type UserRegisterParams struct {
@@ -98,18 +142,25 @@ func (u *UserService) Register(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	passwordDigest := md5.New().Sum([]byte(params.Password))
+	passwordDigest, err := u.hasher.Hash(params.Password)
+	if err != nil {
+		handleError(err, w)
+		return
+	}
+
 	newUser := User{
 		Email:          params.Email,
-		PasswordDigest: string(passwordDigest),
+		PasswordDigest: passwordDigest,
 		Role:           "user",
 		FavoriteCake:   params.FavoriteCake,
+		Unverified:     true,
 	}
 
-	if err := u.repository.Add(params.Email, newUser); err != nil {
+	if err := u.repository.Add(r.Context(), params.Email, newUser); err != nil {
 		handleError(err, w)
 		return
 	}
+	u.sendVerification(r, newUser)
 
 	w.WriteHeader(http.StatusCreated)
 	w.Write([]byte("registered"))
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultVerificationTTL = 24 * time.Hour
+	defaultResetTTL        = time.Hour
+)
+
+// unverifiedPolicy is what users who have not verified their email yet may
+// do: everything, log in but only look at their account, or nothing at all.
+type unverifiedPolicy string
+
+const (
+	unverifiedFull    unverifiedPolicy = "full"
+	unverifiedLimited unverifiedPolicy = "limited"
+	unverifiedNone    unverifiedPolicy = "none"
+)
+
+var (
+	errEmailNotVerified      = errors.New("email is not verified")
+	errInvalidVerifyToken    = errors.New("verification link is not valid")
+	errVerificationLinkStale = errors.New("verification link has expired")
+)
+
+// emailVerification signs links that prove their holder received mail sent
+// to an address: verification links and password reset links.
+type emailVerification struct {
+	secret   []byte
+	ttl      time.Duration
+	resetTTL time.Duration
+	baseURL  string
+	policy   unverifiedPolicy
+}
+
+// emailVerificationFromEnv reads CAKE_VERIFY_SECRET, CAKE_VERIFY_TTL,
+// CAKE_RESET_TTL, CAKE_PUBLIC_URL and CAKE_UNVERIFIED_POLICY.
+func emailVerificationFromEnv() (emailVerification, error) {
+	v := emailVerification{
+		secret:  []byte(os.Getenv("CAKE_VERIFY_SECRET")),
+		baseURL: strings.TrimSuffix(os.Getenv("CAKE_PUBLIC_URL"), "/"),
+		policy:  unverifiedPolicy(os.Getenv("CAKE_UNVERIFIED_POLICY")),
+	}
+
+	if len(v.secret) == 0 {
+		log.Println("CAKE_VERIFY_SECRET is not set, verification links will not survive a restart")
+		v.secret = make([]byte, 32)
+		if _, err := rand.Read(v.secret); err != nil {
+			return emailVerification{}, err
+		}
+	}
+
+	ttl, err := time.ParseDuration(os.Getenv("CAKE_VERIFY_TTL"))
+	if err != nil || ttl <= 0 {
+		ttl = defaultVerificationTTL
+	}
+	v.ttl = ttl
+
+	resetTTL, err := time.ParseDuration(os.Getenv("CAKE_RESET_TTL"))
+	if err != nil || resetTTL <= 0 {
+		resetTTL = defaultResetTTL
+	}
+	v.resetTTL = resetTTL
+
+	if len(v.baseURL) == 0 {
+		v.baseURL = "http://localhost:" + os.Getenv("API_PORT")
+	}
+
+	switch v.policy {
+	case "":
+		v.policy = unverifiedLimited
+	case unverifiedFull, unverifiedLimited, unverifiedNone:
+	default:
+		return emailVerification{}, errors.New("unknown unverified user policy \"" + string(v.policy) + "\"")
+	}
+
+	return v, nil
+}
+
+// sign binds payload to what the token is for and to binding, a value that
+// changes once the token has served its purpose.
+func (v emailVerification) sign(purpose string, payload string, binding string) string {
+	mac := hmac.New(sha256.New, v.secret)
+	mac.Write([]byte(purpose + "\x00" + payload + "\x00" + binding))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// signedToken is "<email>.<expiry>.<signature>", the email base64url
+// encoded.
+func (v emailVerification) signedToken(purpose string, email string, binding string, expiresAt time.Time) string {
+	payload := base64.RawURLEncoding.EncodeToString([]byte(email)) + "." + strconv.FormatInt(expiresAt.Unix(), 10)
+	return payload + "." + v.sign(purpose, payload, binding)
+}
+
+// tokenEmail reads the email of a signed token without checking anything,
+// so the binding can be looked up before the token is checked.
+func tokenEmail(token string) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", errInvalidVerifyToken
+	}
+
+	email, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return "", errInvalidVerifyToken
+	}
+	return string(email), nil
+}
+
+func (v emailVerification) checkSignedToken(purpose string, token string, binding string, now time.Time) error {
+	idx := strings.LastIndex(token, ".")
+	if idx < 0 {
+		return errInvalidVerifyToken
+	}
+
+	payload, signature := token[:idx], token[idx+1:]
+	if !hmac.Equal([]byte(signature), []byte(v.sign(purpose, payload, binding))) {
+		return errInvalidVerifyToken
+	}
+
+	parts := strings.Split(payload, ".")
+	if len(parts) != 2 {
+		return errInvalidVerifyToken
+	}
+
+	expiry, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return errInvalidVerifyToken
+	}
+
+	if now.Unix() > expiry {
+		return errVerificationLinkStale
+	}
+	return nil
+}
+
+func (v emailVerification) token(email string, now time.Time) string {
+	return v.signedToken("verify", email, "", now.Add(v.ttl))
+}
+
+func (v emailVerification) parse(token string, now time.Time) (string, error) {
+	email, err := tokenEmail(token)
+	if err != nil {
+		return "", err
+	}
+
+	if err = v.checkSignedToken("verify", token, "", now); err != nil {
+		return "", err
+	}
+	return email, nil
+}
+
+func (v emailVerification) link(email string, now time.Time) string {
+	return v.baseURL + "/user/verify?token=" + url.QueryEscape(v.token(email, now))
+}
+
+// sendVerification mails a verification link to u. A failure is only
+// logged: the user can ask for another link.
+func (us *UserService) sendVerification(r *http.Request, u User) {
+	body := "Hi,\n\nplease confirm your email by opening this link:\n\n" +
+		us.verification.link(u.Email, time.Now()) + "\n\n" +
+		"The link expires in " + us.verification.ttl.String() + ".\n"
+
+	if err := us.mailer.Send(r.Context(), u.Email, "Confirm your email", body); err != nil {
+		log.Println("Could not send verification email to", u.Email, err)
+	}
+}
+
+// Verify completes verification with the token of a link sent by
+// sendVerification.
+func (us *UserService) Verify(w http.ResponseWriter, r *http.Request) {
+	email, err := us.verification.parse(r.URL.Query().Get("token"), time.Now())
+	if err != nil {
+		handleError(err, w)
+		return
+	}
+
+	user, err := us.repository.Get(r.Context(), email)
+	if err != nil {
+		handleError(errInvalidVerifyToken, w)
+		return
+	}
+
+	if !user.Unverified {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("email is already verified"))
+		return
+	}
+
+	user.Unverified = false
+	if err = us.repository.Update(r.Context(), email, user); err != nil {
+		handleUpdateError(err, w)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("email is verified"))
+	us.notifier <- []byte("verified: " + email)
+}
+
+// ResendVerification mails a new link to a user who lost the first one.
+func (us *UserService) ResendVerification(w http.ResponseWriter, r *http.Request, u User) {
+	if !u.Unverified {
+		handleError(errors.New("email is already verified"), w)
+		return
+	}
+
+	us.sendVerification(r, u)
+	w.WriteHeader(http.StatusAccepted)
+	w.Write([]byte("verification email is sent"))
+}
+
+// requireVerified refuses unverified users unless the policy gives them
+// full access.
+func (us *UserService) requireVerified(h ProtectedHandler) ProtectedHandler {
+	return func(w http.ResponseWriter, r *http.Request, u User) {
+		if u.Unverified && us.verification.policy != unverifiedFull {
+			handleError(errEmailNotVerified, w)
+			return
+		}
+		h(w, r, u)
+	}
+}
@@ -0,0 +1,246 @@
+package jwt
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+const (
+	defaultJWKSRefresh = 5 * time.Minute
+	jwksFetchTimeout   = 5 * time.Second
+)
+
+// JWK is a public key as published in a JWKS, RFC 7517. RSA keys fill N
+// and E, P-256 keys X and Y, Ed25519 keys X.
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Crv string `json:"crv,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+func encodeKey(id string, key publicKey) (JWK, error) {
+	jwk := JWK{Kid: id, Use: "sig", Alg: key.method.Alg()}
+	b64 := base64.RawURLEncoding.EncodeToString
+
+	switch k := key.public.(type) {
+	case *rsa.PublicKey:
+		jwk.Kty = "RSA"
+		jwk.N = b64(k.N.Bytes())
+		jwk.E = b64(big.NewInt(int64(k.E)).Bytes())
+	case *ecdsa.PublicKey:
+		x, y := make([]byte, 32), make([]byte, 32)
+		k.X.FillBytes(x)
+		k.Y.FillBytes(y)
+		jwk.Kty, jwk.Crv, jwk.X, jwk.Y = "EC", "P-256", b64(x), b64(y)
+	case ed25519.PublicKey:
+		jwk.Kty, jwk.Crv, jwk.X = "OKP", "Ed25519", b64(k)
+	default:
+		return JWK{}, errors.New("unsupported key type")
+	}
+
+	return jwk, nil
+}
+
+func decodeKey(k JWK) (publicKey, error) {
+	malformed := errors.New("malformed key " + k.Kid)
+	b64 := base64.RawURLEncoding.DecodeString
+
+	var public crypto.PublicKey
+	switch {
+	case k.Kty == "RSA":
+		n, err := b64(k.N)
+		if err != nil {
+			return publicKey{}, malformed
+		}
+
+		e, err := b64(k.E)
+		if err != nil || len(e) == 0 || len(e) > 4 {
+			return publicKey{}, malformed
+		}
+
+		public = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	case k.Kty == "EC" && k.Crv == "P-256":
+		x, err := b64(k.X)
+		if err != nil {
+			return publicKey{}, malformed
+		}
+
+		y, err := b64(k.Y)
+		if err != nil {
+			return publicKey{}, malformed
+		}
+
+		ec := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !ec.Curve.IsOnCurve(ec.X, ec.Y) {
+			return publicKey{}, malformed
+		}
+		public = ec
+	case k.Kty == "OKP" && k.Crv == "Ed25519":
+		x, err := b64(k.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return publicKey{}, malformed
+		}
+		public = ed25519.PublicKey(x)
+	default:
+		return publicKey{}, errors.New("unsupported key type " + k.Kty)
+	}
+
+	method, err := signingMethodOf(public)
+	if err != nil {
+		return publicKey{}, err
+	}
+
+	if len(k.Alg) != 0 && k.Alg != method.Alg() {
+		return publicKey{}, errors.New("unexpected algorithm " + k.Alg + " for key " + k.Kid)
+	}
+
+	return publicKey{method: method, public: public}, nil
+}
+
+// JWKS returns the public keys that are still accepted, the signing key
+// included.
+func (s *KeySet) JWKS() JWKS {
+	s.reloadIfOlder(keyReloadInterval)
+
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	now := time.Now()
+	jwks := JWKS{Keys: []JWK{}}
+	for _, k := range s.keys {
+		if !k.retiredAt.IsZero() && now.After(k.retiredAt.Add(s.grace)) {
+			continue
+		}
+		jwk, err := encodeKey(k.id, publicKey{method: k.method, public: k.private.Public()})
+		if err != nil {
+			continue
+		}
+		jwks.Keys = append(jwks.Keys, jwk)
+	}
+	return jwks
+}
+
+// RemoteKeySet verifies tokens with the keys published at a JWKS URL. The
+// keys are fetched again every refresh, or sooner when a token names a key
+// that is not known yet. If a fetch fails the keys fetched before are kept.
+type RemoteKeySet struct {
+	url     string
+	refresh time.Duration
+	client  *http.Client
+
+	lock      sync.RWMutex
+	keys      map[string]publicKey
+	fetchedAt time.Time
+}
+
+func LoadRemoteKeySet(url string, refresh time.Duration) (*RemoteKeySet, error) {
+	s := &RemoteKeySet{
+		url:     url,
+		refresh: refresh,
+		client:  &http.Client{Timeout: jwksFetchTimeout},
+	}
+
+	if err := s.fetch(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *RemoteKeySet) fetch() error {
+	resp, err := s.client.Get(s.url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return errors.New("could not fetch keys: " + resp.Status)
+	}
+
+	jwks := JWKS{}
+	if err = json.NewDecoder(resp.Body).Decode(&jwks); err != nil {
+		return errors.New("could not read keys: " + err.Error())
+	}
+
+	keys := map[string]publicKey{}
+	for _, k := range jwks.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+
+		key, err := decodeKey(k)
+		if err != nil {
+			continue
+		}
+		keys[k.Kid] = key
+	}
+
+	s.lock.Lock()
+	s.keys = keys
+	s.fetchedAt = time.Now()
+	s.lock.Unlock()
+
+	return nil
+}
+
+func (s *RemoteKeySet) fetchIfOlder(interval time.Duration) {
+	s.lock.RLock()
+	stale := time.Since(s.fetchedAt) > interval
+	s.lock.RUnlock()
+
+	if stale {
+		_ = s.fetch()
+	}
+}
+
+func (s *RemoteKeySet) find(id string) (publicKey, bool) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	key, ok := s.keys[id]
+	return key, ok
+}
+
+func (s *RemoteKeySet) verificationKey(id string) (publicKey, error) {
+	s.fetchIfOlder(s.refresh)
+
+	key, ok := s.find(id)
+	if !ok {
+		s.fetchIfOlder(keyMissReloadInterval)
+		key, ok = s.find(id)
+	}
+
+	if !ok {
+		return publicKey{}, errors.New("unknown signing key")
+	}
+	return key, nil
+}
+
+// Parse checks the signature of token and reads it into claims, whose Valid
+// checks the time claims. What the claims say is for the caller to check.
+func (s *RemoteKeySet) Parse(token string, claims jwt.Claims) error {
+	_, err := jwt.ParseWithClaims(token, claims, keyFunc(s.verificationKey))
+	return err
+}
@@ -0,0 +1,79 @@
+package jwt
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestJWTService_JWKS(t *testing.T) {
+	config := Config{Issuer: "issuer", Audience: "audience", TTL: time.Minute, KeyGrace: time.Minute}
+
+	api := newTestJWTService(t, config)
+	var fetches int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		jwks, err := api.JWKS()
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(jwks)
+	}))
+	defer ts.Close()
+
+	remote, err := LoadRemoteKeySet(ts.URL, time.Hour)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	ws := &JWTService{remote: remote, config: config}
+
+	t.Run("verifying with published keys", func(t *testing.T) {
+		token, err := api.GenerateJWT("test@mail.com", 0)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		claims, err := ws.ParseJWT(token)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if claims.Email != "test@mail.com" {
+			t.Errorf("Unexpected email: %s", claims.Email)
+		}
+
+		if atomic.LoadInt32(&fetches) != 1 {
+			t.Errorf("Expected keys to be cached, fetched %d times", fetches)
+		}
+	})
+
+	t.Run("picking up rotated keys", func(t *testing.T) {
+		if _, err := api.RotateKeys(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		token, err := api.GenerateJWT("test@mail.com", 0)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		remote.fetchedAt = time.Now().Add(-keyMissReloadInterval)
+		if _, err = ws.ParseJWT(token); err != nil {
+			t.Errorf("Expected new key to be fetched, got %v", err)
+		}
+
+		jwks, _ := api.JWKS()
+		if len(jwks.Keys) != 2 {
+			t.Errorf("Expected replaced key to be published during its grace period, got %d keys", len(jwks.Keys))
+		}
+	})
+
+	t.Run("verifying only", func(t *testing.T) {
+		if _, err := ws.GenerateJWT("test@mail.com", 0); err != errVerifyOnly {
+			t.Errorf("Expected %v, got %v", errVerifyOnly, err)
+		}
+	})
+}
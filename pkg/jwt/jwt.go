@@ -1,31 +1,245 @@
 package jwt
 
 import (
-	"github.com/openware/rango/pkg/auth"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"os"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
 )
 
 const (
-	privKeyPath = "../keys/privkey.rsa"
-	pubKeyPath  = "../keys/pubkey.rsa"
+	defaultKeyDir = "../keys"
+
+	defaultIssuer   = "cake-service"
+	defaultAudience = "cake-service"
+	// Access tokens are short-lived, clients renew them with refresh tokens.
+	defaultTokenTTL = 15 * time.Minute
 )
 
+// Config is what every service sharing the keys has to agree on. KeyGrace
+// is how long a replaced key keeps verifying, TTL by default.
+//
+// Keys are read from PrivateKey, PEM that may hold several keys, else from
+// PrivateKeyFile, e.g. a mounted secret, else from KeyDir. Algorithm is what
+// keys generated on rotation sign with: RS256, ES256 or EdDSA.
+//
+// A service with a JWKSURL does not read keys itself: it only verifies
+// tokens, with the keys published at the URL, fetched every JWKSRefresh.
+type Config struct {
+	Issuer         string
+	Audience       string
+	TTL            time.Duration
+	KeyDir         string
+	PrivateKey     string
+	PrivateKeyFile string
+	Algorithm      string
+	KeyGrace       time.Duration
+	JWKSURL        string
+	JWKSRefresh    time.Duration
+}
+
+// ConfigFromEnv reads CAKE_JWT_ISSUER, CAKE_JWT_AUDIENCE, CAKE_JWT_TTL,
+// CAKE_JWT_KEY_DIR, CAKE_JWT_PRIVATE_KEY, CAKE_JWT_PRIVATE_KEY_FILE,
+// CAKE_JWT_ALG, CAKE_JWT_KEY_GRACE, CAKE_JWT_JWKS_URL and
+// CAKE_JWT_JWKS_REFRESH.
+func ConfigFromEnv() Config {
+	c := Config{
+		Issuer:         os.Getenv("CAKE_JWT_ISSUER"),
+		Audience:       os.Getenv("CAKE_JWT_AUDIENCE"),
+		KeyDir:         os.Getenv("CAKE_JWT_KEY_DIR"),
+		PrivateKey:     os.Getenv("CAKE_JWT_PRIVATE_KEY"),
+		PrivateKeyFile: os.Getenv("CAKE_JWT_PRIVATE_KEY_FILE"),
+		Algorithm:      os.Getenv("CAKE_JWT_ALG"),
+		JWKSURL:        os.Getenv("CAKE_JWT_JWKS_URL"),
+	}
+
+	if len(c.Issuer) == 0 {
+		c.Issuer = defaultIssuer
+	}
+
+	if len(c.Audience) == 0 {
+		c.Audience = defaultAudience
+	}
+
+	ttl, err := time.ParseDuration(os.Getenv("CAKE_JWT_TTL"))
+	if err != nil || ttl <= 0 {
+		ttl = defaultTokenTTL
+	}
+	c.TTL = ttl
+
+	if len(c.KeyDir) == 0 {
+		c.KeyDir = defaultKeyDir
+	}
+
+	grace, err := time.ParseDuration(os.Getenv("CAKE_JWT_KEY_GRACE"))
+	if err != nil || grace <= 0 {
+		grace = c.TTL
+	}
+	c.KeyGrace = grace
+
+	refresh, err := time.ParseDuration(os.Getenv("CAKE_JWT_JWKS_REFRESH"))
+	if err != nil || refresh <= 0 {
+		refresh = defaultJWKSRefresh
+	}
+	c.JWKSRefresh = refresh
+
+	return c
+}
+
+// Claims identify the user by email. Generation is the generation of the
+// user's tokens the token was issued in, bumping it revokes every older token.
+// AuthTime is when the user logged in, tokens issued without a login have
+// none.
+type Claims struct {
+	Email      string `json:"email"`
+	Generation int    `json:"gen"`
+	AuthTime   int64  `json:"auth_time,omitempty"`
+	jwt.StandardClaims
+}
+
+// JWTService signs with keys, or only verifies with remote when the keys
+// come from a JWKS URL.
 type JWTService struct {
-	keys *auth.KeyStore
+	keys   *KeySet
+	remote *RemoteKeySet
+	config Config
 }
 
+var errVerifyOnly = errors.New("keys of this service can only verify tokens")
+
 func NewJWTService() (*JWTService, error) {
-	keys, err := auth.LoadOrGenerateKeys(privKeyPath, pubKeyPath)
+	config := ConfigFromEnv()
+	if len(config.JWKSURL) != 0 {
+		remote, err := LoadRemoteKeySet(config.JWKSURL, config.JWKSRefresh)
+		if err != nil {
+			return nil, err
+		}
+		return &JWTService{remote: remote, config: config}, nil
+	}
+
+	keys, err := LoadKeySet(config)
 	if err != nil {
 		return nil, err
 	}
 
-	return &JWTService{keys: keys}, nil
+	return &JWTService{keys: keys, config: config}, nil
 }
 
-func (j *JWTService) GenerateJWT(email string) (string, error) {
-	return auth.ForgeToken("empty", email, "empty", 0, j.keys.PrivateKey, nil)
+// RotateKeys starts signing with a new key, see KeySet.Rotate.
+func (j *JWTService) RotateKeys() (string, error) {
+	if j.keys == nil {
+		return "", errVerifyOnly
+	}
+	return j.keys.Rotate()
 }
 
-func (j *JWTService) ParseJWT(jwt string) (auth.Auth, error) {
-	return auth.ParseAndValidate(jwt, j.keys.PublicKey)
+// JWKS publishes the keys tokens of this service can be verified with.
+func (j *JWTService) JWKS() (JWKS, error) {
+	if j.keys == nil {
+		return JWKS{}, errVerifyOnly
+	}
+	return j.keys.JWKS(), nil
+}
+
+func newTokenID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+// GenerateJWT issues a token to a user who just logged in.
+func (j *JWTService) GenerateJWT(email string, generation int) (string, error) {
+	return j.GenerateJWTAuthenticatedAt(email, generation, time.Now())
+}
+
+// GenerateJWTAuthenticatedAt issues a token to a user who logged in at
+// authTime, a zero authTime for one issued without a login.
+func (j *JWTService) GenerateJWTAuthenticatedAt(email string, generation int, authTime time.Time) (string, error) {
+	id, err := newTokenID()
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	claims := Claims{
+		Email:      email,
+		Generation: generation,
+		StandardClaims: jwt.StandardClaims{
+			Id:        id,
+			Subject:   email,
+			Issuer:    j.config.Issuer,
+			Audience:  j.config.Audience,
+			IssuedAt:  now.Unix(),
+			NotBefore: now.Unix(),
+			ExpiresAt: now.Add(j.config.TTL).Unix(),
+		},
+	}
+	if !authTime.IsZero() {
+		claims.AuthTime = authTime.Unix()
+	}
+
+	if j.keys == nil {
+		return "", errVerifyOnly
+	}
+
+	key, err := j.keys.signingKey()
+	if err != nil {
+		return "", err
+	}
+
+	token := jwt.NewWithClaims(key.method, claims)
+	token.Header["kid"] = key.id
+	return token.SignedString(key.private)
+}
+
+// keyFunc looks the key up by the kid of the token, tokens without one are
+// of the legacy key.
+func keyFunc(find func(string) (publicKey, error)) jwt.Keyfunc {
+	return func(t *jwt.Token) (interface{}, error) {
+		kid, ok := t.Header["kid"].(string)
+		if !ok {
+			kid = legacyKeyID
+		}
+
+		key, err := find(kid)
+		if err != nil {
+			return nil, err
+		}
+
+		// the algorithm comes from the key, never from the token
+		if t.Method.Alg() != key.method.Alg() {
+			return nil, errors.New("unexpected signing method")
+		}
+		return key.public, nil
+	}
+}
+
+// ParseJWT checks the signature, the time claims, the issuer and the
+// audience of token.
+func (j *JWTService) ParseJWT(token string) (Claims, error) {
+	find := j.keys.verificationKey
+	if j.remote != nil {
+		find = j.remote.verificationKey
+	}
+
+	claims := Claims{}
+	_, err := jwt.ParseWithClaims(token, &claims, keyFunc(find))
+	if err != nil {
+		return Claims{}, err
+	}
+
+	if !claims.VerifyIssuer(j.config.Issuer, true) {
+		return Claims{}, errors.New("unexpected token issuer")
+	}
+
+	if !claims.VerifyAudience(j.config.Audience, true) {
+		return Claims{}, errors.New("unexpected token audience")
+	}
+
+	return claims, nil
 }
@@ -0,0 +1,212 @@
+package jwt
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+func newTestJWTService(t *testing.T, c Config) *JWTService {
+	if len(c.KeyDir) == 0 {
+		c.KeyDir = t.TempDir()
+	}
+
+	keys, err := LoadKeySet(c)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	return &JWTService{keys: keys, config: c}
+}
+
+func TestJWTService(t *testing.T) {
+	config := Config{Issuer: "issuer", Audience: "audience", TTL: time.Minute, KeyGrace: time.Minute}
+
+	t.Run("standard claims", func(t *testing.T) {
+		j := newTestJWTService(t, config)
+
+		token, err := j.GenerateJWT("test@mail.com", 3)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		claims, err := j.ParseJWT(token)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if claims.Email != "test@mail.com" || claims.Subject != "test@mail.com" || claims.Generation != 3 {
+			t.Errorf("Unexpected claims: %+v", claims)
+		}
+
+		if claims.Issuer != "issuer" || claims.Audience != "audience" || len(claims.Id) == 0 {
+			t.Errorf("Unexpected claims: %+v", claims)
+		}
+
+		if claims.NotBefore != claims.IssuedAt || claims.ExpiresAt != claims.IssuedAt+60 || claims.AuthTime != claims.IssuedAt {
+			t.Errorf("Unexpected time claims: %+v", claims)
+		}
+
+		refreshed, err := j.GenerateJWTAuthenticatedAt("test@mail.com", 3, time.Time{})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if refreshedClaims, _ := j.ParseJWT(refreshed); refreshedClaims.AuthTime != 0 {
+			t.Errorf("Expected no auth_time without a login, got %d", refreshedClaims.AuthTime)
+		}
+
+		other, err := j.GenerateJWT("test@mail.com", 3)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if otherClaims, _ := j.ParseJWT(other); otherClaims.Id == claims.Id {
+			t.Errorf("Expected unique jti, got %s twice", claims.Id)
+		}
+	})
+
+	t.Run("rejected tokens", func(t *testing.T) {
+		j := newTestJWTService(t, config)
+
+		for name, c := range map[string]Config{
+			"other issuer":   {Issuer: "other", Audience: config.Audience, TTL: time.Minute},
+			"other audience": {Issuer: config.Issuer, Audience: "other", TTL: time.Minute},
+			"expired":        {Issuer: config.Issuer, Audience: config.Audience, TTL: -time.Minute},
+		} {
+			forger := &JWTService{keys: j.keys, config: c}
+			token, err := forger.GenerateJWT("test@mail.com", 0)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if _, err = j.ParseJWT(token); err == nil {
+				t.Errorf("Expected token with %s to be rejected", name)
+			}
+		}
+
+		token, err := newTestJWTService(t, config).GenerateJWT("test@mail.com", 0)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if _, err = j.ParseJWT(token); err == nil {
+			t.Errorf("Expected token signed with another key to be rejected")
+		}
+	})
+}
+
+func TestJWTService_KeyRotation(t *testing.T) {
+	config := Config{Issuer: "issuer", Audience: "audience", TTL: time.Minute, KeyGrace: time.Minute}
+
+	t.Run("rotating keys", func(t *testing.T) {
+		j := newTestJWTService(t, config)
+
+		old, err := j.GenerateJWT("test@mail.com", 0)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		kid, err := j.RotateKeys()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		token, err := j.GenerateJWT("test@mail.com", 0)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		parsed, _ := jwt.Parse(token, nil)
+		if parsed == nil || parsed.Header["kid"] != kid {
+			t.Errorf("Expected token to be signed with %s", kid)
+		}
+
+		for _, tok := range []string{old, token} {
+			if _, err = j.ParseJWT(tok); err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+		}
+
+		// once the grace period is over the replaced key stops verifying
+		j.keys.grace = 0
+		if _, err = j.ParseJWT(old); err == nil {
+			t.Errorf("Expected token signed with retired key to be rejected")
+		}
+
+		if _, err = j.RotateKeys(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		// the key replaced just now stays, the one retired before is gone
+		files, _ := filepath.Glob(filepath.Join(j.config.KeyDir, "*.pem"))
+		if len(files) != 2 {
+			t.Errorf("Expected retired keys to be removed, got %v", files)
+		}
+	})
+
+	t.Run("sharing keys between services", func(t *testing.T) {
+		api := newTestJWTService(t, config)
+		ws, err := LoadKeySet(api.config)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		verifier := &JWTService{keys: ws, config: config}
+
+		if _, err = api.RotateKeys(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		token, err := api.GenerateJWT("test@mail.com", 0)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		ws.lastReload = time.Now().Add(-keyMissReloadInterval)
+		if _, err = verifier.ParseJWT(token); err != nil {
+			t.Errorf("Expected new key to be picked up, got %v", err)
+		}
+	})
+
+	t.Run("legacy key", func(t *testing.T) {
+		dir := t.TempDir()
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		data := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+		if err = os.WriteFile(filepath.Join(dir, legacyKeyFile), data, 0600); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		claims := Claims{Email: "test@mail.com", StandardClaims: jwt.StandardClaims{
+			Issuer:    config.Issuer,
+			Audience:  config.Audience,
+			ExpiresAt: time.Now().Add(time.Minute).Unix(),
+		}}
+		legacy, err := jwt.NewWithClaims(jwt.SigningMethodRS256, claims).SignedString(key)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		config := config
+		config.KeyDir = dir
+		j := newTestJWTService(t, config)
+
+		if _, err = j.RotateKeys(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if _, err = j.ParseJWT(legacy); err != nil {
+			t.Errorf("Expected token without kid to verify with the legacy key, got %v", err)
+		}
+	})
+}
@@ -0,0 +1,224 @@
+package jwt
+
+import (
+	"crypto"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+const (
+	keyFileExt    = ".pem"
+	kidTimeLayout = "20060102T150405.000000000Z"
+
+	// legacyKeyID is the key tokens without a kid header were signed with.
+	legacyKeyID   = "privkey"
+	legacyKeyFile = "privkey.rsa"
+
+	keyReloadInterval = time.Minute
+	// an unknown kid reloads sooner, but not on every garbage token
+	keyMissReloadInterval = time.Second
+)
+
+type signingKey struct {
+	id        string
+	createdAt time.Time
+	retiredAt time.Time
+	method    jwt.SigningMethod
+	private   crypto.Signer
+}
+
+// publicKey is what a token signed by a key is verified with.
+type publicKey struct {
+	method jwt.SigningMethod
+	public crypto.PublicKey
+}
+
+// KeySet holds the signing keys of a keySource. The newest key signs, older
+// ones keep verifying for a grace period after they were replaced so that
+// rotating does not log anybody out.
+//
+// Several processes may share a key directory: each of them picks up keys
+// added by the others on the next reload.
+type KeySet struct {
+	source    keySource
+	algorithm string
+	grace     time.Duration
+
+	lock       sync.RWMutex
+	keys       []signingKey
+	lastReload time.Time
+}
+
+// LoadKeySet reads the keys from the source configured in c. A key directory
+// without keys gets its first one generated.
+func LoadKeySet(c Config) (*KeySet, error) {
+	algorithm := c.Algorithm
+	if len(algorithm) == 0 {
+		algorithm = defaultAlgorithm
+	}
+	if _, ok := keyGenerators[algorithm]; !ok {
+		return nil, errors.New("unsupported signing algorithm \"" + algorithm + "\"")
+	}
+
+	s := &KeySet{source: newKeySource(c), algorithm: algorithm, grace: c.KeyGrace}
+	if err := s.reload(); err != nil {
+		return nil, err
+	}
+
+	if len(s.keys) == 0 {
+		if _, err := s.Rotate(); err != nil {
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+func newKeyID(now time.Time) (string, error) {
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return "", err
+	}
+	return now.UTC().Format(kidTimeLayout) + "-" + hex.EncodeToString(suffix), nil
+}
+
+// keyCreatedAt is encoded in the kid of generated keys. Other keys, the
+// legacy one included, come first.
+func keyCreatedAt(id string) time.Time {
+	created, err := time.Parse(kidTimeLayout, strings.SplitN(id, "-", 2)[0])
+	if err != nil {
+		return time.Time{}
+	}
+	return created
+}
+
+func (s *KeySet) reload() error {
+	keys, err := s.source.load()
+	if err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	s.keys = keys
+	s.lastReload = time.Now()
+	s.lock.Unlock()
+
+	return nil
+}
+
+// Rotate generates a new signing key, keeps the current one for verifying
+// only and forgets keys whose grace period is over. It returns the new kid.
+// Keys that come from the environment or a key file are rotated by whoever
+// provides them.
+func (s *KeySet) Rotate() (string, error) {
+	source, ok := s.source.(writableKeySource)
+	if !ok {
+		return "", errors.New("keys that are not in a key directory can not be rotated")
+	}
+
+	private, err := keyGenerators[s.algorithm]()
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	id, err := newKeyID(now)
+	if err != nil {
+		return "", err
+	}
+
+	k, err := newSigningKey(id, private)
+	if err != nil {
+		return "", err
+	}
+
+	if err = source.store(k); err != nil {
+		return "", err
+	}
+
+	if err = s.reload(); err != nil {
+		return "", err
+	}
+
+	s.lock.RLock()
+	expired := []string{}
+	for _, k := range s.keys {
+		if !k.retiredAt.IsZero() && now.After(k.retiredAt.Add(s.grace)) {
+			expired = append(expired, k.id)
+		}
+	}
+	s.lock.RUnlock()
+
+	for _, id := range expired {
+		if err = source.remove(id); err != nil {
+			return "", err
+		}
+	}
+
+	if len(expired) != 0 {
+		return id, s.reload()
+	}
+	return id, nil
+}
+
+func (s *KeySet) reloadIfOlder(interval time.Duration) {
+	s.lock.RLock()
+	stale := time.Since(s.lastReload) > interval
+	s.lock.RUnlock()
+
+	if stale {
+		// keep the keys we have if the source can not be read right now
+		_ = s.reload()
+	}
+}
+
+func (s *KeySet) signingKey() (signingKey, error) {
+	s.reloadIfOlder(keyReloadInterval)
+
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	if len(s.keys) == 0 {
+		return signingKey{}, errors.New("there is no signing key")
+	}
+	return s.keys[len(s.keys)-1], nil
+}
+
+func (s *KeySet) find(id string) (signingKey, bool) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	for _, k := range s.keys {
+		if k.id == id {
+			return k, true
+		}
+	}
+	return signingKey{}, false
+}
+
+// verificationKey returns the public key of id if it is still accepted. An
+// unknown kid may belong to a key another process just added, so it triggers
+// a reload.
+func (s *KeySet) verificationKey(id string) (publicKey, error) {
+	k, ok := s.find(id)
+	if !ok {
+		s.reloadIfOlder(keyMissReloadInterval)
+		k, ok = s.find(id)
+	}
+
+	if !ok {
+		return publicKey{}, errors.New("unknown signing key")
+	}
+
+	if !k.retiredAt.IsZero() && time.Now().After(k.retiredAt.Add(s.grace)) {
+		return publicKey{}, errors.New("signing key was retired")
+	}
+
+	return publicKey{method: k.method, public: k.private.Public()}, nil
+}
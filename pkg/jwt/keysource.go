@@ -0,0 +1,260 @@
+package jwt
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+const defaultAlgorithm = "RS256"
+
+// keyGenerators are the algorithms new keys can be made for.
+var keyGenerators = map[string]func() (crypto.Signer, error){
+	"RS256": func() (crypto.Signer, error) {
+		return rsa.GenerateKey(rand.Reader, 2048)
+	},
+	"ES256": func() (crypto.Signer, error) {
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	},
+	"EdDSA": func() (crypto.Signer, error) {
+		_, private, err := ed25519.GenerateKey(rand.Reader)
+		return private, err
+	},
+}
+
+// signingMethodOf tells which algorithm a key signs with from its type.
+func signingMethodOf(key crypto.PublicKey) (jwt.SigningMethod, error) {
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		return jwt.SigningMethodRS256, nil
+	case *ecdsa.PublicKey:
+		if k.Curve != elliptic.P256() {
+			return nil, errors.New("only P-256 ECDSA keys are supported")
+		}
+		return jwt.SigningMethodES256, nil
+	case ed25519.PublicKey:
+		return signingMethodEdDSA, nil
+	default:
+		return nil, errors.New("unsupported key type")
+	}
+}
+
+func parsePrivateKey(block *pem.Block) (crypto.Signer, error) {
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		signer, ok := key.(crypto.Signer)
+		if !ok {
+			return nil, errors.New("unsupported key type")
+		}
+		return signer, nil
+	default:
+		return nil, errors.New("unexpected PEM block " + block.Type)
+	}
+}
+
+func newSigningKey(id string, private crypto.Signer) (signingKey, error) {
+	method, err := signingMethodOf(private.Public())
+	if err != nil {
+		return signingKey{}, err
+	}
+	return signingKey{id: id, createdAt: keyCreatedAt(id), method: method, private: private}, nil
+}
+
+// keyThumbprint names keys that come without a name, the same way in every
+// process that loads them.
+func keyThumbprint(key crypto.PublicKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:8]), nil
+}
+
+// keySource is where a KeySet reads its keys from, oldest first.
+type keySource interface {
+	load() ([]signingKey, error)
+}
+
+// writableKeySource can store new keys too, which lets a KeySet rotate.
+type writableKeySource interface {
+	keySource
+	store(k signingKey) error
+	remove(id string) error
+}
+
+// newKeySource picks the source configured in c: PEM in the environment,
+// then a key file such as a mounted secret, then a key directory.
+func newKeySource(c Config) keySource {
+	switch {
+	case len(c.PrivateKey) != 0:
+		return pemSource{name: "CAKE_JWT_PRIVATE_KEY", data: []byte(c.PrivateKey)}
+	case len(c.PrivateKeyFile) != 0:
+		return fileSource{path: c.PrivateKeyFile}
+	default:
+		return dirSource{dir: c.KeyDir}
+	}
+}
+
+// pemSource holds one or more PEM encoded keys, the last one signs. Keys are
+// named by their thumbprint and never retire: rotating them is a matter of
+// redeploying with the new key appended and dropping the old one later.
+type pemSource struct {
+	name string
+	data []byte
+}
+
+func (s pemSource) load() ([]signingKey, error) {
+	keys := []signingKey{}
+	rest := s.data
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+
+		private, err := parsePrivateKey(block)
+		if err != nil {
+			return nil, errors.New("could not read key from " + s.name + ": " + err.Error())
+		}
+
+		id, err := keyThumbprint(private.Public())
+		if err != nil {
+			return nil, err
+		}
+
+		k, err := newSigningKey(id, private)
+		if err != nil {
+			return nil, errors.New("could not read key from " + s.name + ": " + err.Error())
+		}
+		keys = append(keys, k)
+	}
+
+	if len(keys) == 0 {
+		return nil, errors.New("there are no keys in " + s.name)
+	}
+	return keys, nil
+}
+
+// fileSource is a pemSource read from a file on every reload, so an updated
+// secret is picked up without a restart.
+type fileSource struct {
+	path string
+}
+
+func (s fileSource) load() ([]signingKey, error) {
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		return nil, err
+	}
+	return pemSource{name: s.path, data: data}.load()
+}
+
+// dirSource keeps one key per file, named after its kid. The kid carries
+// the creation time, so every process sharing the directory agrees on the
+// order of keys and on when each of them was replaced.
+type dirSource struct {
+	dir string
+}
+
+func (s dirSource) load() ([]signingKey, error) {
+	files, err := filepath.Glob(filepath.Join(s.dir, "*"+keyFileExt))
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err = os.Stat(filepath.Join(s.dir, legacyKeyFile)); err == nil {
+		files = append(files, filepath.Join(s.dir, legacyKeyFile))
+	}
+
+	keys := []signingKey{}
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, errors.New("could not read key " + file + ": no PEM data")
+		}
+
+		private, err := parsePrivateKey(block)
+		if err != nil {
+			return nil, errors.New("could not read key " + file + ": " + err.Error())
+		}
+
+		id := strings.TrimSuffix(filepath.Base(file), keyFileExt)
+		if filepath.Base(file) == legacyKeyFile {
+			id = legacyKeyID
+		}
+
+		k, err := newSigningKey(id, private)
+		if err != nil {
+			return nil, errors.New("could not read key " + file + ": " + err.Error())
+		}
+		keys = append(keys, k)
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		if !keys[i].createdAt.Equal(keys[j].createdAt) {
+			return keys[i].createdAt.Before(keys[j].createdAt)
+		}
+		return keys[i].id < keys[j].id
+	})
+
+	for i := 0; i < len(keys)-1; i++ {
+		keys[i].retiredAt = keys[i+1].createdAt
+	}
+
+	return keys, nil
+}
+
+func (s dirSource) store(k signingKey) error {
+	if err := os.MkdirAll(s.dir, 0700); err != nil {
+		return err
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(k.private)
+	if err != nil {
+		return err
+	}
+
+	data := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	return os.WriteFile(filepath.Join(s.dir, k.id+keyFileExt), data, 0600)
+}
+
+func (s dirSource) remove(id string) error {
+	file := filepath.Join(s.dir, id+keyFileExt)
+	if id == legacyKeyID {
+		file = filepath.Join(s.dir, legacyKeyFile)
+	}
+
+	if err := os.Remove(file); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+package jwt
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+func encodeTestKey(t *testing.T, key crypto.Signer) string {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+}
+
+func generateTestKey(t *testing.T, algorithm string) crypto.Signer {
+	key, err := keyGenerators[algorithm]()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return key
+}
+
+func TestJWTService_Algorithms(t *testing.T) {
+	for _, algorithm := range []string{"RS256", "ES256", "EdDSA"} {
+		t.Run(algorithm, func(t *testing.T) {
+			config := Config{Issuer: "issuer", Audience: "audience", TTL: time.Minute, KeyGrace: time.Minute, Algorithm: algorithm}
+			api := newTestJWTService(t, config)
+
+			token, err := api.GenerateJWT("test@mail.com", 0)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			parsed, _ := jwt.Parse(token, nil)
+			if parsed == nil || parsed.Header["alg"] != algorithm {
+				t.Errorf("Expected token to be signed with %s", algorithm)
+			}
+
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				jwks, _ := api.JWKS()
+				json.NewEncoder(w).Encode(jwks)
+			}))
+			defer ts.Close()
+
+			remote, err := LoadRemoteKeySet(ts.URL, time.Hour)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			ws := &JWTService{remote: remote, config: config}
+
+			for _, j := range []*JWTService{api, ws} {
+				if _, err = j.ParseJWT(token); err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+			}
+		})
+	}
+
+	t.Run("unknown algorithm", func(t *testing.T) {
+		if _, err := LoadKeySet(Config{KeyDir: t.TempDir(), Algorithm: "HS256"}); err == nil {
+			t.Errorf("Expected HS256 to be refused")
+		}
+	})
+}
+
+func TestJWTService_KeySources(t *testing.T) {
+	config := Config{Issuer: "issuer", Audience: "audience", TTL: time.Minute}
+	ec := generateTestKey(t, "ES256")
+	ed := generateTestKey(t, "EdDSA")
+
+	t.Run("PEM in the environment", func(t *testing.T) {
+		config := config
+		config.PrivateKey = encodeTestKey(t, ec) + encodeTestKey(t, ed)
+		j := newTestJWTService(t, config)
+
+		token, err := j.GenerateJWT("test@mail.com", 0)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		parsed, _ := jwt.Parse(token, nil)
+		if parsed == nil || parsed.Header["alg"] != "EdDSA" {
+			t.Errorf("Expected the last key to sign")
+		}
+
+		if _, err = j.RotateKeys(); err == nil {
+			t.Errorf("Expected keys from the environment not to be rotated")
+		}
+
+		jwks, _ := j.JWKS()
+		if len(jwks.Keys) != 2 {
+			t.Errorf("Expected both keys to be published, got %d", len(jwks.Keys))
+		}
+
+		// a token has to be signed with the algorithm of the key it names
+		ecKid, _ := keyThumbprint(ec.Public())
+		forged := jwt.NewWithClaims(signingMethodEdDSA, Claims{StandardClaims: jwt.StandardClaims{
+			Issuer:    config.Issuer,
+			Audience:  config.Audience,
+			ExpiresAt: time.Now().Add(time.Minute).Unix(),
+		}})
+		forged.Header["kid"] = ecKid
+		signed, err := forged.SignedString(ed)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if _, err = j.ParseJWT(signed); err == nil {
+			t.Errorf("Expected token signed with another algorithm than its key to be rejected")
+		}
+	})
+
+	t.Run("mounted secret", func(t *testing.T) {
+		file := filepath.Join(t.TempDir(), "tls.key")
+		if err := os.WriteFile(file, []byte(encodeTestKey(t, ec)), 0600); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		config := config
+		config.PrivateKeyFile = file
+		j := newTestJWTService(t, config)
+
+		token, err := j.GenerateJWT("test@mail.com", 0)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if _, err = j.ParseJWT(token); err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+
+		config.PrivateKeyFile = filepath.Join(t.TempDir(), "missing.key")
+		if _, err = LoadKeySet(config); err == nil {
+			t.Errorf("Expected a missing key file to be an error")
+		}
+	})
+}
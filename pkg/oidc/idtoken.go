@@ -0,0 +1,106 @@
+package oidc
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// IDClaims are the claims of an ID token that identify the user. Subject
+// is what stays the same for a user of the provider, the email may change.
+type IDClaims struct {
+	Issuer          string   `json:"iss"`
+	Subject         string   `json:"sub"`
+	Audience        audience `json:"aud"`
+	AuthorizedParty string   `json:"azp,omitempty"`
+	ExpiresAt       int64    `json:"exp"`
+	IssuedAt        int64    `json:"iat"`
+	Nonce           string   `json:"nonce,omitempty"`
+	Email           string   `json:"email,omitempty"`
+	EmailVerified   bool     `json:"email_verified,omitempty"`
+}
+
+// audience is a single string or a list of them.
+type audience []string
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var one string
+	if err := json.Unmarshal(data, &one); err == nil {
+		*a = audience{one}
+		return nil
+	}
+
+	var many []string
+	if err := json.Unmarshal(data, &many); err != nil {
+		return errors.New("aud is neither a string nor a list")
+	}
+	*a = many
+	return nil
+}
+
+func (a audience) MarshalJSON() ([]byte, error) {
+	if len(a) == 1 {
+		return json.Marshal(a[0])
+	}
+	return json.Marshal([]string(a))
+}
+
+func (a audience) contains(clientID string) bool {
+	for _, aud := range a {
+		if aud == clientID {
+			return true
+		}
+	}
+	return false
+}
+
+// Valid checks the time claims, for jwt.ParseWithClaims.
+func (c IDClaims) Valid() error {
+	return c.validAt(time.Now())
+}
+
+func (c IDClaims) validAt(now time.Time) error {
+	if c.ExpiresAt == 0 || now.Add(-clockSkew).Unix() > c.ExpiresAt {
+		return errors.New("ID token has expired")
+	}
+
+	if now.Add(clockSkew).Unix() < c.IssuedAt {
+		return errors.New("ID token is issued in the future")
+	}
+	return nil
+}
+
+// Verify checks an ID token as OpenID Connect Core 3.1.3.7 asks for.
+func (p *Provider) Verify(token string, nonce string, now time.Time) (IDClaims, error) {
+	claims := IDClaims{}
+	if err := p.keys.Parse(token, &claims); err != nil {
+		return IDClaims{}, errors.New("invalid ID token: " + err.Error())
+	}
+
+	if err := claims.validAt(now); err != nil {
+		return IDClaims{}, err
+	}
+
+	if claims.Issuer != p.config.Issuer {
+		return IDClaims{}, errors.New("unexpected ID token issuer")
+	}
+
+	if !claims.Audience.contains(p.config.ClientID) {
+		return IDClaims{}, errors.New("ID token is not meant for this client")
+	}
+
+	if len(claims.Audience) > 1 && claims.AuthorizedParty != p.config.ClientID {
+		return IDClaims{}, errors.New("ID token is not meant for this client")
+	}
+
+	if subtle.ConstantTimeCompare([]byte(claims.Nonce), []byte(nonce)) != 1 {
+		return IDClaims{}, errors.New("ID token nonce does not match")
+	}
+
+	if len(claims.Subject) == 0 {
+		return IDClaims{}, errors.New("ID token has no subject")
+	}
+
+	return claims, nil
+}
@@ -0,0 +1,193 @@
+// Package oidc logs users in with an OpenID Connect provider through the
+// authorization code flow with PKCE, RFC 7636.
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/philanton/cake-service/pkg/jwt"
+)
+
+const (
+	defaultKeyRefresh = 5 * time.Minute
+	requestTimeout    = 10 * time.Second
+	// clockSkew is how far the clock of the provider may be off.
+	clockSkew = time.Minute
+)
+
+var defaultScopes = []string{"openid", "email"}
+
+// Config registers this service as a client of the provider at Issuer.
+// RedirectURL has to match the one registered with the provider.
+type Config struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	Scopes       []string
+}
+
+type discovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+type Provider struct {
+	config   Config
+	authURL  string
+	tokenURL string
+	keys     *jwt.RemoteKeySet
+	client   *http.Client
+}
+
+// NewProvider reads the endpoints and keys of the provider from its
+// discovery document.
+func NewProvider(ctx context.Context, c Config) (*Provider, error) {
+	if len(c.Issuer) == 0 || len(c.ClientID) == 0 || len(c.RedirectURL) == 0 {
+		return nil, errors.New("issuer, client id and redirect url are required")
+	}
+
+	if len(c.Scopes) == 0 {
+		c.Scopes = defaultScopes
+	}
+
+	p := &Provider{config: c, client: &http.Client{Timeout: requestTimeout}}
+
+	wellKnown := strings.TrimSuffix(c.Issuer, "/") + "/.well-known/openid-configuration"
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, wellKnown, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("could not discover provider: " + resp.Status)
+	}
+
+	d := discovery{}
+	if err = json.NewDecoder(resp.Body).Decode(&d); err != nil {
+		return nil, errors.New("could not read discovery document: " + err.Error())
+	}
+
+	// the issuer of the document is the one ID tokens have to name
+	if d.Issuer != c.Issuer {
+		return nil, errors.New("provider claims to be issuer \"" + d.Issuer + "\"")
+	}
+
+	if len(d.AuthorizationEndpoint) == 0 || len(d.TokenEndpoint) == 0 || len(d.JWKSURI) == 0 {
+		return nil, errors.New("discovery document lacks endpoints")
+	}
+
+	p.authURL, p.tokenURL = d.AuthorizationEndpoint, d.TokenEndpoint
+	if p.keys, err = jwt.LoadRemoteKeySet(d.JWKSURI, defaultKeyRefresh); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+func (p *Provider) Issuer() string {
+	return p.config.Issuer
+}
+
+// RandomString returns 32 random bytes base64url encoded, what state, nonce
+// and code verifier are made of.
+func RandomString() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// Challenge is the S256 code challenge of verifier.
+func Challenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// AuthCodeURL is where to send the user to log in. The caller keeps state,
+// nonce and verifier to complete the login with Exchange.
+func (p *Provider) AuthCodeURL(state string, nonce string, verifier string) string {
+	params := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.config.ClientID},
+		"redirect_uri":          {p.config.RedirectURL},
+		"scope":                 {strings.Join(p.config.Scopes, " ")},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {Challenge(verifier)},
+		"code_challenge_method": {"S256"},
+	}
+
+	sep := "?"
+	if strings.Contains(p.authURL, "?") {
+		sep = "&"
+	}
+	return p.authURL + sep + params.Encode()
+}
+
+type tokenResponse struct {
+	IDToken          string `json:"id_token"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+// Exchange trades code for an ID token and verifies it was issued to this
+// client for nonce.
+func (p *Provider) Exchange(ctx context.Context, code string, nonce string, verifier string) (IDClaims, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.config.RedirectURL},
+		"client_id":     {p.config.ClientID},
+		"code_verifier": {verifier},
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return IDClaims{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if len(p.config.ClientSecret) != 0 {
+		req.SetBasicAuth(url.QueryEscape(p.config.ClientID), url.QueryEscape(p.config.ClientSecret))
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return IDClaims{}, err
+	}
+	defer resp.Body.Close()
+
+	body := tokenResponse{}
+	if err = json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return IDClaims{}, errors.New("could not read token response: " + resp.Status)
+	}
+
+	if len(body.Error) != 0 {
+		return IDClaims{}, errors.New("provider refused the code: " + body.Error + " " + body.ErrorDescription)
+	}
+
+	if resp.StatusCode != http.StatusOK || len(body.IDToken) == 0 {
+		return IDClaims{}, errors.New("provider returned no ID token: " + resp.Status)
+	}
+
+	return p.Verify(body.IDToken, nonce, time.Now())
+}
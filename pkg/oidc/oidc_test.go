@@ -0,0 +1,156 @@
+package oidc_test
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/philanton/cake-service/pkg/oidc"
+	"github.com/philanton/cake-service/pkg/oidc/oidctest"
+)
+
+func newTestProvider(t *testing.T) (*oidctest.Server, *oidc.Provider) {
+	idp := oidctest.NewServer("cake", "secret")
+	t.Cleanup(idp.Close)
+
+	p, err := oidc.NewProvider(context.Background(), oidc.Config{
+		Issuer:       idp.Issuer(),
+		ClientID:     "cake",
+		ClientSecret: "secret",
+		RedirectURL:  "http://cake.test/callback",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return idp, p
+}
+
+// authorize follows AuthCodeURL and returns the code the provider redirects
+// back with.
+func authorize(t *testing.T, p *oidc.Provider, state string, nonce string, verifier string) string {
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+
+	resp, err := client.Get(p.AuthCodeURL(state, nonce, verifier))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	location, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := location.Query().Get("state"); got != state {
+		t.Fatalf("state = %q, want %q", got, state)
+	}
+	return location.Query().Get("code")
+}
+
+func TestProvider_Exchange(t *testing.T) {
+	idp, p := newTestProvider(t)
+	idp.SetIdentity(oidctest.Identity{Subject: "42", Email: "test@mail.com", EmailVerified: true})
+
+	t.Run("logging in", func(t *testing.T) {
+		code := authorize(t, p, "state", "nonce", "verifier")
+		claims, err := p.Exchange(context.Background(), code, "nonce", "verifier")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if claims.Subject != "42" || claims.Email != "test@mail.com" || !claims.EmailVerified {
+			t.Errorf("claims = %+v", claims)
+		}
+	})
+
+	t.Run("using a code twice", func(t *testing.T) {
+		code := authorize(t, p, "state", "nonce", "verifier")
+		if _, err := p.Exchange(context.Background(), code, "nonce", "verifier"); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := p.Exchange(context.Background(), code, "nonce", "verifier"); err == nil {
+			t.Error("expected the used code to be refused")
+		}
+	})
+
+	t.Run("presenting another verifier", func(t *testing.T) {
+		code := authorize(t, p, "state", "nonce", "verifier")
+		if _, err := p.Exchange(context.Background(), code, "nonce", "other"); err == nil {
+			t.Error("expected the code to be refused without its verifier")
+		}
+	})
+
+	t.Run("expecting another nonce", func(t *testing.T) {
+		code := authorize(t, p, "state", "nonce", "verifier")
+		if _, err := p.Exchange(context.Background(), code, "other", "verifier"); err == nil {
+			t.Error("expected the ID token to be refused")
+		}
+	})
+}
+
+func TestProvider_Verify(t *testing.T) {
+	idp, p := newTestProvider(t)
+	now := time.Now()
+
+	valid := oidc.IDClaims{
+		Issuer:    idp.Issuer(),
+		Subject:   "42",
+		Audience:  []string{"cake"},
+		ExpiresAt: now.Add(time.Hour).Unix(),
+		IssuedAt:  now.Unix(),
+		Nonce:     "nonce",
+	}
+
+	tests := []struct {
+		name  string
+		edit  func(*oidc.IDClaims)
+		valid bool
+	}{
+		{"valid", func(*oidc.IDClaims) {}, true},
+		{"several audiences", func(c *oidc.IDClaims) {
+			c.Audience = []string{"other", "cake"}
+			c.AuthorizedParty = "cake"
+		}, true},
+		{"several audiences without azp", func(c *oidc.IDClaims) { c.Audience = []string{"other", "cake"} }, false},
+		{"another audience", func(c *oidc.IDClaims) { c.Audience = []string{"other"} }, false},
+		{"another issuer", func(c *oidc.IDClaims) { c.Issuer = "http://evil.test" }, false},
+		{"another nonce", func(c *oidc.IDClaims) { c.Nonce = "other" }, false},
+		{"expired", func(c *oidc.IDClaims) { c.ExpiresAt = now.Add(-time.Hour).Unix() }, false},
+		{"no subject", func(c *oidc.IDClaims) { c.Subject = "" }, false},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			claims := valid
+			tc.edit(&claims)
+
+			token, err := idp.Sign(claims)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err = p.Verify(token, "nonce", now); (err == nil) != tc.valid {
+				t.Errorf("Verify() error = %v, want valid %v", err, tc.valid)
+			}
+		})
+	}
+}
+
+func TestNewProvider(t *testing.T) {
+	idp := oidctest.NewServer("cake", "secret")
+	defer idp.Close()
+
+	_, err := oidc.NewProvider(context.Background(), oidc.Config{
+		Issuer:      idp.Issuer() + "/",
+		ClientID:    "cake",
+		RedirectURL: "http://cake.test/callback",
+	})
+	if err == nil {
+		t.Error("expected an issuer differing from the discovery document to be refused")
+	}
+}
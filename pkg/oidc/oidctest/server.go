@@ -0,0 +1,268 @@
+// Package oidctest runs an OpenID Connect provider in process, for tests.
+// It logs everybody in as the identity it is given, without asking.
+package oidctest
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"time"
+
+	jwtgo "github.com/dgrijalva/jwt-go"
+	"github.com/philanton/cake-service/pkg/jwt"
+	"github.com/philanton/cake-service/pkg/oidc"
+)
+
+const (
+	keyID    = "oidctest"
+	codeTTL  = time.Minute
+	tokenTTL = time.Hour
+)
+
+// Identity is who the provider says logs in. An empty Subject makes the
+// provider deny every login.
+type Identity struct {
+	Subject       string
+	Email         string
+	EmailVerified bool
+}
+
+type grant struct {
+	clientID    string
+	redirectURI string
+	nonce       string
+	challenge   string
+	identity    Identity
+	expiresAt   time.Time
+}
+
+// Server knows a single client. Codes work once and only with the verifier
+// of the challenge they were issued for.
+type Server struct {
+	*httptest.Server
+	ClientID     string
+	ClientSecret string
+
+	key *rsa.PrivateKey
+
+	lock     sync.Mutex
+	identity Identity
+	codes    map[string]grant
+}
+
+func NewServer(clientID string, clientSecret string) *Server {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(err)
+	}
+
+	s := &Server{
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		key:          key,
+		codes:        map[string]grant{},
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", s.discovery)
+	mux.HandleFunc("/authorize", s.authorize)
+	mux.HandleFunc("/token", s.token)
+	mux.HandleFunc("/jwks", s.jwks)
+	s.Server = httptest.NewServer(mux)
+
+	return s
+}
+
+func (s *Server) Issuer() string {
+	return s.URL
+}
+
+// SetIdentity sets who the next logins are of.
+func (s *Server) SetIdentity(id Identity) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.identity = id
+}
+
+// Sign signs claims with the key of the provider, to forge ID tokens.
+func (s *Server) Sign(claims oidc.IDClaims) (string, error) {
+	token := jwtgo.NewWithClaims(jwtgo.SigningMethodRS256, claims)
+	token.Header["kid"] = keyID
+	return token.SignedString(s.key)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func tokenError(w http.ResponseWriter, code string, description string) {
+	writeJSON(w, http.StatusBadRequest, map[string]string{"error": code, "error_description": description})
+}
+
+func (s *Server) discovery(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"issuer":                                s.URL,
+		"authorization_endpoint":                s.URL + "/authorize",
+		"token_endpoint":                        s.URL + "/token",
+		"jwks_uri":                              s.URL + "/jwks",
+		"response_types_supported":              []string{"code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"code_challenge_methods_supported":      []string{"S256"},
+	})
+}
+
+func (s *Server) jwks(w http.ResponseWriter, r *http.Request) {
+	b64 := base64.RawURLEncoding.EncodeToString
+	writeJSON(w, http.StatusOK, jwt.JWKS{Keys: []jwt.JWK{{
+		Kty: "RSA",
+		Kid: keyID,
+		Use: "sig",
+		Alg: "RS256",
+		N:   b64(s.key.N.Bytes()),
+		E:   b64(big.NewInt(int64(s.key.E)).Bytes()),
+	}}})
+}
+
+// authorize approves right away and sends the user back with a code.
+func (s *Server) authorize(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if q.Get("client_id") != s.ClientID {
+		http.Error(w, "unknown client", http.StatusBadRequest)
+		return
+	}
+
+	redirect, err := url.Parse(q.Get("redirect_uri"))
+	if err != nil || !redirect.IsAbs() {
+		http.Error(w, "invalid redirect_uri", http.StatusBadRequest)
+		return
+	}
+
+	params := redirect.Query()
+	params.Set("state", q.Get("state"))
+
+	s.lock.Lock()
+	identity := s.identity
+	s.lock.Unlock()
+
+	switch {
+	case q.Get("response_type") != "code":
+		params.Set("error", "unsupported_response_type")
+	case q.Get("code_challenge_method") != "S256" || len(q.Get("code_challenge")) == 0:
+		params.Set("error", "invalid_request")
+	case len(identity.Subject) == 0:
+		params.Set("error", "access_denied")
+	default:
+		code, err := oidc.RandomString()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		s.lock.Lock()
+		s.codes[code] = grant{
+			clientID:    s.ClientID,
+			redirectURI: redirect.String(),
+			nonce:       q.Get("nonce"),
+			challenge:   q.Get("code_challenge"),
+			identity:    identity,
+			expiresAt:   time.Now().Add(codeTTL),
+		}
+		s.lock.Unlock()
+
+		params.Set("code", code)
+	}
+
+	redirect.RawQuery = params.Encode()
+	http.Redirect(w, r, redirect.String(), http.StatusFound)
+}
+
+func (s *Server) token(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		tokenError(w, "invalid_request", err.Error())
+		return
+	}
+
+	clientID, secret, ok := r.BasicAuth()
+	if ok {
+		clientID, _ = url.QueryUnescape(clientID)
+		secret, _ = url.QueryUnescape(secret)
+	} else {
+		clientID, secret = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+	}
+
+	if clientID != s.ClientID || subtle.ConstantTimeCompare([]byte(secret), []byte(s.ClientSecret)) != 1 {
+		tokenError(w, "invalid_client", "unknown client or wrong secret")
+		return
+	}
+
+	if r.PostForm.Get("grant_type") != "authorization_code" {
+		tokenError(w, "unsupported_grant_type", "only authorization_code is supported")
+		return
+	}
+
+	code := r.PostForm.Get("code")
+	s.lock.Lock()
+	g, ok := s.codes[code]
+	delete(s.codes, code)
+	s.lock.Unlock()
+
+	if !ok || time.Now().After(g.expiresAt) || g.clientID != clientID {
+		tokenError(w, "invalid_grant", "unknown or used code")
+		return
+	}
+
+	if r.PostForm.Get("redirect_uri") != g.redirectURI {
+		tokenError(w, "invalid_grant", "redirect_uri does not match")
+		return
+	}
+
+	if oidc.Challenge(r.PostForm.Get("code_verifier")) != g.challenge {
+		tokenError(w, "invalid_grant", "code_verifier does not match")
+		return
+	}
+
+	now := time.Now()
+	idToken, err := s.Sign(oidc.IDClaims{
+		Issuer:        s.URL,
+		Subject:       g.identity.Subject,
+		Audience:      []string{clientID},
+		ExpiresAt:     now.Add(tokenTTL).Unix(),
+		IssuedAt:      now.Unix(),
+		Nonce:         g.nonce,
+		Email:         g.identity.Email,
+		EmailVerified: g.identity.EmailVerified,
+	})
+	if err != nil {
+		tokenError(w, "server_error", err.Error())
+		return
+	}
+
+	accessToken, err := oidc.RandomString()
+	if err != nil {
+		tokenError(w, "server_error", err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"access_token": accessToken,
+		"token_type":   "Bearer",
+		"expires_in":   int64(tokenTTL.Seconds()),
+		"id_token":     idToken,
+	})
+}